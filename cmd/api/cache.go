@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/lib/pq"
+)
+
+// listenForInvalidations drops what the triggers of migration 000015 announce
+// from the read cache, the changes of every instance arrive here
+func (a *applicationDependencies) listenForInvalidations(ctx context.Context) {
+	readCache := a.commentModel.Cache
+	if readCache == nil {
+		return
+	}
+
+	listener := pq.NewListener(a.config.db.dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			a.logger.Error(err.Error(), "listener", data.InvalidationChannel)
+		}
+	})
+	defer listener.Close()
+
+	err := listener.Listen(data.InvalidationChannel)
+	if err != nil {
+		a.logger.Error(err.Error(), "listener", data.InvalidationChannel)
+		return
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-listener.Notify:
+			// a nil notification means the connection was re-established,
+			// what changed meanwhile is unknown
+			if notification == nil {
+				readCache.Clear()
+				continue
+			}
+			err := readCache.Invalidate(notification.Extra)
+			if err != nil {
+				a.logger.Error(err.Error(), "listener", data.InvalidationChannel)
+			}
+		case <-ping.C:
+			go listener.Ping()
+		}
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	_ "encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 
 	// import the data package which contains the definition for Comment
@@ -16,8 +15,9 @@ func (a *applicationDependencies) createCommentHandler(w http.ResponseWriter, r
 	// create a struct to hold a comment
 	// we use struct tags [``] to make the names display in lowercase
 	var incomingData struct {
-		Content string `json:"content"`
-		Author  string `json:"author"`
+		Content  string `json:"content"`
+		Author   string `json:"author"`
+		ParentID *int64 `json:"parent_id"`
 	}
 
 	// perform the decoding
@@ -31,41 +31,98 @@ func (a *applicationDependencies) createCommentHandler(w http.ResponseWriter, r
 	// At this point in our code the JSON is well-formed JSON so now
 	// we will validate it using the Validators which expects a Comment
 	comment := &data.Comment{
-		Content: incomingData.Content,
-		Author:  incomingData.Author,
+		Content:  incomingData.Content,
+		Author:   incomingData.Author,
+		ParentID: incomingData.ParentID,
 	}
+	if !a.insertComment(w, r, comment, nil) {
+		return
+	}
+
+	// Set a Location header. The path to the newly created comment
+	headers := make(http.Header)
+	headers.Set("Location", versionPath(r, "/comments/%d", comment.ID))
+
+	// Send a JSON response with 201 (new resource created) status code
+	data := envelope{
+		"comment": a.commentView(r, data.CommentFields, comment),
+	}
+	err = a.writeJson(w, r, http.StatusCreated, data, headers)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// insertComment validates, moderates and stores a new comment, optionally in a thread.
+// It returns false when an error response has already been sent
+func (a *applicationDependencies) insertComment(w http.ResponseWriter, r *http.Request, comment *data.Comment, thread *data.Thread) bool {
+	comment.Status = data.StatusApproved
+	// hold the comment back until a moderator approves it
+	if a.config.moderation.preModerate {
+		comment.Status = data.StatusPending
+	}
+	if thread != nil {
+		comment.ThreadID = &thread.ID
+		// a thread can ask for pre-moderation even if the rest of the site does not
+		if thread.PreModeration {
+			comment.Status = data.StatusPending
+		}
+	}
+
 	// Intialize Validator instance
 	v := validator.New()
 	// Do the validation
 	data.ValidateComment(v, comment)
+	err := a.checkParentComment(v, comment)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return false
+	}
 	if !v.IsEmpty() {
 		a.failedValidationResponse(w, r, v.Errors)
-		return
+		return false
+	}
+
+	// Run the moderation rules, the comment may be rejected or held back
+	decision, ok := a.checkModerationRules(w, r, comment)
+	if !ok {
+		return false
 	}
 
-	// Add the comment to the database table
+	// Add the comment to the database table, along with its mentions and the comment.created event
 	err = a.commentModel.Insert(comment)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
-		return
+		return false
 	}
+	a.finishModerationRules(comment, decision)
 
-	// for now display the result
-	fmt.Fprintf(w, "%+v\n", incomingData)
-
-	// Set a Location header. The path to the newly created comment
-	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/comments/%d", comment.ID))
+	return true
+}
 
-	// Send a JSON response with 201 (new resource created) status code
-	data := envelope{
-		"comment": comment,
+// checkParentComment makes sure a reply answers an existing comment in its own thread
+func (a *applicationDependencies) checkParentComment(v *validator.Validator, comment *data.Comment) error {
+	if comment.ParentID == nil {
+		return nil
 	}
-	err = a.writeJson(w, http.StatusCreated, data, headers)
+
+	// a reply to a comment that was just posted must find it, a replica may not have it yet
+	parent, err := a.commentModel.Primary().Get(*comment.ParentID)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
-		return
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("parent_id", "must be an existing comment")
+			return nil
+		default:
+			return err
+		}
 	}
+
+	sameThread := (parent.ThreadID == nil && comment.ThreadID == nil) ||
+		(parent.ThreadID != nil && comment.ThreadID != nil && *parent.ThreadID == *comment.ThreadID)
+	v.Check(sameThread, "parent_id", "must be a comment in the same thread")
+	return nil
 }
 
 func (a *applicationDependencies) displayCommentHandler(w http.ResponseWriter, r *http.Request) {
@@ -77,8 +134,18 @@ func (a *applicationDependencies) displayCommentHandler(w http.ResponseWriter, r
 		return
 	}
 
-	//Call Get() to retrieve the comment with the specified id
-	comment, err := a.commentModel.Get(id)
+	queryParameters := r.URL.Query()
+	v := validator.New()
+	// e.g. include=author,parent.author
+	includes := a.readIncludes(queryParameters, v)
+	fields := a.readCommentFields(r, queryParameters, v).Require(includes.requiredFields()...)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	//Call GetPublished() to retrieve the comment with the specified id, unless it awaits moderation or was turned down
+	comment, err := a.comments(r).GetPublished(id, fields)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -89,10 +156,19 @@ func (a *applicationDependencies) displayCommentHandler(w http.ResponseWriter, r
 		return
 	}
 	// display the comment
+	included, err := a.loadIncluded(r, []*data.Comment{comment}, includes)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
 	data := envelope{
-		"comment": comment,
+		"comment": a.commentView(r, fields, comment),
+	}
+	if len(includes) > 0 {
+		data["included"] = included
 	}
-	err = a.writeJson(w, http.StatusOK, data, nil)
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -108,7 +184,7 @@ func (a *applicationDependencies) updateCommentHandler(w http.ResponseWriter, r
 	}
 
 	// Call Get() to retrieve the comment with specified id
-	comment, err := a.commentModel.Get(id)
+	comment, err := a.comments(r).Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -138,6 +214,10 @@ func (a *applicationDependencies) updateCommentHandler(w http.ResponseWriter, r
 	// We need to now check the fields to see which ones need updating
 	// if incomingData.Content is nil, no update done
 	if incomingData.Content != nil {
+		// edited content has to be approved again
+		if a.config.moderation.preModerate && *incomingData.Content != comment.Content {
+			comment.Status = data.StatusPending
+		}
 		comment.Content = *incomingData.Content
 	}
 
@@ -154,16 +234,29 @@ func (a *applicationDependencies) updateCommentHandler(w http.ResponseWriter, r
 		return
 	}
 
+	// the edited content has to pass the moderation rules too
+	decision, ok := a.checkModerationRules(w, r, comment)
+	if !ok {
+		return
+	}
+
 	// perform the update
 	err = a.commentModel.Update(comment)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			a.editConflictResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
+	a.finishModerationRules(comment, decision)
+
 	data := envelope{
-		"comment": comment,
+		"comment": a.commentView(r, data.CommentFields, comment),
 	}
-	err = a.writeJson(w, http.StatusOK, data, nil)
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -188,23 +281,36 @@ func (a *applicationDependencies) deleteCommentHandler(w http.ResponseWriter, r
 		}
 		return
 	}
+
 	// display the comment
 	data := envelope{
 		"message": "comment successfully deleted",
 	}
-	err = a.writeJson(w, http.StatusOK, data, nil)
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
 }
 
+// the orders of a comment list, also used by the OpenAPI document
+var commentSortSafeList = []string{"id", "author", "likes", "reactions", "relevance",
+	"created_at", "updated_at",
+	"-id", "-author", "-likes", "-reactions", "-relevance", "-created_at", "-updated_at"}
+
 // create the list handler
 func (a *applicationDependencies) ListCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	// ?thread= limits the list to the comments of one thread
+	a.listComments(w, r, a.getSingleQueryParameter(r.URL.Query(), "thread", ""))
+}
+
+// listComments sends a page of comments, threadKey may be empty for all comments
+func (a *applicationDependencies) listComments(w http.ResponseWriter, r *http.Request, threadKey string) {
 	// create a struct to hold the query parameters
 	// no field name for the type data.Filters
 	var queryParametersData struct {
 		Content string
 		Author  string
+		Search  string
 		data.Filters
 	}
 	// get the query parameters from the URL
@@ -219,8 +325,14 @@ func (a *applicationDependencies) ListCommentsHandler(w http.ResponseWriter, r *
 		queryParameters,
 		"author", "")
 
+	// ?q= is a web search style query, e.g. "exact phrase" or -excluded
+	queryParametersData.Search = a.getSingleQueryParameter(
+		queryParameters,
+		"q", "")
+
 	// create a new validator instance
 	v := validator.New()
+	v.Check(len(queryParametersData.Search) <= 200, "q", "must not be more than 200 bytes long")
 
 	queryParametersData.Filters.Page = a.getSingleIntegerParameter(
 		queryParameters, "page", 1, v)
@@ -228,10 +340,31 @@ func (a *applicationDependencies) ListCommentsHandler(w http.ResponseWriter, r *
 	queryParametersData.Filters.PageSize = a.getSingleIntegerParameter(
 		queryParameters, "page_size", 10, v)
 
+	// search results come best match first unless asked otherwise
+	defaultSort := "id"
+	if queryParametersData.Search != "" {
+		defaultSort = "-relevance"
+	}
 	queryParametersData.Filters.Sort = a.getSingleQueryParameter(
-		queryParameters, "sort", "id")
+		queryParameters, "sort", defaultSort)
 
-	queryParametersData.Filters.SortSafeList = []string{"id", "author", "-id", "-author"}
+	queryParametersData.Filters.SortSafeList = commentSortSafeList
+
+	// only the comments of a time range
+	queryParametersData.Filters.CreatedAfter = a.getSingleTimeParameter(
+		queryParameters, "created_after", v)
+	queryParametersData.Filters.CreatedBefore = a.getSingleTimeParameter(
+		queryParameters, "created_before", v)
+	queryParametersData.Filters.UpdatedSince = a.getSingleTimeParameter(
+		queryParameters, "updated_since", v)
+
+	// e.g. filter=author:eq:alice AND version:gte:2
+	queryParametersData.Filters.Filter = queryParameters["filter"]
+	queryParametersData.Filters.FilterSafeList = data.CommentFilterFields
+
+	// e.g. fields=id,content
+	includes := a.readIncludes(queryParameters, v)
+	fields := a.readCommentFields(r, queryParameters, v).Require(includes.requiredFields()...)
 
 	// Check if our filters are valid
 	data.ValidateFilters(v, queryParametersData.Filters)
@@ -241,18 +374,28 @@ func (a *applicationDependencies) ListCommentsHandler(w http.ResponseWriter, r *
 		return
 	}
 
-	comments, metadata, err := a.commentModel.GetAll(queryParametersData.Content, queryParametersData.Author, queryParametersData.Filters)
+	comments, metadata, err := a.comments(r).GetAll(queryParametersData.Content, queryParametersData.Author,
+		threadKey, queryParametersData.Search, queryParametersData.Filters, fields)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	included, err := a.loadIncluded(r, comments, includes)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
 	}
 
 	data := envelope{
-		"comments":  comments,
+		"comments":  a.commentViews(r, fields, comments),
 		"@metadata": metadata,
 	}
+	if len(includes) > 0 {
+		data["included"] = included
+	}
 
-	err = a.writeJson(w, http.StatusOK, data, nil)
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
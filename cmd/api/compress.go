@@ -0,0 +1,171 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the gzip writers are reused, a new one allocates several hundred KB
+var gzipWriters = sync.Pool{New: func() any {
+	return gzip.NewWriter(io.Discard)
+}}
+
+// compress gzips the responses for the clients that accept it. A response
+// smaller than -compress-min-size is sent as it is, compressing it would cost
+// more than it saves
+func (a *applicationDependencies) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, minSize: a.config.compression.minSize, status: http.StatusOK}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsGzip reads Accept-Encoding, e.g. "gzip, deflate, br" or "gzip;q=0"
+func acceptsGzip(header string) bool {
+	accepted := false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		quality := 1.0
+		name, value, found := strings.Cut(strings.TrimSpace(params), "=")
+		if found && strings.TrimSpace(name) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil {
+				quality = q
+			}
+		}
+		// gzip;q=0 says no even when * allows everything
+		if coding == "gzip" {
+			return quality > 0
+		}
+		accepted = quality > 0
+	}
+	return accepted
+}
+
+// compressWriter holds the start of the body back until it knows if the
+// response is large enough to compress, only then the headers go out
+type compressWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	started bool
+	gz      *gzip.Writer // nil when the response is sent as it is
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	// 1xx responses such as 103 Early Hints are not the final response
+	if status < 200 || cw.started {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.started {
+		if !cw.compressible() {
+			err := cw.start(false)
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			cw.buf = append(cw.buf, b...)
+			if len(cw.buf) < cw.minSize {
+				return len(b), nil
+			}
+			err := cw.start(true)
+			if err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// compressible is false for a body that is encoded already and for event
+// streams, whose events must reach the client as soon as they are flushed
+func (cw *compressWriter) compressible() bool {
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		return false
+	}
+	return cw.status != http.StatusNoContent && cw.status != http.StatusNotModified
+}
+
+// start sends the headers and what was held back
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	if compress {
+		cw.Header().Set("Content-Encoding", "gzip")
+		cw.Header().Del("Content-Length")
+		cw.gz = gzipWriters.Get().(*gzip.Writer)
+		cw.gz.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.gz != nil {
+		_, err = cw.gz.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Close sends a small response or ends the gzip stream
+func (cw *compressWriter) Close() error {
+	if !cw.started {
+		return cw.start(false)
+	}
+	if cw.gz == nil {
+		return nil
+	}
+	err := cw.gz.Close()
+	gzipWriters.Put(cw.gz)
+	cw.gz = nil
+	return err
+}
+
+// Flush sends what is held back as it is, there is no point in waiting for more
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		cw.start(false)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the writer underneath
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
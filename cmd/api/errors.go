@@ -1,27 +1,87 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/ReynerioSamos/craboo/internal/importer"
+	"github.com/ReynerioSamos/craboo/internal/validator"
 )
 
 func (a *applicationDependencies) logError(r *http.Request, err error) {
 
 	method := r.Method
 	uri := r.URL.RequestURI()
-	a.logger.Error(err.Error(), "method", method, "uri", uri)
+	a.logger.Error(err.Error(), "method", method, "uri", uri, "request_id", requestIDFromContext(r.Context()))
 
 }
 
+// the problem type of validation failures, the other errors are about:blank
+// which means that the title is the HTTP status text
+const problemValidation = "/problems/validation-failed"
+
+// errorResponseJSON sends {"error": message}, or RFC 9457 problem details when
+// the client accepts application/problem+json or -problem-details is set.
+// message is a string or the errors of a failed validation
 func (a *applicationDependencies) errorResponseJSON(w http.ResponseWriter, r *http.Request, status int, message any) {
-	errorData := envelope{"error": message}
-	err := a.writeJson(w, status, errorData, nil)
+	var errorData envelope
+	var headers http.Header
+
+	if a.wantsProblemDetails(r) {
+		errorData = envelope{
+			"type":       "about:blank",
+			"title":      http.StatusText(status),
+			"status":     status,
+			"instance":   r.URL.Path,
+			"request_id": requestIDFromContext(r.Context()),
+		}
+		switch message := message.(type) {
+		case string:
+			errorData["detail"] = message
+		case map[string][]validator.FieldError:
+			errorData["type"] = problemValidation
+			errorData["title"] = "Validation failed"
+			errorData["detail"] = "one or more fields are invalid, see errors"
+			errorData["errors"] = message
+		}
+		headers = http.Header{"Content-Type": []string{"application/problem+json"}}
+	} else {
+		// the old clients only know one message per field
+		if fieldErrors, ok := message.(map[string][]validator.FieldError); ok && !a.config.validation.detailed {
+			messages := make(map[string]string, len(fieldErrors))
+			for key, errs := range fieldErrors {
+				messages[key] = errs[0].Message
+			}
+			message = messages
+		}
+		errorData = envelope{"error": message}
+	}
+
+	err := a.writeJson(w, r, status, errorData, headers)
 	if err != nil {
 		a.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
 
+// wantsProblemDetails tells if the client listed application/problem+json in
+// its Accept header, or if every client gets problem details
+func (a *applicationDependencies) wantsProblemDetails(r *http.Request) bool {
+	if a.config.problemDetails {
+		return true
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(accepted, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), "application/problem+json") &&
+			strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *applicationDependencies) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	a.logError(r, err)
 
@@ -46,6 +106,44 @@ func (a *applicationDependencies) badRequestResponse(w http.ResponseWriter, r *h
 	a.errorResponseJSON(w, r, http.StatusBadRequest, err.Error())
 }
 
-func (a *applicationDependencies) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+// with -validation-errors=detailed or problem details every field has a list
+// of {code, message, params}, otherwise only the first message of every field is sent
+func (a *applicationDependencies) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string][]validator.FieldError) {
 	a.errorResponseJSON(w, r, http.StatusUnprocessableEntity, errors)
 }
+
+// an import can fail because of what the client sent or because of us
+func (a *applicationDependencies) importErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesError):
+		a.badRequestResponse(w, r, fmt.Errorf("the body must not be larger than %d bytes", maxBytesError.Limit))
+	case errors.Is(err, importer.ErrBadInput):
+		a.badRequestResponse(w, r, err)
+	default:
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) tooManySubscribersResponse(w http.ResponseWriter, r *http.Request) {
+	message := "too many clients are streaming right now, please try again later"
+	a.errorResponseJSON(w, r, http.StatusServiceUnavailable, message)
+}
+
+// 409 when the record changed between reading and writing it
+func (a *applicationDependencies) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to update the record due to an edit conflict, please try again"
+	a.errorResponseJSON(w, r, http.StatusConflict, message)
+}
+
+// 409 when the first request with the Idempotency-Key has not finished yet
+func (a *applicationDependencies) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this Idempotency-Key is still being processed, please try again later"
+	a.errorResponseJSON(w, r, http.StatusConflict, message)
+}
+
+// 422 when the Idempotency-Key was first sent with another request
+func (a *applicationDependencies) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the Idempotency-Key was already used for a different request"
+	a.errorResponseJSON(w, r, http.StatusUnprocessableEntity, message)
+}
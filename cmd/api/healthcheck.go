@@ -13,9 +13,13 @@ func (a *applicationDependencies) healthCheckHandler(w http.ResponseWriter,
 			"environment": a.config.environment,
 			"version":     appVersion,
 		},
+		// hits and misses of the read cache of this instance
+		"cache": a.commentModel.Cache.Stats(),
+		// the read replicas and how far behind they were at the last check
+		"replicas": a.replicas.Status(),
 	}
 
-	err := a.writeJson(w, http.StatusOK, data, nil)
+	err := a.writeJson(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
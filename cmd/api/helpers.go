@@ -1,21 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ReynerioSamos/craboo/internal/data"
 	"github.com/ReynerioSamos/craboo/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
 
 // This Method will accept:
 // response write (w)
+// the request (r), for ?pretty=
 // status code to send (default is 200)
 // actual data to encode in Json
 // a map of the headers to set for the response
@@ -23,25 +29,156 @@ import (
 // create and envelope type
 type envelope map[string]any
 
-func (a *applicationDependencies) writeJson(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	jsResponse, err := json.MarshalIndent(data, "", "\t")
-	if err != nil {
-		return err
+func (a *applicationDependencies) writeJson(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	pretty := a.prettyJSON(r)
+	writeHeader := func() {
+		// the headers may replace the content type, e.g. for problem details
+		w.Header().Set("Content-Type", "application/json")
+		for key, value := range headers {
+			w.Header()[key] = value
+			//w.Header().Set(key, value[0])
+		}
+		w.WriteHeader(status)
 	}
-	jsResponse = append(jsResponse, '\n')
-	for key, value := range headers {
-		w.Header()[key] = value
-		//w.Header().Set(key, value[0])
+
+	if !hasLongList(data) {
+		var jsResponse []byte
+		var err error
+		if pretty {
+			jsResponse, err = json.MarshalIndent(data, "", "\t")
+		} else {
+			jsResponse, err = json.Marshal(data)
+		}
+		if err != nil {
+			return err
+		}
+		jsResponse = append(jsResponse, '\n')
+		writeHeader()
+		_, err = w.Write(jsResponse)
+		if err != nil {
+			return err
+		}
+		return nil
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	_, err = w.Write(jsResponse)
+
+	writeHeader()
+	err := writeEnvelope(w, data, pretty)
 	if err != nil {
-		return err
+		// the status is sent already, all that is left is to cut the response short
+		a.logError(r, err)
+		panic(http.ErrAbortHandler)
 	}
 	return nil
 }
 
+// prettyJSON tells if the JSON is indented for people to read. It is in
+// development, ?pretty=true and ?pretty=false decide otherwise
+func (a *applicationDependencies) prettyJSON(r *http.Request) bool {
+	pretty, err := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	if err == nil {
+		return pretty
+	}
+	// the default of -env is spelled developement
+	return a.config.environment == "development" || a.config.environment == "developement"
+}
+
+// a list longer than this is encoded item by item straight to the client
+// instead of the whole response being built in memory first
+const streamListLength = 50
+
+var jsonMarshaler = reflect.TypeFor[json.Marshaler]()
+
+// longList tells if the value is a list to stream, a list that encodes
+// itself or bytes such as json.RawMessage are encoded as usual
+func longList(value any) bool {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice || v.Len() <= streamListLength || v.Type().Elem().Kind() == reflect.Uint8 {
+		return false
+	}
+	return !v.Type().Implements(jsonMarshaler) && !reflect.PointerTo(v.Type()).Implements(jsonMarshaler)
+}
+
+func hasLongList(data envelope) bool {
+	for _, value := range data {
+		if longList(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEnvelope writes what json.Marshal or json.MarshalIndent would, but the
+// long lists of the envelope are encoded one item at a time
+func writeEnvelope(w io.Writer, data envelope, pretty bool) error {
+	marshal := func(value any, prefix string) ([]byte, error) {
+		if pretty {
+			return json.MarshalIndent(value, prefix, "\t")
+		}
+		return json.Marshal(value)
+	}
+	newline := func(indent string) string {
+		if pretty {
+			return "\n" + indent
+		}
+		return ""
+	}
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	buf := bufio.NewWriterSize(w, 32*1024)
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(newline("\t"))
+		name, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		if pretty {
+			buf.WriteByte(' ')
+		}
+
+		if !longList(data[key]) {
+			value, err := marshal(data[key], "\t")
+			if err != nil {
+				return err
+			}
+			buf.Write(value)
+			continue
+		}
+
+		list := reflect.ValueOf(data[key])
+		buf.WriteByte('[')
+		for j := range list.Len() {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(newline("\t\t"))
+			// by address like json.Marshal, for the MarshalJSON methods of pointers
+			item, err := marshal(list.Index(j).Addr().Interface(), "\t\t")
+			if err != nil {
+				return err
+			}
+			buf.Write(item)
+		}
+		buf.WriteString(newline("\t"))
+		buf.WriteByte(']')
+	}
+	if len(keys) > 0 {
+		buf.WriteString(newline(""))
+	}
+	buf.WriteString("}\n")
+	return buf.Flush()
+}
+
 func (a *applicationDependencies) readJson(w http.ResponseWriter, r *http.Request, destination any) error {
 	// what is the max size of the request body (250KB seems reasonable)
 	maxBytes := 256_000
@@ -152,3 +289,41 @@ func (a *applicationDependencies) getSingleIntegerParameter(queryParameters url.
 	}
 	return intValue
 }
+
+// this method accepts an RFC 3339 timestamp such as 2024-05-01T10:00:00Z or a date
+// such as 2024-05-01 (midnight UTC). It returns nil when the parameter is missing
+func (a *applicationDependencies) getSingleTimeParameter(queryParameters url.Values,
+	key string,
+	v *validator.Validator) *time.Time {
+	result := queryParameters.Get(key)
+	if result == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, result)
+	if err != nil {
+		t, err = time.Parse(time.DateOnly, result)
+	}
+	if err != nil {
+		v.AddError(key, "must be an RFC 3339 timestamp or a date (YYYY-MM-DD)")
+		return nil
+	}
+	return &t
+}
+
+// readFieldset narrows the fieldset to fields=id,content. Without the parameter
+// every field is returned. Methods cannot have type parameters so this is a function
+func readFieldset[T any](queryParameters url.Values, fieldset data.Fieldset[T], v *validator.Validator) data.Fieldset[T] {
+	result := queryParameters.Get("fields")
+	if result == "" {
+		return fieldset
+	}
+	names := strings.Split(result, ",")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	selected, err := fieldset.Select(names)
+	if err != nil {
+		v.AddError("fields", err.Error())
+	}
+	return selected
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+)
+
+// idempotent makes a POST safe to retry. The first response to a request with
+// an Idempotency-Key is stored for -idempotency-ttl and sent again for every
+// retry with the same key, so a retried create does not create twice.
+//
+// The same key with another query or body is a 422, a key whose first request
+// is still running a 409. Errors on our side (5xx) are not stored, the retry
+// runs the request again
+func (a *applicationDependencies) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			a.badRequestResponse(w, r, errors.New("the Idempotency-Key header must not be more than 255 characters long"))
+			return
+		}
+
+		// one byte more than readJson allows so that it still sees a body that is too large
+		body, err := io.ReadAll(io.LimitReader(r.Body, 256_000+1))
+		if err != nil {
+			a.badRequestResponse(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(r.URL.RawQuery))
+		hash.Write([]byte{0})
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+		scope := r.Method + " " + r.URL.Path
+
+		stored, err := a.idempotencyModel.Begin(scope, key, fingerprint, a.config.idempotency.ttl)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrIdempotencyKeyInUse):
+				a.idempotencyKeyInUseResponse(w, r)
+			case errors.Is(err, data.ErrIdempotencyKeyMismatch):
+				a.idempotencyKeyMismatchResponse(w, r)
+			default:
+				a.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if stored != nil {
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		// a panic or an error gives the key back
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			if !completed {
+				err := a.idempotencyModel.Release(scope, key)
+				if err != nil {
+					a.logError(r, err)
+				}
+			}
+		}()
+
+		next(recorder, r)
+		if recorder.status >= 500 {
+			return
+		}
+
+		// the ID of this request is not the ID of the replays. The body is
+		// recorded before the compression, which decides again for a replay
+		header := recorder.Header().Clone()
+		header.Del("X-Request-ID")
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		err = a.idempotencyModel.Complete(scope, key, &data.StoredResponse{
+			StatusCode: recorder.status,
+			Header:     header,
+			Body:       recorder.body.Bytes(),
+		})
+		if err != nil {
+			a.logError(r, err)
+			return
+		}
+		completed = true
+	}
+}
+
+// responseRecorder keeps a copy of what the handler writes
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the writer underneath
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// cleanIdempotencyKeys removes the expired keys now and then, an expired key
+// is reused anyway but the table should not grow forever
+func (a *applicationDependencies) cleanIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := a.idempotencyModel.DeleteExpired()
+		if err != nil {
+			a.logger.Error(err.Error(), "component", "idempotency")
+			continue
+		}
+		if deleted > 0 {
+			a.logger.Info("expired idempotency keys deleted", "deleted", deleted)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/importer"
+)
+
+// readImportOptions works out the format and dry_run setting of an import request.
+// ?format= wins over the Content-Type header
+func (a *applicationDependencies) readImportOptions(r *http.Request) (importer.Format, bool, error) {
+	queryParameters := r.URL.Query()
+
+	value := a.getSingleQueryParameter(queryParameters, "format", r.Header.Get("Content-Type"))
+	format, err := importer.ParseFormat(value)
+	if err != nil {
+		return "", false, err
+	}
+
+	dryRun := false
+	switch a.getSingleQueryParameter(queryParameters, "dry_run", "false") {
+	case "true", "1":
+		dryRun = true
+	case "false", "0":
+	default:
+		return "", false, errors.New("dry_run must be true or false")
+	}
+
+	return format, dryRun, nil
+}
+
+// prepareImport lifts the limits that are meant for regular requests.
+// An import can be far larger than 256KB and take far longer than our timeouts
+func (a *applicationDependencies) prepareImport(w http.ResponseWriter, r *http.Request) (context.Context, context.CancelFunc) {
+	r.Body = http.MaxBytesReader(w, r.Body, a.config.imports.maxBytes)
+
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(a.config.imports.timeout)
+	// not every ResponseWriter supports deadlines, the server timeouts apply then
+	_ = rc.SetReadDeadline(deadline)
+	_ = rc.SetWriteDeadline(deadline)
+
+	return context.WithDeadline(r.Context(), deadline)
+}
+
+func (a *applicationDependencies) importCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	format, dryRun, err := a.readImportOptions(r)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	ctx, cancel := a.prepareImport(w, r)
+	defer cancel()
+
+	report, err := importer.Comments(ctx, r.Body, format, dryRun, a.commentModel)
+	if err != nil {
+		a.importErrorResponse(w, r, err)
+		return
+	}
+
+	a.logger.Info("comments imported", "imported", report.Imported,
+		"rejected", report.Rejected, "dry_run", report.DryRun)
+
+	data := envelope{
+		"report": report,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	format, dryRun, err := a.readImportOptions(r)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	ctx, cancel := a.prepareImport(w, r)
+	defer cancel()
+
+	report, err := importer.Users(ctx, r.Body, format, dryRun, a.userModel)
+	if err != nil {
+		a.importErrorResponse(w, r, err)
+		return
+	}
+
+	a.logger.Info("users imported", "imported", report.Imported,
+		"rejected", report.Rejected, "dry_run", report.DryRun)
+
+	data := envelope{
+		"report": report,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
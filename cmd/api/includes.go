@@ -0,0 +1,198 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// An includeTree is what include= asks for, include=author,parent.author
+// gives {author: {}, parent: {author: {}}}
+type includeTree map[string]includeTree
+
+// the relations of a comment. Users and threads have none
+var commentRelations = []string{"author", "parent", "thread"}
+
+// readIncludes reads include=author,parent.thread and checks every path
+func (a *applicationDependencies) readIncludes(queryParameters url.Values, v *validator.Validator) includeTree {
+	tree := includeTree{}
+	for _, path := range a.getMultipleQueryParameters(queryParameters, "include", []string{}) {
+		path = strings.TrimSpace(path)
+		relations := strings.Split(path, ".")
+		if len(relations) > a.config.includes.maxDepth {
+			v.AddError("include", fmt.Sprintf("%q must not be more than %d levels deep", path, a.config.includes.maxDepth))
+			continue
+		}
+
+		node := tree
+		for i, relation := range relations {
+			// only a parent is a comment and has relations of its own
+			if !validator.PermittedValue(relation, commentRelations...) || (i > 0 && relations[i-1] != "parent") {
+				v.AddError("include", fmt.Sprintf("%q is not a relation, must be a path of %s", path, strings.Join(commentRelations, ", ")))
+				break
+			}
+			if node[relation] == nil {
+				node[relation] = includeTree{}
+			}
+			node = node[relation]
+		}
+	}
+	return tree
+}
+
+// requiredFields are the comment fields that the relations are loaded from,
+// they are read even when fields= leaves them out
+func (tree includeTree) requiredFields() []string {
+	fields := []string{}
+	for relation := range tree {
+		switch relation {
+		case "author":
+			fields = append(fields, "author")
+		case "parent":
+			fields = append(fields, "parent_id")
+		case "thread":
+			fields = append(fields, "thread_id")
+		}
+	}
+	return fields
+}
+
+// the shape of included for the OpenAPI document, loadIncluded only sends
+// the kinds that were asked for
+type includedRecords struct {
+	Users    []data.User    `json:"users,omitempty"`
+	Comments []data.Comment `json:"comments,omitempty"`
+	Threads  []data.Thread  `json:"threads,omitempty"`
+}
+
+// the records of a compound document, each one once
+type included struct {
+	users    map[int64]*data.User
+	comments map[int64]*data.Comment
+	threads  map[int64]*data.Thread
+}
+
+// loadIncluded loads the related records of the comments with one query per
+// relation and level. The comments themselves are not repeated
+func (a *applicationDependencies) loadIncluded(r *http.Request, comments []*data.Comment, tree includeTree) (map[string]any, error) {
+	inc := &included{
+		users:    map[int64]*data.User{},
+		comments: map[int64]*data.Comment{},
+		threads:  map[int64]*data.Thread{},
+	}
+	err := a.includeRelations(comments, tree, inc)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, comment := range comments {
+		delete(inc.comments, comment.ID)
+	}
+
+	// a key for every kind that was asked for, even when nothing was found
+	result := map[string]any{}
+	var walk func(tree includeTree)
+	walk = func(tree includeTree) {
+		for relation, subtree := range tree {
+			switch relation {
+			case "author":
+				result["users"] = sortedByID(inc.users, func(user *data.User) int64 { return user.ID })
+			case "parent":
+				parents := sortedByID(inc.comments, func(comment *data.Comment) int64 { return comment.ID })
+				result["comments"] = a.commentViews(r, data.CommentFields, parents)
+			case "thread":
+				result["threads"] = sortedByID(inc.threads, func(thread *data.Thread) int64 { return thread.ID })
+			}
+			walk(subtree)
+		}
+	}
+	walk(tree)
+	return result, nil
+}
+
+func (a *applicationDependencies) includeRelations(comments []*data.Comment, tree includeTree, inc *included) error {
+	if len(comments) == 0 || len(tree) == 0 {
+		return nil
+	}
+
+	if _, ok := tree["author"]; ok {
+		// authors are free text, those that are usernames are included
+		usernames := []string{}
+		for _, comment := range comments {
+			if comment.Author != "" && !slices.Contains(usernames, comment.Author) {
+				usernames = append(usernames, comment.Author)
+			}
+		}
+		users, err := a.userModel.GetByUsernames(usernames)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			inc.users[user.ID] = user
+		}
+	}
+
+	if _, ok := tree["thread"]; ok {
+		ids := []int64{}
+		for _, comment := range comments {
+			if comment.ThreadID != nil && inc.threads[*comment.ThreadID] == nil && !slices.Contains(ids, *comment.ThreadID) {
+				ids = append(ids, *comment.ThreadID)
+			}
+		}
+		if len(ids) > 0 {
+			threads, err := a.threadModel.GetByIDs(ids)
+			if err != nil {
+				return err
+			}
+			for _, thread := range threads {
+				inc.threads[thread.ID] = thread
+			}
+		}
+	}
+
+	subtree, ok := tree["parent"]
+	if !ok {
+		return nil
+	}
+	ids := []int64{}
+	for _, comment := range comments {
+		if comment.ParentID != nil && !slices.Contains(ids, *comment.ParentID) {
+			ids = append(ids, *comment.ParentID)
+		}
+	}
+	missing := slices.DeleteFunc(slices.Clone(ids), func(id int64) bool { return inc.comments[id] != nil })
+	if len(missing) > 0 {
+		parents, err := a.commentModel.GetByIDs(missing)
+		if err != nil {
+			return err
+		}
+		for _, parent := range parents {
+			inc.comments[parent.ID] = parent
+		}
+	}
+
+	// parents that are held for moderation or were deleted are not found
+	parents := []*data.Comment{}
+	for _, id := range ids {
+		if parent := inc.comments[id]; parent != nil {
+			parents = append(parents, parent)
+		}
+	}
+	return a.includeRelations(parents, subtree, inc)
+}
+
+// sortedByID lists the records of a map in a stable order
+func sortedByID[T any](records map[int64]*T, id func(*T) int64) []*T {
+	list := make([]*T, 0, len(records))
+	for _, record := range records {
+		list = append(list, record)
+	}
+	slices.SortFunc(list, func(x, y *T) int { return cmp.Compare(id(x), id(y)) })
+	return list
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// the orders of the mentions of a user
+var mentionSortSafeList = []string{"id", "author", "created_at", "updated_at",
+	"-id", "-author", "-created_at", "-updated_at"}
+
+// lists the comments in which a user was @mentioned
+func (a *applicationDependencies) listUserMentionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	// make sure the user exists so we can tell a 404 from an empty list
+	_, err = a.users(r).Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var filters data.Filters
+	queryParameters := r.URL.Query()
+
+	v := validator.New()
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
+	filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "-id")
+	filters.SortSafeList = mentionSortSafeList
+	filters.CreatedAfter = a.getSingleTimeParameter(queryParameters, "created_after", v)
+	filters.CreatedBefore = a.getSingleTimeParameter(queryParameters, "created_before", v)
+	filters.UpdatedSince = a.getSingleTimeParameter(queryParameters, "updated_since", v)
+	filters.Filter = queryParameters["filter"]
+	filters.FilterSafeList = data.CommentFilterFields
+	fields := a.readCommentFields(r, queryParameters, v)
+
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	comments, metadata, err := a.mentionModel.GetForUser(id, filters, fields)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"comments":  a.commentViews(r, fields, comments),
+		"@metadata": metadata,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
+	"slices"
+
+	"github.com/ReynerioSamos/craboo/internal/validator"
 )
 
 func (a *applicationDependencies) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			err := recover()
+			// a response that was cut short on purpose, net/http closes the connection
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
 			if err != nil {
 				w.Header().Set("Connection", "close")
 				a.serverErrorResponse(w, r, fmt.Errorf("%s", err))
@@ -17,3 +29,80 @@ func (a *applicationDependencies) recoverPanic(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+type contextKey string
+
+const requestIDContextKey = contextKey("request_id")
+
+// requestID gives every request an ID that is logged with its errors and sent
+// back in X-Request-ID. An ID from a proxy in front of us is kept if it looks sane
+func (a *applicationDependencies) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			_, err := rand.Read(b)
+			if err != nil {
+				a.serverErrorResponse(w, r, err)
+				return
+			}
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// validateRequest checks the query parameters and the JSON body of a request
+// against its endpoint, the same description the OpenAPI document is built from.
+// It is meant for development (-openapi-validate), the handlers check everything
+// again
+func (a *applicationDependencies) validateRequest(e endpoint, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := validator.New()
+		for name, values := range r.URL.Query() {
+			i := slices.IndexFunc(e.query, func(p queryParam) bool { return p.name == name })
+			if i < 0 {
+				v.AddError(name, "is not a parameter of this endpoint")
+				continue
+			}
+			e.query[i].check(v, values)
+		}
+
+		if e.body != nil && e.body.value != nil {
+			// one byte more than readJson allows so that it still sees a body that is too large
+			body, err := io.ReadAll(io.LimitReader(r.Body, 256_000+1))
+			if err != nil {
+				a.badRequestResponse(w, r, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			e.body.check(v, body)
+		}
+
+		if !v.IsEmpty() {
+			a.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// lets anyone flag a comment for the moderators
+func (a *applicationDependencies) createReportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	var incomingData struct {
+		Reason string `json:"reason"`
+		UserID *int64 `json:"user_id"`
+	}
+
+	err = a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	report := &data.Report{
+		CommentID: id,
+		UserID:    incomingData.UserID,
+		Reason:    incomingData.Reason,
+	}
+	v := validator.New()
+	data.ValidateReport(v, report)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.moderationModel.InsertReport(report)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"report": report,
+	}
+	err = a.writeJson(w, r, http.StatusCreated, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// lists pending and flagged comments, the most reported first
+func (a *applicationDependencies) moderationQueueHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+	queryParameters := r.URL.Query()
+
+	v := validator.New()
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
+	// the queue has a fixed order
+	filters.Sort = "id"
+	filters.SortSafeList = []string{"id"}
+
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	queue, metadata, err := a.moderationModel.Queue(filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"queue":     a.queueView(r, queue),
+		"@metadata": metadata,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// approves, rejects or hides a batch of comments in one go
+func (a *applicationDependencies) moderateCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	var action data.ModerationAction
+
+	err := a.readJson(w, r, &action)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateModerationAction(v, &action)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.moderationModel.Apply(&action)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	a.logger.Info("comments moderated", "action", action.Action,
+		"moderator", action.Moderator, "comments", len(action.CommentIDs))
+
+	data := envelope{
+		"moderation": action,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/mailer"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// sendNotifications is the outbox consumer that queues the emails caused by an event
+func (a *applicationDependencies) sendNotifications(ctx context.Context, event *data.OutboxEvent) error {
+	switch event.Event {
+	case data.EventUserCreated:
+		var user data.User
+		err := json.Unmarshal(event.Payload, &user)
+		if err != nil {
+			return err
+		}
+		return a.emailModel.Enqueue(&event.ID, user.Email, "user_welcome", map[string]any{
+			"fullname": user.Fullname,
+			"username": user.Username,
+		})
+	case data.EventCommentCreated:
+		var comment data.Comment
+		err := json.Unmarshal(event.Payload, &comment)
+		if err != nil {
+			return err
+		}
+		return a.notifyCommentCreated(event.ID, &comment)
+	}
+	return nil
+}
+
+// notifyCommentCreated tells the mentioned users and the author of the parent
+// comment. Nobody hears about a comment that is held for moderation, approving
+// it is a comment.created of its own
+func (a *applicationDependencies) notifyCommentCreated(outboxID int64, comment *data.Comment) error {
+	if comment.Status != data.StatusApproved {
+		return nil
+	}
+
+	// one email per user even if they are mentioned twice or mentioned in a reply to them
+	notified := map[int64]bool{}
+
+	for _, mention := range comment.Mentions {
+		if notified[mention.UserID] {
+			continue
+		}
+		notified[mention.UserID] = true
+
+		user, err := a.userModel.Get(mention.UserID)
+		if err != nil {
+			// the user was deleted in the meantime
+			if errors.Is(err, data.ErrRecordNotFound) {
+				continue
+			}
+			return err
+		}
+		err = a.queueNotification(outboxID, user, comment, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if comment.ParentID == nil {
+		return nil
+	}
+	parent, err := a.commentModel.Get(*comment.ParentID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	// authors are free text, only an author that is a username can be told
+	user, err := a.userModel.GetByUsername(parent.Author)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if notified[user.ID] {
+		return nil
+	}
+	return a.queueNotification(outboxID, user, comment, parent)
+}
+
+// queueNotification queues a mention email, or a reply email when parent is
+// set, unless the user turned them off or wrote the comment themselves
+func (a *applicationDependencies) queueNotification(outboxID int64, user *data.User, comment *data.Comment, parent *data.Comment) error {
+	if strings.EqualFold(user.Username, comment.Author) {
+		return nil
+	}
+
+	prefs, err := a.preferenceModel.Get(user.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	content := map[string]any{
+		"fullname":    user.Fullname,
+		"author":      comment.Author,
+		"content":     comment.Content,
+		"comment_url": a.publicURL(fmt.Sprintf("/%s/comments/%d", a.latestVersion().name, comment.ID)),
+	}
+
+	if parent == nil {
+		if !prefs.Mentions {
+			return nil
+		}
+		content["unsubscribe_url"] = a.unsubscribeURL(user.ID, data.NotifyMentions)
+		return a.emailModel.Enqueue(&outboxID, user.Email, "mention", content)
+	}
+
+	if !prefs.Replies {
+		return nil
+	}
+	content["parent_content"] = parent.Content
+	content["unsubscribe_url"] = a.unsubscribeURL(user.ID, data.NotifyReplies)
+	return a.emailModel.Enqueue(&outboxID, user.Email, "reply", content)
+}
+
+// runDigests queues the daily digest once the digest hour (UTC) has come,
+// it covers the 24 hours before that hour
+func (a *applicationDependencies) runDigests(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().UTC()
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		sendAt := day.Add(time.Duration(a.config.mail.digestHour) * time.Hour)
+		if now.Before(sendAt) {
+			continue
+		}
+
+		queued, err := a.emailModel.RunDigest(day, sendAt.Add(-24*time.Hour), sendAt, a.buildDigest)
+		if err != nil {
+			a.logger.Error(err.Error(), "component", "digest")
+			continue
+		}
+		if queued {
+			a.logger.Info("daily digest queued", "day", day.Format(time.DateOnly))
+		}
+	}
+}
+
+func (a *applicationDependencies) buildDigest(digest *data.Digest) (string, any, error) {
+	comments := []map[string]any{}
+	for _, comment := range digest.Comments {
+		comments = append(comments, map[string]any{
+			"author":  comment.Author,
+			"content": comment.Content,
+			"url":     a.publicURL(fmt.Sprintf("/%s/comments/%d", a.latestVersion().name, comment.ID)),
+		})
+	}
+
+	return "digest", map[string]any{
+		"fullname":        digest.User.Fullname,
+		"comments":        comments,
+		"unsubscribe_url": a.unsubscribeURL(digest.User.ID, data.NotifyDigest),
+	}, nil
+}
+
+// publicURL makes a link that works from inside an email
+func (a *applicationDependencies) publicURL(path string) string {
+	return strings.TrimSuffix(a.config.mail.publicURL, "/") + path
+}
+
+func (a *applicationDependencies) unsubscribeURL(userID int64, kind string) string {
+	token := mailer.UnsubscribeToken(a.config.mail.secret, userID, kind)
+	return a.publicURL("/" + a.latestVersion().name + "/unsubscribe?token=" + url.QueryEscape(token))
+}
+
+func (a *applicationDependencies) displayPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	prefs, err := a.preferenceModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"preferences": prefs,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) updatePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	prefs, err := a.preferenceModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// pointers so that we know which settings the client left out
+	var incomingData struct {
+		Mentions *bool `json:"mentions"`
+		Replies  *bool `json:"replies"`
+		Digest   *bool `json:"digest"`
+	}
+
+	err = a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	if incomingData.Mentions != nil {
+		prefs.Mentions = *incomingData.Mentions
+	}
+	if incomingData.Replies != nil {
+		prefs.Replies = *incomingData.Replies
+	}
+	if incomingData.Digest != nil {
+		prefs.Digest = *incomingData.Digest
+	}
+
+	err = a.preferenceModel.Upsert(prefs)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"preferences": prefs,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET or POST /v1/unsubscribe?token= is the link at the bottom of the emails.
+// POST is what mail clients use for one-click unsubscribe
+func (a *applicationDependencies) unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	token := a.getSingleQueryParameter(r.URL.Query(), "token", "")
+
+	userID, kind, err := mailer.ParseUnsubscribeToken(a.config.mail.secret, token)
+	if err == nil && !validator.PermittedValue(kind, data.NotifyMentions, data.NotifyReplies, data.NotifyDigest, data.NotifyAll) {
+		err = mailer.ErrInvalidToken
+	}
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	prefs, err := a.preferenceModel.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	prefs.Unsubscribe(kind)
+	err = a.preferenceModel.Upsert(prefs)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"message":     "you have been unsubscribed",
+		"preferences": prefs,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
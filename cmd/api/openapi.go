@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// openAPIDocument describes the endpoints of a version as an OpenAPI 3.1
+// document. The schemas are read from the json and validate tags of the data
+// types, a named struct such as Comment becomes a component that the operations
+// refer to
+func openAPIDocument(version apiVersion, endpoints []endpoint) envelope {
+	s := &schemas{components: map[string]any{}, names: map[reflect.Type]string{}, version: version}
+
+	// the errors of every endpoint, see errors.go
+	s.components["FieldError"] = s.schema(reflect.TypeOf(validator.FieldError{}))
+	s.components["ValidationErrors"] = map[string]any{
+		"type":        "object",
+		"description": "the problems of every field, the first message of a field unless the server runs with -validation-errors=detailed",
+		"additionalProperties": map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": ref("FieldError")},
+		}},
+	}
+	s.components["Error"] = map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"error": map[string]any{"oneOf": []any{map[string]any{"type": "string"}, ref("ValidationErrors")}},
+		},
+		"required": []string{"error"},
+	}
+	s.components["Problem"] = map[string]any{
+		"type":        "object",
+		"description": "RFC 9457 problem details, sent when the client accepts application/problem+json",
+		"properties": map[string]any{
+			"type":       map[string]any{"type": "string"},
+			"title":      map[string]any{"type": "string"},
+			"status":     map[string]any{"type": "integer"},
+			"detail":     map[string]any{"type": "string"},
+			"instance":   map[string]any{"type": "string"},
+			"request_id": map[string]any{"type": "string"},
+			"errors":     ref("ValidationErrors"),
+		},
+		"required": []string{"type", "title", "status"},
+	}
+	// the resources first, they keep their plain names
+	for _, value := range []any{data.Comment{}, data.User{}, data.Metadata{}, data.Report{}} {
+		s.component(reflect.TypeOf(version.represent(value)))
+	}
+	errorContent := map[string]any{
+		"application/json":         map[string]any{"schema": ref("Error")},
+		"application/problem+json": map[string]any{"schema": ref("Problem")},
+	}
+
+	paths := map[string]map[string]any{}
+	for _, e := range endpoints {
+		path, parameters := openAPIPath("/" + version.name + e.path)
+		for _, param := range e.query {
+			parameters = append(parameters, param.openAPI())
+		}
+		if e.idempotent() {
+			parameters = append(parameters, map[string]any{"name": "Idempotency-Key", "in": "header",
+				"description": "a retry with the same key gets the first response again instead of running twice",
+				"schema":      map[string]any{"type": "string", "maxLength": 255}})
+		}
+
+		status := e.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		operation := map[string]any{
+			"summary":     e.summary,
+			"operationId": operationID(e),
+			"tags":        []string{e.tag},
+			"responses": map[string]any{
+				strconv.Itoa(status): s.response(status, version, e.result),
+				"default":            map[string]any{"description": "an error", "content": errorContent},
+			},
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if e.body != nil {
+			operation["requestBody"] = s.requestBody(e.body)
+		}
+		if version.deprecated() {
+			operation["deprecated"] = true
+		}
+
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(e.method)] = operation
+	}
+
+	return envelope{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Craboo API " + version.name,
+			"version": appVersion,
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": s.components},
+	}
+}
+
+// openAPIPath turns /v1/comments/:id into /v1/comments/{id} and lists the
+// path parameters
+func openAPIPath(path string) (string, []any) {
+	segments := strings.Split(path, "/")
+	parameters := []any{}
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			continue
+		}
+		name := segment[1:]
+		schema := map[string]any{"type": "string"}
+		if name == "id" {
+			schema = map[string]any{"type": "integer", "format": "int64", "minimum": 1}
+		}
+		parameters = append(parameters, map[string]any{"name": name, "in": "path", "required": true, "schema": schema})
+		segments[i] = "{" + name + "}"
+	}
+	return strings.Join(segments, "/"), parameters
+}
+
+// operationID is e.g. getV1CommentsId
+func operationID(e endpoint) string {
+	id := strings.ToLower(e.method)
+	for _, part := range strings.FieldsFunc(e.path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+func (p queryParam) openAPI() map[string]any {
+	var schema map[string]any
+	switch p.kind {
+	case paramInteger:
+		schema = map[string]any{"type": "integer"}
+	case paramBoolean:
+		schema = map[string]any{"type": "boolean"}
+	case paramList:
+		items := map[string]any{"type": "string"}
+		if len(p.enum) > 0 {
+			items["enum"] = p.enum
+		}
+		schema = map[string]any{"type": "array", "items": items}
+	default:
+		schema = map[string]any{"type": "string"}
+		if len(p.enum) > 0 {
+			schema["enum"] = p.enum
+		}
+	}
+	if p.repeated {
+		schema = map[string]any{"type": "array", "items": schema}
+	}
+
+	param := map[string]any{"name": p.name, "in": "query", "description": p.description, "schema": schema}
+	if p.kind == paramList {
+		// fields=id,content rather than fields=id&fields=content
+		param["style"] = "form"
+		param["explode"] = false
+	}
+	return param
+}
+
+// schemas builds the schemas of the Go types, the named structs go into components
+type schemas struct {
+	components map[string]any
+	names      map[reflect.Type]string
+	version    apiVersion // commentV2 is the Comment of the v2 document
+}
+
+func ref(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func (s *schemas) response(status int, version apiVersion, result *responseBody) map[string]any {
+	response := map[string]any{"description": http.StatusText(status)}
+	if result == nil {
+		return response
+	}
+	if result.contentType != "" {
+		response["content"] = map[string]any{result.contentType: map[string]any{"schema": map[string]any{"type": "string"}}}
+		return response
+	}
+
+	properties := map[string]any{}
+	required := []string{}
+	for key, value := range result.properties {
+		properties[key] = s.schema(reflect.TypeOf(version.represent(value)))
+		if !slices.Contains(result.optional, key) {
+			required = append(required, key)
+		}
+	}
+	slices.Sort(required)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	response["content"] = map[string]any{"application/json": map[string]any{"schema": schema}}
+	return response
+}
+
+func (s *schemas) requestBody(b *requestBody) map[string]any {
+	if b.value == nil {
+		content := map[string]any{}
+		for _, contentType := range b.contentTypes {
+			content[contentType] = map[string]any{"schema": map[string]any{"type": "string"}}
+		}
+		return map[string]any{"required": true, "content": content}
+	}
+
+	properties := map[string]any{}
+	required := []string{}
+	for _, f := range b.structFields() {
+		properties[fieldName(f)] = s.field(f)
+		if !b.partial && slices.Contains(validateRules(f), "required") {
+			required = append(required, fieldName(f))
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return map[string]any{
+		"required": true,
+		"content":  map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+// structFields are the fields of the body in the order of the body
+func (b *requestBody) structFields() []reflect.StructField {
+	t := reflect.TypeOf(b.value)
+	fields := []reflect.StructField{}
+	for _, name := range b.fields {
+		found := false
+		for _, f := range reflect.VisibleFields(t) {
+			if f.IsExported() && !f.Anonymous && fieldName(f) == name {
+				fields = append(fields, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			panic("openapi: " + t.Name() + " has no field " + name)
+		}
+	}
+	return fields
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema is the schema of a Go type as encoding/json writes it
+func (s *schemas) schema(t reflect.Type) map[string]any {
+	if t == nil {
+		return map[string]any{}
+	}
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return nullable(s.schema(t.Elem()))
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		return ref(s.component(t))
+	default:
+		return map[string]any{}
+	}
+}
+
+// component adds a named struct to the components once
+func (s *schemas) component(t reflect.Type) string {
+	name, ok := s.names[t]
+	if ok {
+		return name
+	}
+	name = strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	name = strings.TrimSuffix(name, strings.ToUpper(s.version.name))
+	if _, taken := s.components[name]; taken {
+		// importer.Report next to data.Report
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	s.names[t] = name
+	// recursive types refer to the name before the schema is done
+	s.components[name] = map[string]any{}
+	s.components[name] = s.object(t)
+	return name
+}
+
+// object is the schema of a struct. Fields without omitempty are always sent
+func (s *schemas) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	for _, f := range reflect.VisibleFields(t) {
+		_, options, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || f.Anonymous || f.Tag.Get("json") == "-" {
+			continue
+		}
+		properties[fieldName(f)] = s.field(f)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, fieldName(f))
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// field is the schema of a struct field with the limits of its validate tag
+func (s *schemas) field(f reflect.StructField) map[string]any {
+	t := f.Type
+	pointer := t.Kind() == reflect.Pointer
+	if pointer {
+		t = t.Elem()
+	}
+	schema := s.schema(t)
+	if _, isRef := schema["$ref"]; !isRef {
+		limits(schema, t, f.Tag.Get("validate"))
+	}
+	if pointer {
+		return nullable(schema)
+	}
+	return schema
+}
+
+// limits adds what the validate tag checks to the schema
+func limits(schema map[string]any, t reflect.Type, tag string) {
+	if tag == "" || tag == "-" {
+		return
+	}
+	hasChars := strings.Contains(tag, "maxchars=")
+	for _, part := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(part), "=")
+		n, _ := strconv.Atoi(param)
+		switch {
+		case name == "minchars":
+			schema["minLength"] = n
+		case name == "maxchars":
+			// JSON Schema counts code points, the validator counts what users see
+			schema["maxLength"] = n
+		case (name == "min" || name == "max") && t.Kind() == reflect.String:
+			// in bytes, only a limit of its own when there is no maxchars
+			if name == "min" {
+				schema["minLength"] = n
+			} else if !hasChars {
+				schema["maxLength"] = n
+			}
+		case (name == "min" || name == "max") && t.Kind() == reflect.Slice:
+			schema[name+"Items"] = n
+		case name == "min":
+			schema["minimum"] = n
+		case name == "max":
+			schema["maximum"] = n
+		case name == "oneof":
+			schema["enum"] = strings.Fields(param)
+		case name == "email":
+			schema["format"] = "email"
+		case name == "url":
+			schema["format"] = "uri"
+		case name == "unique":
+			schema["uniqueItems"] = true
+		}
+	}
+}
+
+// nullable allows null next to the schema
+func nullable(schema map[string]any) map[string]any {
+	switch kind := schema["type"].(type) {
+	case string:
+		schema["type"] = []string{kind, "null"}
+		return schema
+	case nil:
+		if _, isRef := schema["$ref"]; !isRef {
+			return schema // any value, null included
+		}
+	}
+	return map[string]any{"oneOf": []any{schema, map[string]any{"type": "null"}}}
+}
+
+// validateRules are the names of the rules of a validate tag
+func validateRules(f reflect.StructField) []string {
+	names := []string{}
+	for _, part := range strings.Split(f.Tag.Get("validate"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		names = append(names, name)
+	}
+	return names
+}
+
+// fieldName is the JSON name of the field
+func fieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// openAPIHandler sends the document of the version that routes() built
+func (a *applicationDependencies) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.writeJson(w, r, http.StatusOK, a.openapi[apiVersionFromContext(r).name], nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// the checks of validateRequest
+
+// check reports the values of a query parameter that the document does not allow
+func (p queryParam) check(v *validator.Validator, values []string) {
+	if !p.repeated && len(values) > 1 {
+		v.AddError(p.name, "must only be given once")
+	}
+	for _, value := range values {
+		switch p.kind {
+		case paramInteger:
+			_, err := strconv.Atoi(value)
+			v.Check(err == nil, p.name, "must be an integer value")
+		case paramBoolean:
+			v.Check(validator.PermittedValue(value, "true", "false", "1", "0"), p.name, "must be true or false")
+		case paramTime:
+			_, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				_, err = time.Parse(time.DateOnly, value)
+			}
+			v.Check(err == nil, p.name, "must be an RFC 3339 timestamp or a date (YYYY-MM-DD)")
+		case paramList:
+			for _, item := range strings.Split(value, ",") {
+				item = strings.TrimSpace(item)
+				if len(p.enum) > 0 {
+					v.CheckPermitted(item, p.name, p.enum...)
+				}
+			}
+		default:
+			if len(p.enum) > 0 {
+				v.CheckPermitted(value, p.name, p.enum...)
+			}
+		}
+	}
+}
+
+// check reports the fields of a JSON body that the document does not allow. A
+// body that is not a JSON object is left to readJson, its errors are better
+func (b *requestBody) check(v *validator.Validator, body []byte) {
+	var object map[string]json.RawMessage
+	if json.Unmarshal(body, &object) != nil {
+		return
+	}
+
+	fields := b.structFields()
+	for name, value := range object {
+		i := slices.IndexFunc(fields, func(f reflect.StructField) bool { return fieldName(f) == name })
+		if i < 0 {
+			v.AddError(name, "is not a field of the body")
+			continue
+		}
+		t := fields[i].Type
+		if string(value) == "null" {
+			v.Check(slices.Contains([]reflect.Kind{reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface}, t.Kind()),
+				name, "must not be null")
+			continue
+		}
+		err := json.Unmarshal(value, reflect.New(t).Interface())
+		v.Check(err == nil, name, "must be "+jsonType(t))
+	}
+
+	if b.partial {
+		return
+	}
+	for _, f := range fields {
+		if _, ok := object[fieldName(f)]; !ok && slices.Contains(validateRules(f), "required") {
+			v.CheckRequired("", fieldName(f))
+		}
+	}
+}
+
+// jsonType is what a value of the type looks like in JSON, for the messages
+func jsonType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array of " + strings.TrimPrefix(strings.TrimPrefix(jsonType(t.Elem()), "a "), "an ") + "s"
+	default:
+		return "an object"
+	}
+}
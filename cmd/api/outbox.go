@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// registerOutboxConsumers lists everything that reacts to the domain events.
+// New side effects of a change belong here instead of in the handlers
+func (a *applicationDependencies) registerOutboxConsumers() {
+	// queue a delivery for every subscribed webhook
+	a.outboxRelay.Register("webhooks", func(ctx context.Context, event *data.OutboxEvent) error {
+		public, err := publicEvent(event)
+		if err != nil || !public {
+			return err
+		}
+		return a.webhookModel.Enqueue(event)
+	})
+	// queue the welcome, mention and reply emails
+	a.outboxRelay.Register("notifications", a.sendNotifications)
+}
+
+// publicEvent tells if an event may leave the system. Like the comment stream,
+// only approved comments are public, a held comment stays with the moderators
+func publicEvent(event *data.OutboxEvent) (bool, error) {
+	switch event.Event {
+	case data.EventCommentCreated, data.EventCommentUpdated:
+		var comment struct {
+			Status string `json:"status"`
+		}
+		err := json.Unmarshal(event.Payload, &comment)
+		if err != nil {
+			return false, err
+		}
+		return comment.Status == data.StatusApproved, nil
+	}
+	return true, nil
+}
+
+// GET /v1/outbox lists the events, ?status=dead shows the dead letters
+func (a *applicationDependencies) listOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+	queryParameters := r.URL.Query()
+
+	v := validator.New()
+	status := a.getSingleQueryParameter(queryParameters, "status", "")
+	v.Check(status == "" || validator.PermittedValue(status, data.OutboxPending, data.OutboxPublished, data.OutboxDead),
+		"status", "must be pending, published or dead")
+
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
+	filters.Sort = "-id"
+	filters.SortSafeList = []string{"-id"}
+
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := a.outboxModel.GetAll(status, filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"events":    events,
+		"@metadata": metadata,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/outbox/:id/retry gives a dead event another go
+func (a *applicationDependencies) retryOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	// only dead events can be retried, the others count as not found
+	event, err := a.outboxModel.Retry(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"event": event,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+// readReaction builds a Reaction from /v1/comments/:id/reactions/:kind?user_id=
+func (a *applicationDependencies) readReaction(r *http.Request, v *validator.Validator) (*data.Reaction, error) {
+	commentID, err := a.readIDParam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	reaction := &data.Reaction{
+		CommentID: commentID,
+		UserID:    int64(a.getSingleIntegerParameter(r.URL.Query(), "user_id", 0, v)),
+		Kind:      params.ByName("kind"),
+	}
+	data.ValidateReaction(v, reaction, a.config.reactions.kinds)
+
+	return reaction, nil
+}
+
+func (a *applicationDependencies) addReactionHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	reaction, err := a.readReaction(r, v)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// a second PUT of the same reaction changes nothing
+	err = a.reactionModel.Insert(reaction)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	a.writeReactionCounts(w, r, reaction.CommentID)
+}
+
+func (a *applicationDependencies) removeReactionHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	reaction, err := a.readReaction(r, v)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.reactionModel.Delete(reaction)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	a.writeReactionCounts(w, r, reaction.CommentID)
+}
+
+// send back the new totals so the client can update its counters
+func (a *applicationDependencies) writeReactionCounts(w http.ResponseWriter, r *http.Request, commentID int64) {
+	counts, err := a.reactionModel.Counts(commentID)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"comment_id": commentID,
+		"reactions":  counts,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
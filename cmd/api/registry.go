@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/julienschmidt/httprouter"
+)
+
+// An endpoint is one route of the API together with what the OpenAPI document
+// says about it. routes() lists them, mount() puts them on the router and
+// openapi.go turns them into the document
+type endpoint struct {
+	method  string
+	path    string // httprouter syntax below the version, e.g. /comments/:id
+	handler http.HandlerFunc
+	summary string
+	tag     string
+	query   []queryParam
+	body    *requestBody
+	status  int           // of a successful response, 200 when not set
+	result  *responseBody // nil for an empty response
+}
+
+// the kinds of query parameters
+const (
+	paramString  = "string"
+	paramInteger = "integer"
+	paramBoolean = "boolean"
+	paramTime    = "time" // RFC 3339 or a date, see getSingleTimeParameter
+	paramList    = "list" // comma separated, e.g. fields=id,content
+)
+
+type queryParam struct {
+	name        string
+	kind        string
+	description string
+	enum        []string // the permitted values, of every item for a list
+	repeated    bool     // may be given more than once, e.g. filter=
+}
+
+// A requestBody is described by a value of a data type, the body may have
+// the listed JSON fields of it. The validate tags of the fields give the limits
+type requestBody struct {
+	contentTypes []string // application/json when empty
+	value        any
+	fields       []string
+	partial      bool // a PATCH, no field is required
+}
+
+// A responseBody is an envelope, a key and a value of the type that the key holds
+type responseBody struct {
+	contentType string // application/json when empty
+	properties  map[string]any
+	optional    []string // the keys that are not always there
+}
+
+// the shapes of the request bodies
+
+func body(value any, fields ...string) *requestBody {
+	return &requestBody{value: value, fields: fields}
+}
+
+func patchBody(value any, fields ...string) *requestBody {
+	return &requestBody{value: value, fields: fields, partial: true}
+}
+
+// rawBody is a body that is not JSON, such as the CSV of an import
+func rawBody(contentTypes ...string) *requestBody {
+	return &requestBody{contentTypes: contentTypes}
+}
+
+// the shapes of the responses
+
+func one(key string, value any) *responseBody {
+	return &responseBody{properties: map[string]any{key: value}}
+}
+
+// list is a page of records with the @metadata of the page
+func list(key string, value any) *responseBody {
+	return &responseBody{properties: map[string]any{key: value, "@metadata": data.Metadata{}}}
+}
+
+// withIncluded adds the compound document of include=, see includes.go
+func withIncluded(result *responseBody) *responseBody {
+	result.properties["included"] = includedRecords{}
+	result.optional = append(result.optional, "included")
+	return result
+}
+
+func message() *responseBody {
+	return one("message", "")
+}
+
+func eventStream() *responseBody {
+	return &responseBody{contentType: "text/event-stream"}
+}
+
+// the query parameters that several endpoints share
+
+func pagingParams() []queryParam {
+	return []queryParam{
+		{name: "page", kind: paramInteger, description: "the page to return, from 1 to 500"},
+		{name: "page_size", kind: paramInteger, description: "the number of records per page, from 1 to 100"},
+	}
+}
+
+func sortParam(safeList []string) queryParam {
+	return queryParam{name: "sort", kind: paramString, enum: safeList,
+		description: "the order of the records, a leading - sorts descending"}
+}
+
+func timeRangeParams() []queryParam {
+	return []queryParam{
+		{name: "created_after", kind: paramTime, description: "only records created after the RFC 3339 timestamp or date (YYYY-MM-DD)"},
+		{name: "created_before", kind: paramTime, description: "only records created before the RFC 3339 timestamp or date (YYYY-MM-DD)"},
+		{name: "updated_since", kind: paramTime, description: "only records updated since the RFC 3339 timestamp or date (YYYY-MM-DD)"},
+	}
+}
+
+func filterParam(safeList map[string]data.FilterField) queryParam {
+	fields := make([]string, 0, len(safeList))
+	for field := range safeList {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	return queryParam{name: "filter", kind: paramString, repeated: true,
+		description: "a filter expression such as author:eq:alice AND version:gte:2, on " + strings.Join(fields, ", ")}
+}
+
+func prettyParam() queryParam {
+	return queryParam{name: "pretty", kind: paramBoolean,
+		description: "indent the JSON for reading, the default in development"}
+}
+
+func fieldsParam(names []string) queryParam {
+	return queryParam{name: "fields", kind: paramList, enum: names,
+		description: "the fields to return, every field when not given"}
+}
+
+func includeParam() queryParam {
+	return queryParam{name: "include", kind: paramList,
+		description: "related records to add under included, paths of " + strings.Join(commentRelations, ", ") + " such as parent.author"}
+}
+
+// idempotent tells if the endpoint honours Idempotency-Key, every POST with
+// a JSON body or none. An import body is too large to keep
+func (e endpoint) idempotent() bool {
+	return e.method == http.MethodPost && (e.body == nil || e.body.value != nil)
+}
+
+// mount registers the endpoints on the router.
+//
+// httprouter does not allow a fixed segment such as /comments/import next to
+// a wildcard such as /comments/:id/reports. Such a fixed path is registered as
+// the wildcard instead and staticOrID sends it to the right handler
+func (a *applicationDependencies) mount(router *httprouter.Router, version apiVersion, endpoints []endpoint) {
+	type route struct{ method, path string }
+	order := []route{}
+	handlers := map[route]http.HandlerFunc{}
+	statics := map[route]map[string]http.HandlerFunc{}
+	params := map[route]string{}
+
+	for _, e := range endpoints {
+		handler := e.handler
+		if a.config.openapi.validate {
+			handler = a.validateRequest(e, handler)
+		}
+		if e.idempotent() {
+			handler = a.idempotent(handler)
+		}
+		handler = a.versioned(version, e.method+" "+e.path, handler)
+
+		key := route{e.method, e.path}
+		if parent, static, wildcard, ok := wildcardSibling(e, endpoints); ok {
+			key = route{e.method, parent + "/:" + wildcard}
+			if statics[key] == nil {
+				statics[key] = map[string]http.HandlerFunc{}
+			}
+			statics[key][static] = handler
+			params[key] = wildcard
+		} else {
+			handlers[key] = handler
+		}
+		if !slices.Contains(order, key) {
+			order = append(order, key)
+		}
+	}
+
+	for _, key := range order {
+		handler := handlers[key]
+		if statics[key] != nil {
+			// a fixed path without a wildcard route of the same method
+			if handler == nil {
+				handler = a.methodNotAllowedResponse
+			}
+			handler = a.staticOrID(params[key], statics[key], handler)
+		}
+		router.HandlerFunc(key.method, "/"+version.name+key.path, handler)
+	}
+}
+
+// wildcardSibling tells if the last segment of the endpoint is fixed while
+// another endpoint of the same method has a wildcard in its place
+func wildcardSibling(e endpoint, endpoints []endpoint) (parent string, static string, wildcard string, ok bool) {
+	i := strings.LastIndex(e.path, "/")
+	parent, static = e.path[:i], e.path[i+1:]
+	if strings.HasPrefix(static, ":") || strings.HasPrefix(static, "*") {
+		return "", "", "", false
+	}
+	for _, other := range endpoints {
+		if other.method != e.method || !strings.HasPrefix(other.path, parent+"/:") {
+			continue
+		}
+		wildcard, _, _ = strings.Cut(strings.TrimPrefix(other.path, parent+"/:"), "/")
+		return parent, static, wildcard, true
+	}
+	return "", "", "", false
+}
+
+// staticOrID sends the fixed values of the wildcard to their handlers, every
+// other value to the handler of the wildcard
+func (a *applicationDependencies) staticOrID(param string, statics map[string]http.HandlerFunc, idHandler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		handler, ok := statics[params.ByName(param)]
+		if ok {
+			handler(w, r)
+			return
+		}
+		idHandler(w, r)
+	}
+}
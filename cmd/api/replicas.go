@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+)
+
+// the cookie of a client that wrote lately, its reads go to the primary
+const readPrimaryCookie = "read_primary"
+
+// replicaStaleness is how far behind a replica that is read from can be: the
+// -db-replica-max-lag it may have at a check plus the time until the next
+// check. 0 without replicas
+func (cfg serverConfig) replicaStaleness() time.Duration {
+	if len(cfg.db.replicaDSNs) == 0 {
+		return 0
+	}
+	return cfg.db.replicaMaxLag + cfg.db.replicaCheckInterval
+}
+
+// readYourWrites pins the clients that change something to the primary for a
+// while, so that the next GET shows the change even when the replicas are
+// behind. The pin lasts as long as a replica can be behind. The cookie works
+// across instances
+func (a *applicationDependencies) readYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.replicas != nil && !safeMethod(r.Method) {
+			pin := a.config.replicaStaleness()
+			http.SetCookie(w, &http.Cookie{
+				Name:     readPrimaryCookie,
+				Value:    "1",
+				Path:     "/",
+				MaxAge:   int(pin.Round(time.Second).Seconds()) + 1,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// readsPrimary tells if the request must read from the primary: a write,
+// which may read what it then changes, or a client pinned by readYourWrites
+func (a *applicationDependencies) readsPrimary(r *http.Request) bool {
+	if a.replicas == nil {
+		return false
+	}
+	if !safeMethod(r.Method) {
+		return true
+	}
+	_, err := r.Cookie(readPrimaryCookie)
+	return err == nil
+}
+
+// comments is the comment model for the reads of the request
+func (a *applicationDependencies) comments(r *http.Request) data.CommentModel {
+	if a.readsPrimary(r) {
+		return a.commentModel.Primary()
+	}
+	return a.commentModel
+}
+
+// users is the user model for the reads of the request
+func (a *applicationDependencies) users(r *http.Request) data.UserModel {
+	if a.readsPrimary(r) {
+		return a.userModel.Primary()
+	}
+	return a.userModel
+}
+
+// checkReplicas keeps the health and lag of the replicas up to date and logs
+// when a replica is taken out of the reads or comes back
+func (a *applicationDependencies) checkReplicas(ctx context.Context) {
+	if a.replicas == nil {
+		return
+	}
+
+	ticker := time.NewTicker(a.config.db.replicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, status := range a.replicas.Check() {
+			if status.Healthy {
+				a.logger.Info("database replica is used for reads", "replica", status.Name, "lag_seconds", status.LagSeconds)
+			} else {
+				a.logger.Warn("database replica is not used for reads", "replica", status.Name, "error", status.Error)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"net/http"
+	"slices"
 
+	"github.com/ReynerioSamos/craboo/internal/cache"
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/importer"
+	"github.com/ReynerioSamos/craboo/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -14,25 +19,223 @@ func (a *applicationDependencies) routes() http.Handler {
 	// handle 405
 	router.MethodNotAllowed = http.HandlerFunc(a.methodNotAllowedResponse)
 
-	//set up routes
-	//route for health checker
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", a.healthCheckHandler)
+	// every version has the same endpoints, the documents are built once
+	// because the endpoints do not change while we run
+	a.openapi = map[string]envelope{}
+	for _, version := range a.versions() {
+		endpoints := a.endpoints(version)
+		// every endpoint takes pretty=, see writeJson
+		for i := range endpoints {
+			endpoints[i].query = append(slices.Clip(endpoints[i].query), prettyParam())
+		}
+		a.openapi[version.name] = openAPIDocument(version, endpoints)
+		a.mount(router, version, endpoints)
+	}
 
-	// routes for comments CRUD functionality
-	router.HandlerFunc(http.MethodPost, "/v1/comments", a.createCommentHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/comments/:id", a.displayCommentHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/comments/:id", a.updateCommentHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/comments/:id", a.deleteCommentHandler)
+	//panic recover, the request ID comes first so that errors can show it.
+	// the compression is outside of both so that errors are compressed too
+	return a.compress(a.requestID(a.recoverPanic(a.readYourWrites(router))))
+}
+
+// endpoints is every route of a version of the API, see registry.go. The
+// paths are below the version, /comments is /v1/comments and /v2/comments
+func (a *applicationDependencies) endpoints(version apiVersion) []endpoint {
+	// the query parameters of the comment lists
+	commentList := slices.Concat(
+		[]queryParam{
+			{name: "content", kind: paramString, description: "only comments whose content contains the text"},
+			{name: "author", kind: paramString, description: "only comments of the author"},
+			{name: "q", kind: paramString, description: `a web search style query, e.g. "exact phrase" or -excluded`},
+			{name: "thread", kind: paramString, description: "only the comments of the thread with the key"},
+			sortParam(commentSortSafeList),
+			filterParam(data.CommentFilterFields),
+			fieldsParam(version.commentFieldNames()),
+			includeParam(),
+		},
+		pagingParams(), timeRangeParams())
+	importParams := []queryParam{
+		{name: "format", kind: paramString, enum: []string{"ndjson", "jsonl", "csv"}, description: "the format of the body, the Content-Type when not given"},
+		{name: "dry_run", kind: paramBoolean, description: "validate the records without storing them"},
+	}
+	commentBody := body(data.Comment{}, "content", "author", "parent_id")
+
+	return []endpoint{
+		//route for health checker
+		{method: http.MethodGet, path: "/healthcheck", handler: a.healthCheckHandler, tag: "system",
+			summary: "Show the status and version of the API",
+			result: &responseBody{properties: map[string]any{"status": "", "system_info": map[string]string{},
+				"cache": map[string]cache.Stats{}, "replicas": []data.ReplicaStatus{}}}},
+		// the limits the request bodies are validated against
+		{method: http.MethodGet, path: "/validation-rules", handler: a.validationRulesHandler, tag: "system",
+			summary: "List the validation rules of the resources",
+			result:  one("rules", map[string][]validator.FieldRules{})},
+		// this document
+		{method: http.MethodGet, path: "/openapi.json", handler: a.openAPIHandler, tag: "system",
+			summary: "Show the OpenAPI document of the API",
+			result:  &responseBody{properties: map[string]any{}}},
+
+		// routes for comments CRUD functionality
+		{method: http.MethodPost, path: "/comments", handler: a.createCommentHandler, tag: "comments",
+			summary: "Create a comment", body: commentBody,
+			status: http.StatusCreated, result: one("comment", data.Comment{})},
+		{method: http.MethodGet, path: "/comments/stream", handler: a.streamCommentsHandler, tag: "comments",
+			summary: "Stream comment changes as Server-Sent Events",
+			query: []queryParam{
+				{name: "author", kind: paramString, description: "only the comments of the author"},
+				{name: "thread", kind: paramString, description: "only the comments of the thread with the key"},
+				{name: "last_event_id", kind: paramInteger, description: "resume after the event, the Last-Event-ID header does the same"},
+			},
+			result: eventStream()},
+		{method: http.MethodGet, path: "/comments/:id", handler: a.displayCommentHandler, tag: "comments",
+			summary: "Show an approved comment",
+			query:   []queryParam{fieldsParam(version.commentFieldNames()), includeParam()},
+			result:  withIncluded(one("comment", data.Comment{}))},
+		{method: http.MethodPatch, path: "/comments/:id", handler: a.updateCommentHandler, tag: "comments",
+			summary: "Update a comment", body: patchBody(data.Comment{}, "content", "author"),
+			result: one("comment", data.Comment{})},
+		{method: http.MethodDelete, path: "/comments/:id", handler: a.deleteCommentHandler, tag: "comments",
+			summary: "Delete a comment", result: message()},
+		{method: http.MethodPost, path: "/comments/import", handler: a.importCommentsHandler, tag: "comments",
+			summary: "Import comments in bulk", query: importParams,
+			body:   rawBody("application/x-ndjson", "text/csv"),
+			result: one("report", importer.Report{})},
+
+		// routes for reacting to comments
+		{method: http.MethodPut, path: "/comments/:id/reactions/:kind", handler: a.addReactionHandler, tag: "reactions",
+			summary: "React to a comment",
+			query:   []queryParam{{name: "user_id", kind: paramInteger, description: "the user who reacts"}},
+			result:  &responseBody{properties: map[string]any{"comment_id": int64(0), "reactions": data.ReactionCounts{}}}},
+		{method: http.MethodDelete, path: "/comments/:id/reactions/:kind", handler: a.removeReactionHandler, tag: "reactions",
+			summary: "Take a reaction back",
+			query:   []queryParam{{name: "user_id", kind: paramInteger, description: "the user who reacted"}},
+			result:  &responseBody{properties: map[string]any{"comment_id": int64(0), "reactions": data.ReactionCounts{}}}},
+
+		//routes for users CRUD functionality
+		{method: http.MethodPost, path: "/users", handler: a.createUserHandler, tag: "users",
+			summary: "Create a user", body: body(data.User{}, "email", "fullname", "username"),
+			status: http.StatusCreated, result: one("user", data.User{})},
+		{method: http.MethodGet, path: "/users/:id", handler: a.displayUserHandler, tag: "users",
+			summary: "Show a user",
+			query:   []queryParam{fieldsParam(data.UserFields.Names())},
+			result:  one("user", data.User{})},
+		{method: http.MethodPatch, path: "/users/:id", handler: a.updateUserHandler, tag: "users",
+			summary: "Update a user", body: patchBody(data.User{}, "email", "fullname", "username"),
+			result: one("user", data.User{})},
+		{method: http.MethodDelete, path: "/users/:id", handler: a.deleteUserHandler, tag: "users",
+			summary: "Delete a user", result: message()},
+		{method: http.MethodPost, path: "/users/import", handler: a.importUsersHandler, tag: "users",
+			summary: "Import users in bulk", query: importParams,
+			body:   rawBody("application/x-ndjson", "text/csv"),
+			result: one("report", importer.Report{})},
+		{method: http.MethodGet, path: "/users/:id/mentions", handler: a.listUserMentionsHandler, tag: "users",
+			summary: "List the comments that mention a user",
+			query: slices.Concat(
+				[]queryParam{
+					sortParam(mentionSortSafeList),
+					filterParam(data.CommentFilterFields),
+					fieldsParam(version.commentFieldNames()),
+				},
+				pagingParams(), timeRangeParams()),
+			result: list("comments", []data.Comment{})},
+
+		// routes for the email notifications
+		{method: http.MethodGet, path: "/users/:id/preferences", handler: a.displayPreferencesHandler, tag: "notifications",
+			summary: "Show the notification preferences of a user",
+			result:  one("preferences", data.Preferences{})},
+		{method: http.MethodPatch, path: "/users/:id/preferences", handler: a.updatePreferencesHandler, tag: "notifications",
+			summary: "Update the notification preferences of a user",
+			body:    patchBody(data.Preferences{}, "mentions", "replies", "digest"),
+			result:  one("preferences", data.Preferences{})},
+		{method: http.MethodGet, path: "/unsubscribe", handler: a.unsubscribeHandler, tag: "notifications",
+			summary: "Unsubscribe with the link of an email",
+			query:   []queryParam{{name: "token", kind: paramString, description: "the signed token of the link"}},
+			result:  &responseBody{properties: map[string]any{"message": "", "preferences": data.Preferences{}}}},
+		{method: http.MethodPost, path: "/unsubscribe", handler: a.unsubscribeHandler, tag: "notifications",
+			summary: "Unsubscribe with one click from a mail client",
+			query:   []queryParam{{name: "token", kind: paramString, description: "the signed token of the link"}},
+			result:  &responseBody{properties: map[string]any{"message": "", "preferences": data.Preferences{}}}},
+
+		// routes for the moderation workflow
+		{method: http.MethodPost, path: "/comments/:id/reports", handler: a.createReportHandler, tag: "moderation",
+			summary: "Report a comment", body: body(data.Report{}, "reason", "user_id"),
+			status: http.StatusCreated, result: one("report", data.Report{})},
+		{method: http.MethodGet, path: "/moderation/queue", handler: a.moderationQueueHandler, tag: "moderation",
+			summary: "List the comments waiting for a moderator", query: pagingParams(),
+			result: list("queue", []data.QueuedComment{})},
+		{method: http.MethodPost, path: "/moderation/actions", handler: a.moderateCommentsHandler, tag: "moderation",
+			summary: "Approve, reject or hide comments",
+			body:    body(data.ModerationAction{}, "comment_ids", "action", "reason", "moderator"),
+			result:  one("moderation", data.ModerationAction{})},
+
+		// routes for the moderation rules
+		{method: http.MethodGet, path: "/moderation/rules", handler: a.listRulesHandler, tag: "rules",
+			summary: "List the moderation rules",
+			query:   append([]queryParam{sortParam(ruleSortSafeList), filterParam(data.RuleFilterFields)}, pagingParams()...),
+			result:  list("rules", []data.Rule{})},
+		{method: http.MethodPost, path: "/moderation/rules", handler: a.createRuleHandler, tag: "rules",
+			summary: "Create a moderation rule",
+			body:    body(data.Rule{}, "name", "kind", "keywords", "pattern", "threshold", "action", "enabled"),
+			status:  http.StatusCreated, result: one("rule", data.Rule{})},
+		{method: http.MethodPost, path: "/moderation/rules/test", handler: a.testRulesHandler, tag: "rules",
+			summary: "Run the rules on a text without storing anything",
+			body:    body(data.Comment{}, "content"),
+			result:  one("decision", data.RuleDecision{})},
+		{method: http.MethodGet, path: "/moderation/rules/:id", handler: a.displayRuleHandler, tag: "rules",
+			summary: "Show a moderation rule", result: one("rule", data.Rule{})},
+		{method: http.MethodPatch, path: "/moderation/rules/:id", handler: a.updateRuleHandler, tag: "rules",
+			summary: "Update a moderation rule",
+			body:    patchBody(data.Rule{}, "name", "kind", "keywords", "pattern", "threshold", "action", "enabled"),
+			result:  one("rule", data.Rule{})},
+		{method: http.MethodDelete, path: "/moderation/rules/:id", handler: a.deleteRuleHandler, tag: "rules",
+			summary: "Delete a moderation rule", result: message()},
+
+		// routes for threads, the key is a URL or any other external identifier
+		// and may contain escaped slashes so the whole path is matched
+		{method: http.MethodGet, path: "/threads/*path", handler: a.getThreadHandler, tag: "threads",
+			summary: "Show a thread, or list its comments when the path ends in /comments",
+			query:   commentList,
+			result:  one("thread", data.Thread{})},
+		{method: http.MethodPut, path: "/threads/*path", handler: a.putThreadHandler, tag: "threads",
+			summary: "Create or replace a thread",
+			body:    body(data.Thread{}, "title", "metadata", "pre_moderation"),
+			result:  one("thread", data.Thread{})},
+		{method: http.MethodPost, path: "/threads/*path", handler: a.createThreadCommentHandler, tag: "threads",
+			summary: "Create a comment in a thread, the path ends in /comments", body: commentBody,
+			status: http.StatusCreated, result: one("comment", data.Comment{})},
 
-	//routes for users CRUD functionality
-	router.HandlerFunc(http.MethodPost, "/v1/users", a.createUserHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/users/:id", a.displayUserHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/users/:id", a.updateUserHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/users/:id", a.deleteUserHandler)
+		// routes for the outbound webhooks
+		{method: http.MethodGet, path: "/webhooks", handler: a.listWebhooksHandler, tag: "webhooks",
+			summary: "List the webhooks",
+			query:   append([]queryParam{sortParam(webhookSortSafeList), filterParam(data.WebhookFilterFields)}, pagingParams()...),
+			result:  list("webhooks", []data.Webhook{})},
+		{method: http.MethodPost, path: "/webhooks", handler: a.createWebhookHandler, tag: "webhooks",
+			summary: "Create a webhook", body: body(data.Webhook{}, "url", "secret", "events", "enabled"),
+			status: http.StatusCreated, result: one("webhook", data.Webhook{})},
+		{method: http.MethodGet, path: "/webhooks/:id", handler: a.displayWebhookHandler, tag: "webhooks",
+			summary: "Show a webhook", result: one("webhook", data.Webhook{})},
+		{method: http.MethodPatch, path: "/webhooks/:id", handler: a.updateWebhookHandler, tag: "webhooks",
+			summary: "Update a webhook", body: patchBody(data.Webhook{}, "url", "secret", "events", "enabled"),
+			result: one("webhook", data.Webhook{})},
+		{method: http.MethodDelete, path: "/webhooks/:id", handler: a.deleteWebhookHandler, tag: "webhooks",
+			summary: "Delete a webhook", result: message()},
+		{method: http.MethodGet, path: "/webhooks/:id/deliveries", handler: a.listWebhookDeliveriesHandler, tag: "webhooks",
+			summary: "List the deliveries of a webhook, newest first", query: pagingParams(),
+			result: list("deliveries", []data.Delivery{})},
+		{method: http.MethodPost, path: "/webhooks/:id/test", handler: a.testWebhookHandler, tag: "webhooks",
+			summary: "Send a test event to a webhook", result: one("delivery", data.Delivery{})},
 
-	//route for List All comments handler
-	router.HandlerFunc(http.MethodGet, "/v1/comments", a.ListCommentsHandler)
+		// routes for the outbox dead letters
+		{method: http.MethodGet, path: "/outbox", handler: a.listOutboxHandler, tag: "outbox",
+			summary: "List the events of the outbox, newest first",
+			query: append([]queryParam{{name: "status", kind: paramString, description: "only the events with the status",
+				enum: []string{data.OutboxPending, data.OutboxPublished, data.OutboxDead}}}, pagingParams()...),
+			result: list("events", []data.OutboxEvent{})},
+		{method: http.MethodPost, path: "/outbox/:id/retry", handler: a.retryOutboxHandler, tag: "outbox",
+			summary: "Publish a dead event again", result: one("event", data.OutboxEvent{})},
 
-	//panic recover
-	return a.recoverPanic(router)
+		//route for List All comments handler
+		{method: http.MethodGet, path: "/comments", handler: a.ListCommentsHandler, tag: "comments",
+			summary: "List the approved comments", query: commentList,
+			result: withIncluded(list("comments", []data.Comment{}))},
+	}
 }
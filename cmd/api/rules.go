@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// checkModerationRules runs the comment against the enabled rules and applies the decision.
+// It returns false when the comment was rejected and the response has already been sent
+func (a *applicationDependencies) checkModerationRules(w http.ResponseWriter, r *http.Request, comment *data.Comment) (*data.RuleDecision, bool) {
+	rules, err := a.ruleModel.GetEnabled()
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	decision := data.Evaluate(rules, comment.Content)
+	if decision.Rule == nil {
+		comment.RuleID = nil
+		return decision, true
+	}
+	comment.RuleID = &decision.Rule.RuleID
+
+	switch decision.Action {
+	case data.RuleActionReject:
+		// a rejected comment is never stored but the rule still counts the hit
+		a.recordRuleHits(decision)
+		v := validator.New()
+		v.AddError("content", fmt.Sprintf("was rejected by the %q moderation rule", decision.Rule.Name))
+		a.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	case data.RuleActionHold:
+		comment.Status = data.StatusPending
+	}
+	return decision, true
+}
+
+// finishModerationRules is called once the comment has been stored
+func (a *applicationDependencies) finishModerationRules(comment *data.Comment, decision *data.RuleDecision) {
+	a.recordRuleHits(decision)
+
+	// flagged comments stay public but show up in the moderation queue
+	if decision.Action == data.RuleActionFlag {
+		report := &data.Report{
+			CommentID: comment.ID,
+			Reason:    fmt.Sprintf("matched the %q moderation rule", decision.Rule.Name),
+		}
+		err := a.moderationModel.InsertReport(report)
+		if err != nil {
+			a.logger.Error(err.Error(), "comment_id", comment.ID)
+		}
+	}
+}
+
+// statistics should not cause the request to fail
+func (a *applicationDependencies) recordRuleHits(decision *data.RuleDecision) {
+	err := a.ruleModel.RecordHits(decision.RuleIDs())
+	if err != nil {
+		a.logger.Error(err.Error())
+	}
+}
+
+func (a *applicationDependencies) createRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Name      string   `json:"name"`
+		Kind      string   `json:"kind"`
+		Keywords  []string `json:"keywords"`
+		Pattern   string   `json:"pattern"`
+		Threshold int      `json:"threshold"`
+		Action    string   `json:"action"`
+		Enabled   *bool    `json:"enabled"`
+	}
+
+	err := a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	rule := &data.Rule{
+		Name:      incomingData.Name,
+		Kind:      incomingData.Kind,
+		Keywords:  incomingData.Keywords,
+		Pattern:   incomingData.Pattern,
+		Threshold: incomingData.Threshold,
+		Action:    incomingData.Action,
+		Enabled:   true,
+	}
+	// rules are enabled unless the admin says otherwise
+	if incomingData.Enabled != nil {
+		rule.Enabled = *incomingData.Enabled
+	}
+
+	v := validator.New()
+	data.ValidateRule(v, rule)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.ruleModel.Insert(rule)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", versionPath(r, "/moderation/rules/%d", rule.ID))
+
+	data := envelope{
+		"rule": rule,
+	}
+	err = a.writeJson(w, r, http.StatusCreated, data, headers)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) displayRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	rule, err := a.ruleModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"rule": rule,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) updateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	rule, err := a.ruleModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// pointers so we know which fields the client wants to change
+	var incomingData struct {
+		Name      *string  `json:"name"`
+		Kind      *string  `json:"kind"`
+		Keywords  []string `json:"keywords"`
+		Pattern   *string  `json:"pattern"`
+		Threshold *int     `json:"threshold"`
+		Action    *string  `json:"action"`
+		Enabled   *bool    `json:"enabled"`
+	}
+
+	err = a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	if incomingData.Name != nil {
+		rule.Name = *incomingData.Name
+	}
+	// a new kind does not keep the keywords, pattern or threshold of the old
+	// one, the client sends what the new kind needs
+	if incomingData.Kind != nil && *incomingData.Kind != rule.Kind {
+		rule.Kind = *incomingData.Kind
+		if rule.Kind != data.RuleKeywords {
+			rule.Keywords = nil
+		}
+		if rule.Kind != data.RuleRegex {
+			rule.Pattern = ""
+		}
+		if rule.Kind != data.RuleLinks && rule.Kind != data.RuleRepeatedChars {
+			rule.Threshold = 0
+		}
+	}
+	if incomingData.Keywords != nil {
+		rule.Keywords = incomingData.Keywords
+	}
+	if incomingData.Pattern != nil {
+		rule.Pattern = *incomingData.Pattern
+	}
+	if incomingData.Threshold != nil {
+		rule.Threshold = *incomingData.Threshold
+	}
+	if incomingData.Action != nil {
+		rule.Action = *incomingData.Action
+	}
+	if incomingData.Enabled != nil {
+		rule.Enabled = *incomingData.Enabled
+	}
+
+	v := validator.New()
+	data.ValidateRule(v, rule)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.ruleModel.Update(rule)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"rule": rule,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) deleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	err = a.ruleModel.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"message": "rule successfully deleted",
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// the orders of the rule list
+var ruleSortSafeList = []string{"id", "name", "hits", "last_hit_at",
+	"-id", "-name", "-hits", "-last_hit_at"}
+
+// lists the rules together with their hit statistics
+func (a *applicationDependencies) listRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+	queryParameters := r.URL.Query()
+
+	v := validator.New()
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
+	filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "id")
+	filters.SortSafeList = ruleSortSafeList
+	filters.Filter = queryParameters["filter"]
+	filters.FilterSafeList = data.RuleFilterFields
+
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	rules, metadata, err := a.ruleModel.GetAll(filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"rules":     rules,
+		"@metadata": metadata,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// dry run: shows what the current ruleset would do with some text without storing anything
+func (a *applicationDependencies) testRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		Content string `json:"content"`
+	}
+
+	err := a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(incomingData.Content != "", "content", "must be provided")
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	rules, err := a.ruleModel.GetEnabled()
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"decision": data.Evaluate(rules, incomingData.Content),
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/stream"
+)
+
+// GET /v1/comments/stream pushes comment changes as Server-Sent Events.
+// ?author= and ?thread= narrow the stream, Last-Event-ID resumes it
+func (a *applicationDependencies) streamCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	queryParameters := r.URL.Query()
+
+	var filter stream.Filter
+	filter.Author = a.getSingleQueryParameter(queryParameters, "author", "")
+
+	threadKey := a.getSingleQueryParameter(queryParameters, "thread", "")
+	if threadKey != "" {
+		thread, err := a.threadModel.GetByKey(threadKey)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				a.notFoundResponse(w, r)
+			default:
+				a.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		filter.ThreadID = &thread.ID
+	}
+
+	// browsers send the header when they reconnect, other clients may prefer the parameter
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = a.getSingleQueryParameter(queryParameters, "last_event_id", "")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastID < 0 {
+			a.badRequestResponse(w, r, errors.New("Last-Event-ID must be a positive integer"))
+			return
+		}
+	}
+
+	// subscribe before replaying so nothing falls in between
+	sub, err := a.streamBroker.Subscribe(filter)
+	if err != nil {
+		switch {
+		case errors.Is(err, stream.ErrTooManySubscribers):
+			a.tooManySubscribersResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer sub.Close()
+
+	// where the client is in the stream, the zero cursor for a new client
+	var cursor data.StreamCursor
+	var replay []*data.StreamEvent
+	if lastID > 0 {
+		cursor, err = a.streamBroker.Resume(lastID)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+		replay, err = a.streamBroker.Replay(cursor, filter, a.config.stream.replayLimit)
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// the server's WriteTimeout would end the stream after 10 seconds
+	rc := http.NewResponseController(w)
+	err = rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// stop proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// tell the browser how long to wait before reconnecting
+	fmt.Fprintf(w, "retry: %d\n\n", a.config.stream.heartbeat.Milliseconds())
+
+	for _, event := range replay {
+		err = writeStreamEvent(w, event)
+		if err != nil {
+			return
+		}
+		cursor = event.Cursor()
+	}
+	err = rc.Flush()
+	if err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(a.config.stream.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// comments are ignored by clients but keep proxies from closing the connection
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-sub.Events():
+			// we were dropped for being too slow, the client will reconnect and resume
+			if !ok {
+				return
+			}
+			// already sent during the replay
+			if !cursor.Before(event.Cursor()) {
+				continue
+			}
+			err = writeStreamEvent(w, event)
+			cursor = event.Cursor()
+		}
+		if err != nil {
+			return
+		}
+		err = rc.Flush()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes one event in the text/event-stream format
+func writeStreamEvent(w http.ResponseWriter, event *data.StreamEvent) error {
+	payload, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, payload)
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// readThreadPath splits /v1/threads/<key>[/comments] into the key and the rest.
+// The key is usually a URL so we work on the escaped path: that way a key
+// sent as https%3A%2F%2Fexample.com%2Fpost keeps its slashes out of the routing
+func (a *applicationDependencies) readThreadPath(r *http.Request) (string, bool, error) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), versionPath(r, "/threads/"))
+
+	escapedKey, isComments := strings.CutSuffix(path, "/comments")
+	key, err := url.PathUnescape(escapedKey)
+	if err != nil {
+		return "", false, errors.New("invalid thread key")
+	}
+
+	v := validator.New()
+	data.ValidateThreadKey(v, key)
+	if !v.IsEmpty() {
+		return "", false, errors.New("invalid thread key")
+	}
+
+	return key, isComments, nil
+}
+
+// GET /v1/threads/:key shows the thread, GET /v1/threads/:key/comments lists its comments
+func (a *applicationDependencies) getThreadHandler(w http.ResponseWriter, r *http.Request) {
+	key, isComments, err := a.readThreadPath(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	thread, err := a.threadModel.GetByKey(key)
+	if err != nil {
+		switch {
+		// a thread that does not exist yet simply has no comments
+		case errors.Is(err, data.ErrRecordNotFound) && isComments:
+			a.writeEmptyComments(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if isComments {
+		a.listComments(w, r, thread.Key)
+		return
+	}
+
+	data := envelope{
+		"thread": thread,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) writeEmptyComments(w http.ResponseWriter, r *http.Request) {
+	data := envelope{
+		"comments":  []*data.Comment{},
+		"@metadata": data.Metadata{},
+	}
+	err := a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/threads/:key/comments adds a comment to the thread,
+// creating the thread on the first comment when that is allowed
+func (a *applicationDependencies) createThreadCommentHandler(w http.ResponseWriter, r *http.Request) {
+	key, isComments, err := a.readThreadPath(r)
+	if err != nil || !isComments {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	var incomingData struct {
+		Content  string `json:"content"`
+		Author   string `json:"author"`
+		ParentID *int64 `json:"parent_id"`
+	}
+
+	err = a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	var thread *data.Thread
+	if a.config.threads.autoCreate {
+		thread, err = a.threadModel.GetOrCreate(key)
+	} else {
+		thread, err = a.threadModel.GetByKey(key)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	comment := &data.Comment{
+		Content:  incomingData.Content,
+		Author:   incomingData.Author,
+		ParentID: incomingData.ParentID,
+	}
+	if !a.insertComment(w, r, comment, thread) {
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", versionPath(r, "/comments/%d", comment.ID))
+
+	data := envelope{
+		"comment": a.commentView(r, data.CommentFields, comment),
+	}
+	err = a.writeJson(w, r, http.StatusCreated, data, headers)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/threads/:key creates the thread or replaces its title, metadata and settings
+func (a *applicationDependencies) putThreadHandler(w http.ResponseWriter, r *http.Request) {
+	key, isComments, err := a.readThreadPath(r)
+	if err != nil || isComments {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	var incomingData struct {
+		Title         string         `json:"title"`
+		Metadata      map[string]any `json:"metadata"`
+		PreModeration bool           `json:"pre_moderation"`
+	}
+
+	err = a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	thread := &data.Thread{
+		Key:           key,
+		Title:         incomingData.Title,
+		Metadata:      incomingData.Metadata,
+		PreModeration: incomingData.PreModeration,
+	}
+
+	v := validator.New()
+	data.ValidateThread(v, thread)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.threadModel.Upsert(thread)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"thread": thread,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	_ "encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 
 	"github.com/ReynerioSamos/craboo/internal/data"
@@ -15,6 +14,7 @@ func (a *applicationDependencies) createUserHandler(w http.ResponseWriter, r *ht
 	var incomingData struct {
 		Email    string `json:"email"`
 		Fullname string `json:"fullname"`
+		Username string `json:"username"`
 	}
 
 	// decoding
@@ -29,6 +29,7 @@ func (a *applicationDependencies) createUserHandler(w http.ResponseWriter, r *ht
 	user := &data.User{
 		Email:    incomingData.Email,
 		Fullname: incomingData.Fullname,
+		Username: incomingData.Username,
 	}
 	// Intialize Validator instance
 	v := validator.New()
@@ -42,22 +43,25 @@ func (a *applicationDependencies) createUserHandler(w http.ResponseWriter, r *ht
 	// Add the user to the database table
 	err = a.userModel.Insert(user)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateUsername):
+			v.AddError("username", "a user with this username already exists")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	// for now display the result
-	fmt.Fprintf(w, "%+v\n", incomingData)
-
 	// Set a Location header. The path to the newly created user
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprintf("/v1/users/%d", user.ID))
+	headers.Set("Location", versionPath(r, "/users/%d", user.ID))
 
 	// Send a JSON response with 201 (new resource created) status code
 	data := envelope{
 		"user": user,
 	}
-	err = a.writeJson(w, http.StatusCreated, data, headers)
+	err = a.writeJson(w, r, http.StatusCreated, data, headers)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -72,8 +76,15 @@ func (a *applicationDependencies) displayUserHandler(w http.ResponseWriter, r *h
 		return
 	}
 
+	v := validator.New()
+	fields := readFieldset(r.URL.Query(), data.UserFields, v)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	//Call Get() to retrieve the User with the specified id
-	user, err := a.userModel.Get(id)
+	user, err := a.users(r).GetFields(id, fields)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -85,9 +96,9 @@ func (a *applicationDependencies) displayUserHandler(w http.ResponseWriter, r *h
 	}
 	// display the User
 	data := envelope{
-		"user": user,
+		"user": fields.Project(user),
 	}
-	err = a.writeJson(w, http.StatusOK, data, nil)
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -103,7 +114,7 @@ func (a *applicationDependencies) updateUserHandler(w http.ResponseWriter, r *ht
 	}
 
 	// Call Get() to retrieve the User with specified id
-	user, err := a.userModel.Get(id)
+	user, err := a.users(r).Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -121,6 +132,7 @@ func (a *applicationDependencies) updateUserHandler(w http.ResponseWriter, r *ht
 	var incomingData struct {
 		Email    *string `json:"email"`
 		Fullname *string `json:"fullname"`
+		Username *string `json:"username"`
 	}
 
 	// decoding
@@ -141,6 +153,11 @@ func (a *applicationDependencies) updateUserHandler(w http.ResponseWriter, r *ht
 		user.Fullname = *incomingData.Fullname
 	}
 
+	// if incomingData.Username is nil, no update was provided
+	if incomingData.Username != nil {
+		user.Username = *incomingData.Username
+	}
+
 	// Before we write the updates to the DB let's validate
 	v := validator.New()
 	data.ValidateUser(v, user)
@@ -152,13 +169,20 @@ func (a *applicationDependencies) updateUserHandler(w http.ResponseWriter, r *ht
 	// perform the update
 	err = a.userModel.Update(user)
 	if err != nil {
-		a.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, data.ErrDuplicateUsername):
+			v.AddError("username", "a user with this username already exists")
+			a.failedValidationResponse(w, r, v.Errors)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
 		return
 	}
+
 	data := envelope{
 		"user": user,
 	}
-	err = a.writeJson(w, http.StatusOK, data, nil)
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 		return
@@ -183,11 +207,12 @@ func (a *applicationDependencies) deleteUserHandler(w http.ResponseWriter, r *ht
 		}
 		return
 	}
+
 	// display the user
 	data := envelope{
 		"message": "user successfully deleted",
 	}
-	err = a.writeJson(w, http.StatusOK, data, nil)
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		a.serverErrorResponse(w, r, err)
 	}
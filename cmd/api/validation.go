@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// validationRulesHandler lists the validate tags of the resources so that
+// the documentation and the clients do not have to copy the limits
+func (a *applicationDependencies) validationRulesHandler(w http.ResponseWriter, r *http.Request) {
+	data := envelope{
+		"rules": map[string][]validator.FieldRules{
+			"comment": validator.Rules(data.Comment{}),
+			"user":    validator.Rules(data.User{}),
+			"rule":    validator.Rules(data.Rule{}),
+			"webhook": validator.Rules(data.Webhook{}),
+		},
+	}
+
+	err := a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
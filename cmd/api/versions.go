@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// An apiVersion is one surface of the API, /v1 or /v2. The versions share the
+// handlers and the data layer, what differs is how the records are shown. A
+// handler finds its version with apiVersionFromContext
+type apiVersion struct {
+	name        string    // the first segment of the paths
+	deprecation time.Time // zero while the version is current
+	sunset      time.Time // when the version goes away, zero when not planned
+	successor   string    // the version that replaces this one
+}
+
+// the versions that are served, every endpoint exists in each of them
+func (a *applicationDependencies) versions() []apiVersion {
+	return []apiVersion{
+		{name: "v1", deprecation: a.config.versions.v1Deprecation, sunset: a.config.versions.v1Sunset, successor: "v2"},
+		{name: "v2"},
+	}
+}
+
+// latestVersion is the version for links that outlive a request, such as those in emails
+func (a *applicationDependencies) latestVersion() apiVersion {
+	versions := a.versions()
+	return versions[len(versions)-1]
+}
+
+func (v apiVersion) deprecated() bool {
+	return !v.deprecation.IsZero()
+}
+
+const versionContextKey = contextKey("api_version")
+
+// apiVersionFromContext is the version the request came in on, v1 when the
+// handler was called without the router
+func apiVersionFromContext(r *http.Request) apiVersion {
+	version, ok := r.Context().Value(versionContextKey).(apiVersion)
+	if !ok {
+		return apiVersion{name: "v1"}
+	}
+	return version
+}
+
+// versioned puts the version in the context of the request, counts the request
+// for the usage log and tells the clients of a deprecated version when it goes
+// away (RFC 9745 and RFC 8594)
+func (a *applicationDependencies) versioned(version apiVersion, route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.versionUsage.record(version.name, route)
+
+		if version.deprecated() {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", version.deprecation.Unix()))
+			if version.successor != "" {
+				successor := "/" + version.successor + strings.TrimPrefix(r.URL.Path, "/"+version.name)
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+			}
+		}
+		if !version.sunset.IsZero() {
+			w.Header().Set("Sunset", version.sunset.UTC().Format(http.TimeFormat))
+		}
+
+		ctx := context.WithValue(r.Context(), versionContextKey, version)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// versionUsage counts the requests per version and route between two usage logs
+type versionUsage struct {
+	mu     sync.Mutex
+	counts map[[2]string]int64 // version and route, e.g. v1 and GET /comments/:id
+}
+
+func (u *versionUsage) record(version string, route string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.counts == nil {
+		u.counts = map[[2]string]int64{}
+	}
+	u.counts[[2]string{version, route}]++
+}
+
+// take returns the counts so far and starts over
+func (u *versionUsage) take() map[[2]string]int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counts := u.counts
+	u.counts = nil
+	return counts
+}
+
+// logVersionUsage logs the number of requests of every version and route once
+// per interval, so that we know when nobody uses a deprecated version any more
+func (a *applicationDependencies) logVersionUsage(ctx context.Context) {
+	ticker := time.NewTicker(a.config.versions.usageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		counts := a.versionUsage.take()
+		keys := make([][2]string, 0, len(counts))
+		for key := range counts {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, func(x, y [2]string) int { return strings.Compare(x[0]+x[1], y[0]+y[1]) })
+
+		deprecated := map[string]bool{}
+		for _, version := range a.versions() {
+			deprecated[version.name] = version.deprecated()
+		}
+		for _, key := range keys {
+			a.logger.Info("api version usage", "version", key[0], "route", key[1],
+				"requests", counts[key], "deprecated", deprecated[key[0]],
+				"interval", a.config.versions.usageInterval.String())
+		}
+	}
+}
+
+// commentV2 is a comment as /v2 shows it. The author is an object so that it
+// can grow without breaking clients, the timestamps are grouped
+type commentV2 struct {
+	ID            int64               `json:"id"`
+	Content       string              `json:"content"`
+	Author        authorV2            `json:"author"`
+	ThreadID      *int64              `json:"thread_id"`
+	ParentID      *int64              `json:"parent_id"`
+	Status        string              `json:"status"`
+	Version       int32               `json:"version"`
+	MatchedRuleID *int64              `json:"matched_rule_id"`
+	Reactions     data.ReactionCounts `json:"reactions"`
+	Mentions      data.Mentions       `json:"mentions"`
+	Snippet       string              `json:"snippet,omitempty"`
+	Timestamps    timestampsV2        `json:"timestamps"`
+}
+
+type authorV2 struct {
+	Name string `json:"name"`
+}
+
+type timestampsV2 struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// queuedCommentV2 is a comment of the moderation queue in /v2
+type queuedCommentV2 struct {
+	commentV2
+	Reports int `json:"reports"`
+}
+
+// includedRecordsV2 is includedRecords in /v2
+type includedRecordsV2 struct {
+	Users    []data.User   `json:"users,omitempty"`
+	Comments []commentV2   `json:"comments,omitempty"`
+	Threads  []data.Thread `json:"threads,omitempty"`
+}
+
+func newCommentV2(comment *data.Comment) commentV2 {
+	return commentV2{
+		ID:            comment.ID,
+		Content:       comment.Content,
+		Author:        authorV2{Name: comment.Author},
+		ThreadID:      comment.ThreadID,
+		ParentID:      comment.ParentID,
+		Status:        comment.Status,
+		Version:       comment.Version,
+		MatchedRuleID: comment.RuleID,
+		Reactions:     comment.Reactions,
+		Mentions:      comment.Mentions,
+		Snippet:       comment.Snippet,
+		Timestamps:    timestampsV2{CreatedAt: comment.CreatedAt, UpdatedAt: comment.UpdatedAt},
+	}
+}
+
+// a field of fields= in /v2 and the comment fields it is read from
+type commentFieldV2 struct {
+	name  string
+	from  []string
+	value func(c *commentV2) any
+}
+
+var commentFieldsV2 = []commentFieldV2{
+	{"id", []string{"id"}, func(c *commentV2) any { return c.ID }},
+	{"content", []string{"content"}, func(c *commentV2) any { return c.Content }},
+	{"author", []string{"author"}, func(c *commentV2) any { return c.Author }},
+	{"thread_id", []string{"thread_id"}, func(c *commentV2) any { return c.ThreadID }},
+	{"parent_id", []string{"parent_id"}, func(c *commentV2) any { return c.ParentID }},
+	{"status", []string{"status"}, func(c *commentV2) any { return c.Status }},
+	{"version", []string{"version"}, func(c *commentV2) any { return c.Version }},
+	{"matched_rule_id", []string{"matched_rule_id"}, func(c *commentV2) any { return c.MatchedRuleID }},
+	{"reactions", []string{"reactions"}, func(c *commentV2) any { return c.Reactions }},
+	{"mentions", []string{"mentions"}, func(c *commentV2) any { return c.Mentions }},
+	{"snippet", []string{"snippet"}, func(c *commentV2) any { return c.Snippet }},
+	{"timestamps", []string{"created_at", "updated_at"}, func(c *commentV2) any { return c.Timestamps }},
+}
+
+// commentFieldNames are the names that fields= takes in the version
+func (v apiVersion) commentFieldNames() []string {
+	if v.name == "v1" {
+		return data.CommentFields.Names()
+	}
+	names := []string{}
+	for _, field := range commentFieldsV2 {
+		names = append(names, field.name)
+	}
+	return names
+}
+
+// represent swaps the types of the OpenAPI document for those of the version
+func (v apiVersion) represent(value any) any {
+	if v.name == "v1" {
+		return value
+	}
+	switch value.(type) {
+	case data.Comment:
+		return commentV2{}
+	case []data.Comment:
+		return []commentV2{}
+	case []data.QueuedComment:
+		return []queuedCommentV2{}
+	case includedRecords:
+		return includedRecordsV2{}
+	}
+	return value
+}
+
+// readCommentFields reads fields= with the names of the version of the request
+func (a *applicationDependencies) readCommentFields(r *http.Request, queryParameters url.Values, v *validator.Validator) data.Fieldset[data.Comment] {
+	version := apiVersionFromContext(r)
+	result := queryParameters.Get("fields")
+	if version.name == "v1" || result == "" {
+		return readFieldset(queryParameters, data.CommentFields, v)
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(result, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(commentFieldsV2, func(field commentFieldV2) bool { return field.name == name })
+		if i < 0 {
+			v.AddError("fields", fmt.Sprintf("unknown field %q, must be one of %s", name, strings.Join(version.commentFieldNames(), ", ")))
+			continue
+		}
+		names = append(names, commentFieldsV2[i].from...)
+	}
+	selected, err := data.CommentFields.Select(names)
+	if err != nil {
+		v.AddError("fields", err.Error())
+	}
+	return selected
+}
+
+// commentView is what the version of the request shows of a comment
+func (a *applicationDependencies) commentView(r *http.Request, fields data.Fieldset[data.Comment], comment *data.Comment) any {
+	if apiVersionFromContext(r).name == "v1" {
+		return fields.Project(comment)
+	}
+	view := newCommentV2(comment)
+	if !fields.Partial() {
+		return view
+	}
+
+	// only what fields= asked for
+	shown := fields.Shown()
+	partial := map[string]any{}
+	for _, field := range commentFieldsV2 {
+		if slices.ContainsFunc(field.from, func(name string) bool { return slices.Contains(shown, name) }) {
+			partial[field.name] = field.value(&view)
+		}
+	}
+	return partial
+}
+
+// commentViews is commentView for every comment of a list
+func (a *applicationDependencies) commentViews(r *http.Request, fields data.Fieldset[data.Comment], comments []*data.Comment) []any {
+	views := make([]any, len(comments))
+	for i, comment := range comments {
+		views[i] = a.commentView(r, fields, comment)
+	}
+	return views
+}
+
+// queueView is the moderation queue in the version of the request
+func (a *applicationDependencies) queueView(r *http.Request, queue []*data.QueuedComment) any {
+	if apiVersionFromContext(r).name == "v1" {
+		return queue
+	}
+	views := make([]queuedCommentV2, len(queue))
+	for i, queued := range queue {
+		views[i] = queuedCommentV2{commentV2: newCommentV2(queued.Comment), Reports: queued.Reports}
+	}
+	return views
+}
+
+// versionPath is the path of a resource in the version of the request, e.g. for Location
+func versionPath(r *http.Request, format string, args ...any) string {
+	return "/" + apiVersionFromContext(r).name + fmt.Sprintf(format, args...)
+}
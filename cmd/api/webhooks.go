@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// generateSecret is used when the admin does not pick a secret
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (a *applicationDependencies) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var incomingData struct {
+		URL     string   `json:"url"`
+		Secret  string   `json:"secret"`
+		Events  []string `json:"events"`
+		Enabled *bool    `json:"enabled"`
+	}
+
+	err := a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		URL:     incomingData.URL,
+		Secret:  incomingData.Secret,
+		Events:  incomingData.Events,
+		Enabled: true,
+	}
+	if incomingData.Enabled != nil {
+		webhook.Enabled = *incomingData.Enabled
+	}
+	if webhook.Secret == "" {
+		webhook.Secret, err = generateSecret()
+		if err != nil {
+			a.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+	data.ValidateWebhook(v, webhook)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.webhookModel.Insert(webhook)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", versionPath(r, "/webhooks/%d", webhook.ID))
+
+	// this is the only time the secret is sent back
+	data := envelope{
+		"webhook": webhook,
+	}
+	err = a.writeJson(w, r, http.StatusCreated, data, headers)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// readWebhook loads the webhook named by :id and sends the error response if it can't
+func (a *applicationDependencies) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	webhook, err := a.webhookModel.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return webhook, true
+}
+
+func (a *applicationDependencies) displayWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := a.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	webhook.Secret = ""
+
+	data := envelope{
+		"webhook": webhook,
+	}
+	err := a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := a.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var incomingData struct {
+		URL     *string  `json:"url"`
+		Secret  *string  `json:"secret"`
+		Events  []string `json:"events"`
+		Enabled *bool    `json:"enabled"`
+	}
+
+	err := a.readJson(w, r, &incomingData)
+	if err != nil {
+		a.badRequestResponse(w, r, err)
+		return
+	}
+
+	if incomingData.URL != nil {
+		webhook.URL = *incomingData.URL
+	}
+	if incomingData.Secret != nil {
+		webhook.Secret = *incomingData.Secret
+	}
+	if incomingData.Events != nil {
+		webhook.Events = incomingData.Events
+	}
+	// setting enabled back to true is how a disabled webhook is revived
+	if incomingData.Enabled != nil {
+		webhook.Enabled = *incomingData.Enabled
+	}
+
+	v := validator.New()
+	data.ValidateWebhook(v, webhook)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = a.webhookModel.Update(webhook)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+	webhook.Secret = ""
+
+	data := envelope{
+		"webhook": webhook,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+func (a *applicationDependencies) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.readIDParam(r)
+	if err != nil {
+		a.notFoundResponse(w, r)
+		return
+	}
+
+	err = a.webhookModel.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			a.notFoundResponse(w, r)
+		default:
+			a.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	data := envelope{
+		"message": "webhook successfully deleted",
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// the orders of the webhook list
+var webhookSortSafeList = []string{"id", "url", "consecutive_failures",
+	"-id", "-url", "-consecutive_failures"}
+
+func (a *applicationDependencies) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+	queryParameters := r.URL.Query()
+
+	v := validator.New()
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
+	filters.Sort = a.getSingleQueryParameter(queryParameters, "sort", "id")
+	filters.SortSafeList = webhookSortSafeList
+	filters.Filter = queryParameters["filter"]
+	filters.FilterSafeList = data.WebhookFilterFields
+
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	webhooks, metadata, err := a.webhookModel.GetAll(filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"webhooks":  webhooks,
+		"@metadata": metadata,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// the delivery log of a webhook, newest first
+func (a *applicationDependencies) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := a.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var filters data.Filters
+	queryParameters := r.URL.Query()
+
+	v := validator.New()
+	filters.Page = a.getSingleIntegerParameter(queryParameters, "page", 1, v)
+	filters.PageSize = a.getSingleIntegerParameter(queryParameters, "page_size", 10, v)
+	filters.Sort = "-id"
+	filters.SortSafeList = []string{"-id"}
+
+	data.ValidateFilters(v, filters)
+	if !v.IsEmpty() {
+		a.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := a.webhookModel.GetDeliveries(webhook.ID, filters)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	data := envelope{
+		"deliveries": deliveries,
+		"@metadata":  metadata,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
+
+// sends a webhook.test event straight away and reports what the receiver said
+func (a *applicationDependencies) testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := a.readWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	payload := map[string]any{
+		"webhook_id": webhook.ID,
+		"message":    "this is a test event",
+		"sent_at":    time.Now().UTC(),
+	}
+	delivery, err := a.webhookModel.InsertDelivery(webhook, data.EventWebhookTest, payload)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// no retries, the admin is waiting for the answer
+	a.webhookWorker.Deliver(r.Context(), delivery, false)
+
+	data := envelope{
+		"delivery": delivery,
+	}
+	err = a.writeJson(w, r, http.StatusOK, data, nil)
+	if err != nil {
+		a.serverErrorResponse(w, r, err)
+	}
+}
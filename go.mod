@@ -4,4 +4,9 @@ go 1.22.6
 
 require github.com/julienschmidt/httprouter v1.3.0
 
-require github.com/lib/pq v1.10.9 // indirect
+require (
+	github.com/lib/pq v1.10.9
+	github.com/rivo/uniseg v0.4.7
+	golang.org/x/net v0.33.0
+	golang.org/x/text v0.21.0
+)
@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Stats are the counters of a cache since it was created
+type Stats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Shared        uint64 `json:"shared"` // misses that waited for the load of another request
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	Size          int    `json:"size"`
+	Capacity      int    `json:"capacity"`
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// a load that is running, the requests that miss the same key meanwhile wait for it
+type call[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// A Cache keeps at most Capacity values for TTL, the least recently used go
+// first. A nil *Cache caches nothing, Get always loads
+type Cache[K comparable, V any] struct {
+	mu         sync.Mutex
+	capacity   int
+	ttl        time.Duration
+	entries    map[K]*list.Element
+	order      *list.List // the front was used last
+	calls      map[K]*call[V]
+	generation uint64 // counts the invalidations, a load that overlaps one is not kept
+	stats      Stats
+}
+
+// New returns nil when the capacity is not positive, that is no cache at all
+func New[K comparable, V any](capacity int, ttl time.Duration) *Cache[K, V] {
+	if capacity <= 0 {
+		return nil
+	}
+	return &Cache[K, V]{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  map[K]*list.Element{},
+		order:    list.New(),
+		calls:    map[K]*call[V]{},
+		stats:    Stats{Capacity: capacity},
+	}
+}
+
+// Get returns the cached value of the key or calls load for it. Concurrent
+// misses of the same key share one load. Errors are not cached
+func (c *Cache[K, V]) Get(key K, load func() (V, error)) (V, error) {
+	if c == nil {
+		return load()
+	}
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		e := element.Value.(*entry[K, V])
+		if c.ttl <= 0 || time.Now().Before(e.expires) {
+			c.order.MoveToFront(element)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return e.value, nil
+		}
+		c.removeElement(element)
+	}
+	c.stats.Misses++
+	if running, ok := c.calls[key]; ok {
+		c.stats.Shared++
+		c.mu.Unlock()
+		<-running.done
+		return running.value, running.err
+	}
+	current := &call[V]{done: make(chan struct{})}
+	c.calls[key] = current
+	generation := c.generation
+	c.mu.Unlock()
+
+	// a panic in load must not leave the waiters hanging
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(current.done)
+	}()
+
+	current.value, current.err = load()
+	if current.err == nil {
+		c.mu.Lock()
+		// what was loaded may be from before the invalidation
+		if generation == c.generation {
+			c.add(key, current.value)
+		}
+		c.mu.Unlock()
+	}
+	return current.value, current.err
+}
+
+func (c *Cache[K, V]) add(key K, value V) {
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expires: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache[K, V]) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*entry[K, V]).key)
+}
+
+// Remove drops the value of the key
+func (c *Cache[K, V]) Remove(key K) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.stats.Invalidations++
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+// Clear drops every value
+func (c *Cache[K, V]) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.stats.Invalidations++
+	clear(c.entries)
+	c.order.Init()
+}
+
+// Stats returns the counters so far, the zero Stats for a nil cache
+func (c *Cache[K, V]) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.order.Len()
+	return stats
+}
@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// counter makes loads that return value and counts how often they ran
+func counter(value string) (func() (string, error), *atomic.Int32) {
+	var loads atomic.Int32
+	return func() (string, error) {
+		loads.Add(1)
+		return value, nil
+	}, &loads
+}
+
+// blocked starts a Get of key whose load waits until release is closed. It
+// returns once the load is running
+func blocked(c *Cache[string, string], key, value string) (release chan struct{}, result chan string) {
+	release = make(chan struct{})
+	result = make(chan string, 1)
+	started := make(chan struct{})
+	go func() {
+		got, _ := c.Get(key, func() (string, error) {
+			close(started)
+			<-release
+			return value, nil
+		})
+		result <- got
+	}()
+	<-started
+	return release, result
+}
+
+// waitFor polls until the condition holds, the goroutines of a test get there
+// on their own time
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGetSharesOneLoad(t *testing.T) {
+	c := New[string, string](10, time.Minute)
+	release, first := blocked(c, "a", "loaded")
+
+	// the others miss while the first load is running
+	const waiters = 20
+	var loads atomic.Int32
+	var wg sync.WaitGroup
+	results := make(chan string, waiters)
+	for range waiters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := c.Get("a", func() (string, error) {
+				loads.Add(1)
+				return "second load", nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			results <- got
+		}()
+	}
+	waitFor(t, "the waiters", func() bool { return c.Stats().Shared == waiters })
+
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if got := <-first; got != "loaded" {
+		t.Errorf("first Get = %q, want %q", got, "loaded")
+	}
+	for got := range results {
+		if got != "loaded" {
+			t.Errorf("shared Get = %q, want %q", got, "loaded")
+		}
+	}
+	if loads.Load() != 0 {
+		t.Errorf("the waiters loaded %d times, want 0", loads.Load())
+	}
+
+	stats := c.Stats()
+	if stats.Misses != waiters+1 || stats.Shared != waiters || stats.Size != 1 {
+		t.Errorf("stats = %+v, want %d misses, %d shared and size 1", stats, waiters+1, waiters)
+	}
+}
+
+func TestInvalidationDuringLoad(t *testing.T) {
+	tests := []struct {
+		name       string
+		invalidate func(c *Cache[string, string])
+	}{
+		{"remove the key", func(c *Cache[string, string]) { c.Remove("a") }},
+		{"remove another key", func(c *Cache[string, string]) { c.Remove("b") }},
+		{"clear", func(c *Cache[string, string]) { c.Clear() }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New[string, string](10, time.Minute)
+			release, result := blocked(c, "a", "stale")
+
+			// the load read its value before the change that invalidates it
+			tt.invalidate(c)
+			close(release)
+
+			// the caller still gets what it loaded
+			if got := <-result; got != "stale" {
+				t.Errorf("Get = %q, want %q", got, "stale")
+			}
+			if size := c.Stats().Size; size != 0 {
+				t.Errorf("size = %d, the stale value was cached", size)
+			}
+
+			load, loads := counter("fresh")
+			got, err := c.Get("a", load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "fresh" || loads.Load() != 1 {
+				t.Errorf("Get = %q after %d loads, want %q after 1", got, loads.Load(), "fresh")
+			}
+		})
+	}
+}
+
+func TestLoadAfterInvalidationIsCached(t *testing.T) {
+	c := New[string, string](10, time.Minute)
+	c.Remove("a")
+
+	load, loads := counter("value")
+	for range 3 {
+		_, err := c.Get("a", load)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loads.Load() != 1 {
+		t.Errorf("loaded %d times, want 1", loads.Load())
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	c := New[string, string](2, time.Minute)
+	load, loads := counter("value")
+
+	for _, key := range []string{"a", "b", "a", "c"} {
+		_, err := c.Get(key, load)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a was used after b, so b made room for c
+	if loads.Load() != 3 {
+		t.Errorf("loaded %d times, want 3", loads.Load())
+	}
+	stats := c.Stats()
+	if stats.Size != 2 || stats.Capacity != 2 || stats.Evictions != 1 || stats.Hits != 1 {
+		t.Errorf("stats = %+v, want size 2, capacity 2, 1 eviction and 1 hit", stats)
+	}
+
+	for _, tt := range []struct {
+		key    string
+		cached bool
+	}{
+		{"a", true},
+		{"c", true},
+		{"b", false},
+	} {
+		before := loads.Load()
+		_, err := c.Get(tt.key, load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached := loads.Load() == before; cached != tt.cached {
+			t.Errorf("%s cached = %t, want %t", tt.key, cached, tt.cached)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		wait    time.Duration
+		reloads bool
+	}{
+		{"fresh", time.Minute, 0, false},
+		{"expired", 10 * time.Millisecond, 30 * time.Millisecond, true},
+		{"no ttl never expires", 0, 30 * time.Millisecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New[string, string](10, tt.ttl)
+			load, loads := counter("value")
+
+			_, err := c.Get("a", load)
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tt.wait)
+			_, err = c.Get("a", load)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reloaded := loads.Load() == 2; reloaded != tt.reloads {
+				t.Errorf("reloaded = %t, want %t", reloaded, tt.reloads)
+			}
+			if size := c.Stats().Size; size != 1 {
+				t.Errorf("size = %d, want 1", size)
+			}
+		})
+	}
+}
+
+func TestErrorsAreNotCached(t *testing.T) {
+	c := New[string, string](10, time.Minute)
+	errLoad := errors.New("database is down")
+
+	_, err := c.Get("a", func() (string, error) { return "", errLoad })
+	if !errors.Is(err, errLoad) {
+		t.Fatalf("Get = %v, want %v", err, errLoad)
+	}
+
+	load, loads := counter("value")
+	got, err := c.Get("a", load)
+	if err != nil || got != "value" || loads.Load() != 1 {
+		t.Errorf("Get = %q, %v after %d loads, want %q after 1", got, err, loads.Load(), "value")
+	}
+}
+
+func TestNilCache(t *testing.T) {
+	c := New[string, string](0, time.Minute)
+	if c != nil {
+		t.Fatal("New with capacity 0 is not nil")
+	}
+
+	load, loads := counter("value")
+	for range 2 {
+		got, err := c.Get("a", load)
+		if err != nil || got != "value" {
+			t.Fatalf("Get = %q, %v, want %q", got, err, "value")
+		}
+	}
+	if loads.Load() != 2 {
+		t.Errorf("loaded %d times, want 2", loads.Load())
+	}
+	c.Remove("a")
+	c.Clear()
+	if stats := c.Stats(); stats != (Stats{}) {
+		t.Errorf("stats = %+v, want the zero Stats", stats)
+	}
+}
@@ -0,0 +1,156 @@
+package data
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/cache"
+)
+
+// the channel the triggers of migration 000015 notify. The payload is
+// comments:<id> or users:<id>
+const InvalidationChannel = "cache_invalidation"
+
+// A ReadCache keeps recently read comments, comment pages and users. The
+// models drop what they change themselves, the changes of other instances
+// (and of reactions, moderation and imports) arrive as notifications.
+// A nil *ReadCache caches nothing
+type ReadCache struct {
+	comments *cache.Cache[int64, *Comment]
+	pages    *cache.Cache[string, commentPage]
+	users    *cache.Cache[int64, *User]
+
+	// a miss loads from a replica, which may return the row from before the
+	// change for this long. What is dropped is dropped once more after it
+	replicaLag time.Duration
+}
+
+// a page of GetAll
+type commentPage struct {
+	comments []*Comment
+	metadata Metadata
+}
+
+// NewReadCache holds up to size entries of each kind for ttl. A size of 0 turns
+// the cache off. replicaLag is how far behind the replicas the reads go to can
+// be, 0 without replicas
+func NewReadCache(size int, ttl time.Duration, replicaLag time.Duration) *ReadCache {
+	if size <= 0 {
+		return nil
+	}
+	return &ReadCache{
+		comments:   cache.New[int64, *Comment](size, ttl),
+		pages:      cache.New[string, commentPage](size, ttl),
+		users:      cache.New[int64, *User](size, ttl),
+		replicaLag: replicaLag,
+	}
+}
+
+// drop invalidates now and again once the replicas have caught up with the
+// change, a replica that was behind may have put the old row back meanwhile
+func (rc *ReadCache) drop(invalidate func()) {
+	invalidate()
+	if rc.replicaLag > 0 {
+		time.AfterFunc(rc.replicaLag, invalidate)
+	}
+}
+
+// InvalidateComment drops the comment and every page, any page may show it
+func (rc *ReadCache) InvalidateComment(id int64) {
+	if rc == nil {
+		return
+	}
+	rc.drop(func() {
+		rc.comments.Remove(id)
+		rc.pages.Clear()
+	})
+}
+
+// InvalidateUser drops the user. The comments go too because their
+// mentions show the username
+func (rc *ReadCache) InvalidateUser(id int64) {
+	if rc == nil {
+		return
+	}
+	rc.drop(func() {
+		rc.users.Remove(id)
+		rc.comments.Clear()
+		rc.pages.Clear()
+	})
+}
+
+// Clear drops everything, e.g. when notifications may have been missed
+func (rc *ReadCache) Clear() {
+	if rc == nil {
+		return
+	}
+	rc.drop(func() {
+		rc.comments.Clear()
+		rc.pages.Clear()
+		rc.users.Clear()
+	})
+}
+
+// Invalidate handles a notification of InvalidationChannel
+func (rc *ReadCache) Invalidate(payload string) error {
+	kind, id, _ := strings.Cut(payload, ":")
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cache invalidation %q", payload)
+	}
+	switch kind {
+	case "comments":
+		rc.InvalidateComment(n)
+	case "users":
+		rc.InvalidateUser(n)
+	default:
+		return fmt.Errorf("invalid cache invalidation %q", payload)
+	}
+	return nil
+}
+
+// Stats are the counters of every cache, for monitoring
+func (rc *ReadCache) Stats() map[string]cache.Stats {
+	if rc == nil {
+		return map[string]cache.Stats{}
+	}
+	return map[string]cache.Stats{
+		"comments":      rc.comments.Stats(),
+		"comment_pages": rc.pages.Stats(),
+		"users":         rc.users.Stats(),
+	}
+}
+
+// the callers may change what they get, every one gets its own copy
+func (comment *Comment) clone() *Comment {
+	copied := *comment
+	copied.Reactions = maps.Clone(comment.Reactions)
+	copied.Mentions = slices.Clone(comment.Mentions)
+	return &copied
+}
+
+func (page commentPage) clone() ([]*Comment, Metadata) {
+	comments := make([]*Comment, len(page.comments))
+	for i, comment := range page.comments {
+		comments[i] = comment.clone()
+	}
+	return comments, page.metadata
+}
+
+// pageKey tells the pages of GetAll apart, every argument that changes the query is in it
+func pageKey(content, author, thread, search, searchConfig string, filters Filters, fields Fieldset[Comment]) string {
+	timeKey := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%q %q %q %q %q %d %d %q %q %q %q %q %t %q", content, author, thread, search, searchConfig,
+		filters.Page, filters.PageSize, filters.Sort,
+		timeKey(filters.CreatedAfter), timeKey(filters.CreatedBefore), timeKey(filters.UpdatedSince),
+		filters.Filter, fields.Partial(), fields.Names())
+}
@@ -5,9 +5,11 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/ReynerioSamos/craboo/internal/validator"
+	"github.com/lib/pq"
 )
 
 // each name begins with uppercase with so that they are exportable/public
@@ -15,55 +17,248 @@ import (
 // Make our JSON keys be displayed in all lowercase
 // "-" means don't show this field
 type Comment struct {
-	ID        int64     `json:"id"`      // unique value for each comment
-	Content   string    `json:"content"` // the comment data
-	Author    string    `json:"author"`  // the person who wrote the comment
-	CreatedAt time.Time `json:"-"`       // database timestamp
-	Version   int32     `json:"version"` // incremented on each update
+	ID        int64          `json:"id"`                                                                          // unique value for each comment
+	Content   string         `json:"content" validate:"required,text,maxchars=100,max=2000" normalize:"trim,nfc"` // the comment data
+	Author    string         `json:"author" validate:"required,line,maxchars=25,max=200" normalize:"squash,nfc"`  // the person who wrote the comment
+	ThreadID  *int64         `json:"thread_id,omitempty"`                                                         // the thread the comment belongs to, nil for the global list
+	ParentID  *int64         `json:"parent_id,omitempty"`                                                         // the comment this one replies to
+	CreatedAt time.Time      `json:"created_at"`                                                                  // database timestamp
+	UpdatedAt time.Time      `json:"updated_at"`                                                                  // changed by every update
+	Version   int32          `json:"version"`                                                                     // incremented on each update
+	Status    string         `json:"status"`                                                                      // pending, approved, rejected or hidden
+	RuleID    *int64         `json:"matched_rule_id,omitempty"`                                                   // the moderation rule that decided the status
+	Reactions ReactionCounts `json:"reactions"`                                                                   // number of reactions per kind
+	Mentions  Mentions       `json:"mentions"`                                                                    // users mentioned with @username
+	Snippet   string         `json:"snippet,omitempty"`                                                           // the content with the search terms in <mark>, only when searching
 }
 
+// commentColumns is the select list of every query that returns whole comments,
+// scanFields() gives the matching destinations in the same order
+var commentColumns = `comments.id, comments.created_at, comments.updated_at, comments.content, comments.author,
+		comments.thread_id, comments.parent_id, comments.version, comments.status, comments.matched_rule_id,
+		` + reactionCountsColumn + `,
+		` + mentionsColumn
+
+func (comment *Comment) scanFields() []any {
+	return []any{
+		&comment.ID,
+		&comment.CreatedAt,
+		&comment.UpdatedAt,
+		&comment.Content,
+		&comment.Author,
+		&comment.ThreadID,
+		&comment.ParentID,
+		&comment.Version,
+		&comment.Status,
+		&comment.RuleID,
+		&comment.Reactions,
+		&comment.Mentions,
+	}
+}
+
+// the limits are in the validate tags of Comment. The text is normalized
+// first so that the limits count what is stored
 func ValidateComment(v *validator.Validator, comment *Comment) {
-	// check if content field is empty
-	v.Check(comment.Content != "", "content", "must be provided")
-	// check if author field is empty
-	v.Check(comment.Author != "", "author", "must be provided")
-	// check if the Content field is too long
-	v.Check(len(comment.Content) <= 100, "content", "must not be more than 100 bytes long")
-	//check if Author field is too long
-	v.Check(len(comment.Author) <= 25, "author", "must not be more than 25 bytes long")
+	validator.Normalize(comment)
+	v.Struct(comment)
 }
 
 // A CommentModel expects a connection pool
 type CommentModel struct {
-	DB *sql.DB
+	DB           *sql.DB
+	SearchConfig string     // text search configuration, e.g. english or simple
+	Cache        *ReadCache // nil when reads are not cached
+	Replicas     *Replicas  // where Get and GetAll read, nil for the primary
+	primary      bool       // reads skip the cache, see Primary
+}
+
+// Primary reads from the primary and past the cache, for writes and for
+// clients that must see what they just wrote. Until the replicas catch up
+// the cache may hold what one of them returned before the change
+func (c CommentModel) Primary() CommentModel {
+	c.Replicas = nil
+	c.primary = true
+	return c
+}
+
+// reader is the pool of the next read
+func (c CommentModel) reader() *sql.DB {
+	if c.Replicas == nil {
+		return c.DB
+	}
+	return c.Replicas.Reader()
+}
+
+func (c CommentModel) searchConfig() string {
+	if c.SearchConfig == "" {
+		return "english"
+	}
+	return c.SearchConfig
+}
+
+// searchConfigs returns the canonical name of the configured text search
+// configuration and the one new comments are indexed with. The first query
+// fails for configurations that do not exist
+func (c CommentModel) searchConfigs(ctx context.Context) (string, string, error) {
+	var config string
+	err := c.DB.QueryRowContext(ctx, `SELECT $1::regconfig::text`, c.searchConfig()).Scan(&config)
+	if err != nil {
+		return "", "", err
+	}
+
+	var current sql.NullString
+	err = c.DB.QueryRowContext(ctx, `
+		SELECT column_default
+		FROM information_schema.columns
+		WHERE table_name = 'comments' AND column_name = 'search_config'
+		`).Scan(&current)
+	if err != nil {
+		return "", "", err
+	}
+	current.String = strings.TrimSuffix(current.String, "::regconfig")
+	return config, strings.Trim(current.String, "'"), nil
+}
+
+// CheckSearchConfig makes sure the comments are indexed with the configured
+// text search configuration, searching with another one finds next to nothing.
+// Changing it is up to UseSearchConfig, which is too slow for startup
+func (c CommentModel) CheckSearchConfig() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	config, current, err := c.searchConfigs(ctx)
+	if err != nil {
+		return err
+	}
+	if config != current {
+		return fmt.Errorf("the comments are indexed with the %s search configuration, not %s: run make db/search-config config=%s first", current, config, config)
+	}
+	return nil
+}
+
+// UseSearchConfig makes the text search configuration the default of new
+// comments and re-indexes the comments that were indexed with another one.
+// It only does work when the configuration changed
+func (c CommentModel) UseSearchConfig() error {
+	// a long table takes a while to re-index
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	config, current, err := c.searchConfigs(ctx)
+	if err != nil {
+		return err
+	}
+	if config == current {
+		return nil
+	}
+
+	// DDL does not take parameters, the name was checked by searchConfigs
+	_, err = c.DB.ExecContext(ctx, `ALTER TABLE comments ALTER COLUMN search_config SET DEFAULT `+
+		pq.QuoteLiteral(config)+`::regconfig`)
+	if err != nil {
+		return err
+	}
+	_, err = c.DB.ExecContext(ctx, `UPDATE comments SET search_config = $1::regconfig
+		WHERE search_config <> $1::regconfig`, config)
+	return err
 }
 
 // Insert a new row in the commetns table
 // Expects a pointer to the actual
+// The mentions and the comment.created event are stored in the same transaction
 func (c CommentModel) Insert(comment *Comment) error {
 	// the SQL query to be executed against the database table
 	query := `
-		INSERT INTO comments (content, author)
-		VALUES ($1, $2)
-		RETURNING id, created_at, version
+		INSERT INTO comments (content, author, status, matched_rule_id, thread_id, parent_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, updated_at, version
 		`
-	// the actual values to replace $1, and $2
-	args := []any{comment.Content, comment.Author}
+	// comments are live straight away unless they need to be moderated first
+	if comment.Status == "" {
+		comment.Status = StatusApproved
+	}
+
+	// the actual values to replace $1 to $6
+	args := []any{comment.Content, comment.Author, comment.Status, comment.RuleID, comment.ThreadID, comment.ParentID}
 
 	// Create a context with a 3-second timeout. No database
 	// operation should take more than 3 seconds or we will quit it
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// this is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
 	// executre the query against the comments database table. We ask for the
 	// id, created_at, and the version to be sent back to us which we will use
 	// to update the Comment struct later on
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&comment.ID, &comment.CreatedAt, &comment.UpdatedAt, &comment.Version)
+	if err != nil {
+		return err
+	}
+
+	// a brand new comment has no reactions yet
+	comment.Reactions = ReactionCounts{}
+
+	// link every @username to its user
+	comment.Mentions, err = replaceMentions(ctx, tx, comment.ID, ParseMentions(comment.Content))
+	if err != nil {
+		return err
+	}
+
+	err = insertOutbox(ctx, tx, EventCommentCreated, comment.ID, comment)
+	if err != nil {
+		return err
+	}
 
-	return c.DB.QueryRowContext(ctx, query, args...).Scan(&comment.ID, &comment.CreatedAt, &comment.Version)
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// the other instances hear of it from the trigger
+	c.Cache.InvalidateComment(comment.ID)
+	return nil
 }
 
 // Get a specific Coment from the comments table
 func (c CommentModel) Get(id int64) (*Comment, error) {
+	return c.GetFields(id, CommentFields)
+}
+
+// GetFields only reads the fields of the fieldset, the rest stay zero.
+// With a cache the whole comment is read and kept, the fieldset still
+// decides what is shown
+func (c CommentModel) GetFields(id int64, fields Fieldset[Comment]) (*Comment, error) {
+	if c.Cache == nil || c.primary {
+		return c.getFields(id, fields)
+	}
+	comment, err := c.Cache.comments.Get(id, func() (*Comment, error) {
+		return c.getFields(id, CommentFields)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comment.clone(), nil
+}
+
+// GetPublished is GetFields for the public. A comment that is pending,
+// rejected or hidden is not found, the moderators see it in the queue
+func (c CommentModel) GetPublished(id int64, fields Fieldset[Comment]) (*Comment, error) {
+	comment, err := c.GetFields(id, fields.Require("status"))
+	if err != nil {
+		return nil, err
+	}
+	if comment.Status != StatusApproved {
+		return nil, ErrRecordNotFound
+	}
+	return comment, nil
+}
+
+func (c CommentModel) getFields(id int64, fields Fieldset[Comment]) (*Comment, error) {
 	// check if the id is valid
 	if id < 1 {
 		return nil, ErrRecordNotFound
@@ -71,7 +266,7 @@ func (c CommentModel) Get(id int64) (*Comment, error) {
 
 	// the SQL query to be executed against the database table
 	query := `
-		SELECT id, created_at, content, author, version
+		SELECT ` + fields.columns() + `
 		FROM comments
 		WHERE id = $1
 		`
@@ -82,13 +277,7 @@ func (c CommentModel) Get(id int64) (*Comment, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := c.DB.QueryRowContext(ctx, query, id).Scan(
-		&comment.ID,
-		&comment.CreatedAt,
-		&comment.Content,
-		&comment.Author,
-		&comment.Version,
-	)
+	err := c.reader().QueryRowContext(ctx, query, id).Scan(fields.scanFields(&comment)...)
 
 	if err != nil {
 		switch {
@@ -101,21 +290,104 @@ func (c CommentModel) Get(id int64) (*Comment, error) {
 	return &comment, nil
 }
 
+// GetByIDs loads the approved comments with the ids in one query,
+// the others are left out
+func (c CommentModel) GetByIDs(ids []int64) ([]*Comment, error) {
+	query := `
+		SELECT ` + commentColumns + `
+		FROM comments
+		WHERE comments.id = ANY($1) AND status = 'approved'
+		ORDER BY comments.id
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []*Comment{}
+	for rows.Next() {
+		var comment Comment
+		err := rows.Scan(comment.scanFields()...)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, &comment)
+	}
+	return comments, rows.Err()
+}
+
 func (c CommentModel) Update(comment *Comment) error {
 	// The SQL query to be executed against the database table
 	// Everytime we make an update, we increment the version number
+	// the old status decides the event, see insertCommentEvent
 	query := `
+		WITH previous AS (
+			SELECT status FROM comments WHERE id = $5 AND version = $6
+		)
 		UPDATE comments
-		SET content = $1, author = $2, version = version + 1
-		WHERE id = $3
-		RETURNING version
+		SET content = $1, author = $2, status = $3, matched_rule_id = $4, version = version + 1,
+			updated_at = NOW()
+		WHERE id = $5 AND version = $6
+		RETURNING version, updated_at, (SELECT status FROM previous)
 		`
 
-	args := []any{comment.Content, comment.Author, comment.ID}
+	args := []any{comment.Content, comment.Author, comment.Status, comment.RuleID, comment.ID, comment.Version}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return c.DB.QueryRowContext(ctx, query, args...).Scan(&comment.Version)
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// no row means the comment changed (e.g. a moderator hid it) or was
+	// deleted since we read it
+	var previous string
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&comment.Version, &comment.UpdatedAt, &previous)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	// the offsets change with the content so the mentions are parsed again
+	comment.Mentions, err = replaceMentions(ctx, tx, comment.ID, ParseMentions(comment.Content))
+	if err != nil {
+		return err
+	}
+
+	err = insertCommentEvent(ctx, tx, previous, comment)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	c.Cache.InvalidateComment(comment.ID)
+	return nil
+}
+
+// insertCommentEvent records the change of a comment that had the status
+// from. Like the comment stream, a comment that becomes approved is new to the
+// public and one that stops being approved is gone
+func insertCommentEvent(ctx context.Context, tx *sql.Tx, from string, comment *Comment) error {
+	switch {
+	case from != StatusApproved && comment.Status == StatusApproved:
+		return insertOutbox(ctx, tx, EventCommentCreated, comment.ID, comment)
+	case from == StatusApproved && comment.Status != StatusApproved:
+		return insertOutbox(ctx, tx, EventCommentDeleted, comment.ID, map[string]int64{"id": comment.ID})
+	}
+	return insertOutbox(ctx, tx, EventCommentUpdated, comment.ID, comment)
 }
 
 func (c CommentModel) Delete(id int64) error {
@@ -131,10 +403,16 @@ func (c CommentModel) Delete(id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := c.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// ExecContext does not return any rows unlike QueryRowContext.
 	// It only returns information about the query execution
 	// such as how many rows were affected
-	result, err := c.DB.ExecContext(ctx, query, id)
+	result, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -150,35 +428,82 @@ func (c CommentModel) Delete(id int64) error {
 		return ErrRecordNotFound
 	}
 
+	err = insertOutbox(ctx, tx, EventCommentDeleted, id, map[string]int64{"id": id})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	c.Cache.InvalidateComment(id)
 	return nil
 }
 
 // Get all comments
-func (c CommentModel) GetAll(content string, author string, filters Filters) ([]*Comment, Metadata, error) {
+// search uses the web search syntax: "quoted phrases", or, -excluded
+// only the fields of the fieldset are read
+func (c CommentModel) GetAll(content string, author string, thread string, search string, filters Filters, fields Fieldset[Comment]) ([]*Comment, Metadata, error) {
+	if c.Cache == nil || c.primary {
+		return c.getAll(content, author, thread, search, filters, fields)
+	}
+	key := pageKey(content, author, thread, search, c.searchConfig(), filters, fields)
+	page, err := c.Cache.pages.Get(key, func() (commentPage, error) {
+		comments, metadata, err := c.getAll(content, author, thread, search, filters, fields)
+		return commentPage{comments: comments, metadata: metadata}, err
+	})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	comments, metadata := page.clone()
+	return comments, metadata, nil
+}
+
+func (c CommentModel) getAll(content string, author string, thread string, search string, filters Filters, fields Fieldset[Comment]) ([]*Comment, Metadata, error) {
 	// The SQL query to be executed against database table
 
 	// We will use Postgresql built in full text search feature
 	// which allows us to do natural language searches
-	// $? = '' allows for content and author to be optional
+	// $? = '' allows for content, author, thread and search to be optional
+	// Only approved comments are public, the rest are for moderators
+
+	// the content is escaped before ts_headline adds the <mark> tags so that the
+	// snippet is safe to show as HTML. Postgres only computes it for the rows of the page
 
 	// Query formatted string to be able to add the sort values, We are not sure what will be the column
 	// sort by or the order
+	timeRange, timeArgs := filters.timeRange("comments", 8)
+	filter, filterArgs := filters.filterCondition(11)
 	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, created_at, content, author, version
-		FROM comments
-		WHERE (to_tsvector('simple', content) @@
-				plainto_tsquery('simple', $1) OR $1 = '')
+		SELECT COUNT(*) OVER(), %s,
+			CASE WHEN $6 = '' THEN '' ELSE ts_headline($7::regconfig,
+				replace(replace(replace(comments.content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+				search_query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MinWords=5, MaxWords=20')
+			END
+		FROM comments, websearch_to_tsquery($7::regconfig, $6) AS search_query
+		%s
+		CROSS JOIN LATERAL (SELECT ts_rank_cd(comments.search_vector, search_query) AS relevance) AS ranking
+		WHERE status = 'approved'
+		AND (comments.search_vector @@ plainto_tsquery($7::regconfig, $1) OR $1 = '')
 		AND (to_tsvector('simple', author) @@
 				plainto_tsquery('simple', $2) OR $2 = '')
+		AND (comments.thread_id = (SELECT threads.id FROM threads WHERE threads.key = $3) OR $3 = '')
+		AND (comments.search_vector @@ search_query OR $6 = '')
+		AND %s
+		AND %s
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4
-		`, filters.sortColumn(), filters.sortDirection())
+		LIMIT $4 OFFSET $5
+		`, fields.columns(), reactionTotalsJoin, timeRange, filter, filters.sortColumn(), filters.sortDirection())
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	// Query context returns multiple rows
-	rows, err := c.DB.QueryContext(ctx, query, content, author, filters.limit(), filters.offset())
+	args := append([]any{content, author, thread, filters.limit(), filters.offset(),
+		search, c.searchConfig()}, timeArgs...)
+	args = append(args, filterArgs...)
+	rows, err := c.reader().QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -192,13 +517,7 @@ func (c CommentModel) GetAll(content string, author string, filters Filters) ([]
 	// process each row that is in the var rows
 	for rows.Next() {
 		var comment Comment
-		err := rows.Scan(
-			&totalRecords,
-			&comment.ID,
-			&comment.CreatedAt,
-			&comment.Content,
-			&comment.Author,
-			&comment.Version)
+		err := rows.Scan(append(append([]any{&totalRecords}, fields.scanFields(&comment)...), &comment.Snippet)...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// the states of an email
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+)
+
+// An Email is a message waiting to be sent, or one that was. Template names
+// one of the templates of the mailer and Data is what it is rendered with
+type Email struct {
+	ID            int64           `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	OutboxID      *int64          `json:"outbox_id,omitempty"` // the event that caused the email
+	Recipient     string          `json:"recipient"`
+	Template      string          `json:"template"`
+	Data          json.RawMessage `json:"data"`
+	Status        string          `json:"status"`                    // pending, sent or failed
+	Attempts      int             `json:"attempts"`                  // how many times we tried
+	LastError     string          `json:"last_error,omitempty"`      // why the last attempt failed
+	NextAttemptAt *time.Time      `json:"next_attempt_at,omitempty"` // when a pending email is retried
+	SentAt        *time.Time      `json:"sent_at,omitempty"`
+}
+
+// A Digest is what a user missed since the last digest
+type Digest struct {
+	User     *User
+	Comments []*Comment // only ID, CreatedAt, Content, Author and ThreadID are filled in
+}
+
+// the most comments listed in one digest
+const digestMaxComments = 50
+
+// An EmailModel expects a connection pool
+type EmailModel struct {
+	DB *sql.DB
+}
+
+// Enqueue queues an email for the worker. outboxID may be nil, an event
+// that is handed over again does not queue the same email twice
+func (m EmailModel) Enqueue(outboxID *int64, recipient string, template string, data any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return enqueueEmail(ctx, m.DB, outboxID, recipient, template, data)
+}
+
+// enqueueEmail works with the pool as well as in a transaction
+func enqueueEmail(ctx context.Context, db interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, outboxID *int64, recipient string, template string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO emails (outbox_id, recipient, template, data)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (outbox_id, template, recipient) DO NOTHING
+		`
+	_, err = db.ExecContext(ctx, query, outboxID, recipient, template, raw)
+	return err
+}
+
+// ClaimDue picks the emails that are due and leases them to the caller so that
+// other instances leave them alone. The attempt is counted straight away
+func (m EmailModel) ClaimDue(limit int, lease time.Duration) ([]*Email, error) {
+	query := `
+		UPDATE emails
+		SET attempts = attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id
+			FROM emails
+			WHERE status = 'pending'
+			AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at ASC
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, outbox_id, recipient, template, data, attempts
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []*Email{}
+	for rows.Next() {
+		email := Email{Status: EmailPending}
+		err := rows.Scan(
+			&email.ID,
+			&email.CreatedAt,
+			&email.OutboxID,
+			&email.Recipient,
+			&email.Template,
+			&email.Data,
+			&email.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, &email)
+	}
+
+	return emails, rows.Err()
+}
+
+// RecordAttempt stores the outcome of sending an email. A failed email is
+// retried at retryAt unless retryAt is nil, then it has failed for good
+func (m EmailModel) RecordAttempt(email *Email, retryAt *time.Time) error {
+	if email.Status != EmailSent {
+		email.Status = EmailPending
+		if retryAt == nil {
+			email.Status = EmailFailed
+		}
+	}
+	email.NextAttemptAt = retryAt
+
+	query := `
+		UPDATE emails
+		SET status = $1, last_error = $2, next_attempt_at = COALESCE($3, next_attempt_at),
+			sent_at = CASE WHEN $1 = 'sent' THEN NOW() ELSE NULL END
+		WHERE id = $4
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email.Status, email.LastError, retryAt, email.ID)
+	return err
+}
+
+// RunDigest queues the digests of the day unless another instance already did.
+// Every user who wants a digest and was mentioned or replied to from since up
+// to until is passed to build, which returns the template and data of the email.
+// It returns false when the digest of the day was already queued
+func (m EmailModel) RunDigest(day time.Time, since time.Time, until time.Time, build func(digest *Digest) (string, any, error)) (bool, error) {
+	// this can be a lot of work on a busy day
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	// this is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO digest_runs (day)
+		VALUES ($1)
+		ON CONFLICT (day) DO NOTHING
+		`, day.Format(time.DateOnly))
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return false, err
+	}
+
+	// the approved comments that mention the user or reply to one of the
+	// user's comments, not counting what the user wrote
+	query := `
+		SELECT users.id, users.created_at, users.email, users.fullname, users.username,
+			comments.id, comments.created_at, comments.content, comments.author, comments.thread_id
+		FROM notification_preferences p
+		JOIN users ON users.id = p.user_id
+		JOIN comments ON comments.status = 'approved'
+			AND comments.created_at >= $1
+			AND comments.created_at < $2
+			AND lower(comments.author) <> lower(users.username)
+			AND (EXISTS (SELECT 1 FROM comment_mentions
+						WHERE comment_mentions.comment_id = comments.id
+						AND comment_mentions.user_id = users.id)
+				OR EXISTS (SELECT 1 FROM comments parent
+						WHERE parent.id = comments.parent_id
+						AND lower(parent.author) = lower(users.username)))
+		WHERE p.digest
+		ORDER BY users.id, comments.id
+		`
+	rows, err := tx.QueryContext(ctx, query, since, until)
+	if err != nil {
+		return false, err
+	}
+
+	digests := []*Digest{}
+	for rows.Next() {
+		var user User
+		var comment Comment
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Email,
+			&user.Fullname,
+			&user.Username,
+			&comment.ID,
+			&comment.CreatedAt,
+			&comment.Content,
+			&comment.Author,
+			&comment.ThreadID)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+
+		// the rows of a user are next to each other
+		if len(digests) == 0 || digests[len(digests)-1].User.ID != user.ID {
+			digests = append(digests, &Digest{User: &user})
+		}
+		digest := digests[len(digests)-1]
+		if len(digest.Comments) < digestMaxComments {
+			digest.Comments = append(digest.Comments, &comment)
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return false, err
+	}
+
+	for _, digest := range digests {
+		template, data, err := build(digest)
+		if err != nil {
+			return false, err
+		}
+		err = enqueueEmail(ctx, tx, nil, digest.User.Email, template, data)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
@@ -5,3 +5,14 @@ import (
 )
 
 var ErrRecordNotFound = errors.New("record not found")
+
+var ErrDuplicateUsername = errors.New("duplicate username")
+
+// the record changed since it was read
+var ErrEditConflict = errors.New("edit conflict")
+
+// an Idempotency-Key whose first request is still running
+var ErrIdempotencyKeyInUse = errors.New("idempotency key in use")
+
+// an Idempotency-Key that came with a different request before
+var ErrIdempotencyKeyMismatch = errors.New("idempotency key mismatch")
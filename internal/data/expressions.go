@@ -0,0 +1,444 @@
+package data
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// The filter query parameter of the list endpoints is a small expression language:
+//
+//	author:eq:alice
+//	version:gte:2 AND created_at:lt:2026-01-01
+//	author:in:alice|bob AND (likes:gt:10 OR content:contains:"good point")
+//	thread_id:eq:null
+//
+// AND binds tighter than OR and parentheses group. Values with spaces or
+// parentheses are put in double quotes, \" and \\ escape inside them.
+// The fields each resource allows are listed in a FilterSafeList
+
+// the types of a filterable field and the operators they allow
+const (
+	FilterText    = "text"
+	FilterInteger = "integer"
+	FilterTime    = "time"
+	FilterBoolean = "boolean"
+)
+
+var filterOperators = map[string][]string{
+	FilterText:    {"eq", "ne", "contains", "in"},
+	FilterInteger: {"eq", "ne", "lt", "lte", "gt", "gte", "in"},
+	FilterTime:    {"lt", "lte", "gt", "gte"},
+	FilterBoolean: {"eq", "ne"},
+}
+
+var sqlOperators = map[string]string{
+	"eq":  "=",
+	"ne":  "IS DISTINCT FROM",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+}
+
+// keep the generated SQL small
+const (
+	filterMaxLength     = 1000
+	filterMaxConditions = 20
+	filterMaxDepth      = 5
+	filterMaxInValues   = 50
+)
+
+// A FilterField is a field clients may filter on
+type FilterField struct {
+	Column   string // the SQL expression, e.g. comments.author
+	Type     string // text, integer, time or boolean
+	Nullable bool   // allows eq:null and ne:null
+}
+
+// the fields of the comment listings
+var CommentFilterFields = map[string]FilterField{
+	"id":         {Column: "comments.id", Type: FilterInteger},
+	"author":     {Column: "comments.author", Type: FilterText},
+	"content":    {Column: "comments.content", Type: FilterText},
+	"version":    {Column: "comments.version", Type: FilterInteger},
+	"thread_id":  {Column: "comments.thread_id", Type: FilterInteger, Nullable: true},
+	"parent_id":  {Column: "comments.parent_id", Type: FilterInteger, Nullable: true},
+	"likes":      {Column: "reaction_totals.likes", Type: FilterInteger},
+	"reactions":  {Column: "reaction_totals.reactions", Type: FilterInteger},
+	"created_at": {Column: "comments.created_at", Type: FilterTime},
+	"updated_at": {Column: "comments.updated_at", Type: FilterTime},
+}
+
+// the fields of the moderation rules listing
+var RuleFilterFields = map[string]FilterField{
+	"id":          {Column: "id", Type: FilterInteger},
+	"name":        {Column: "name", Type: FilterText},
+	"kind":        {Column: "kind", Type: FilterText},
+	"action":      {Column: "action", Type: FilterText},
+	"enabled":     {Column: "enabled", Type: FilterBoolean},
+	"hits":        {Column: "hits", Type: FilterInteger},
+	"last_hit_at": {Column: "last_hit_at", Type: FilterTime, Nullable: true},
+}
+
+// the fields of the webhooks listing
+var WebhookFilterFields = map[string]FilterField{
+	"id":                   {Column: "id", Type: FilterInteger},
+	"url":                  {Column: "url", Type: FilterText},
+	"enabled":              {Column: "enabled", Type: FilterBoolean},
+	"consecutive_failures": {Column: "consecutive_failures", Type: FilterInteger},
+}
+
+// A FilterError points at the part of the expression that is wrong
+type FilterError struct {
+	Position int    // 1-based, in characters
+	Token    string // the offending token, empty at the end of the expression
+	Message  string
+}
+
+func (e *FilterError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("at position %d: %s", e.Position, e.Message)
+	}
+	return fmt.Sprintf("at position %d near %q: %s", e.Position, e.Token, e.Message)
+}
+
+// a filterNode is either a group of children joined with AND/OR or a single condition
+type filterNode struct {
+	join     string // AND or OR, empty for a condition
+	children []*filterNode
+
+	field    FilterField
+	operator string
+	values   []any // one value, several for in, none for null checks
+}
+
+type filterToken struct {
+	text     string // (, ), AND, OR or a whole condition
+	position int
+}
+
+// tokenize splits the expression, keeping the quoted values of conditions intact
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	runes := []rune(expression)
+	tokens := []filterToken{}
+
+	for i := 0; i < len(runes); {
+		switch {
+		case unicode.IsSpace(runes[i]):
+			i++
+		case runes[i] == '(' || runes[i] == ')':
+			tokens = append(tokens, filterToken{string(runes[i]), i + 1})
+			i++
+		default:
+			start := i
+			inQuotes := false
+			for i < len(runes) {
+				r := runes[i]
+				if inQuotes {
+					if r == '\\' && i+1 < len(runes) {
+						i += 2
+						continue
+					}
+					if r == '"' {
+						inQuotes = false
+					}
+				} else {
+					if unicode.IsSpace(r) || r == '(' || r == ')' {
+						break
+					}
+					if r == '"' {
+						inQuotes = true
+					}
+				}
+				i++
+			}
+			if inQuotes {
+				return nil, &FilterError{start + 1, string(runes[start:]), "unterminated quoted value"}
+			}
+			tokens = append(tokens, filterToken{string(runes[start:i]), start + 1})
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens     []filterToken
+	next       int
+	fields     map[string]FilterField
+	conditions int
+	end        int // position just past the expression, for errors at the end
+}
+
+// parseFilter checks the expression against the allowed fields and returns its tree
+func parseFilter(expression string, fields map[string]FilterField) (*filterNode, error) {
+	if len(expression) > filterMaxLength {
+		return nil, &FilterError{1, "", fmt.Sprintf("must not be more than %d bytes long", filterMaxLength)}
+	}
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens, fields: fields, end: len([]rune(expression)) + 1}
+	if len(tokens) == 0 {
+		return nil, &FilterError{1, "", "must not be empty"}
+	}
+
+	node, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.next < len(p.tokens) {
+		token := p.tokens[p.next]
+		return nil, &FilterError{token.position, token.text, "expected AND or OR"}
+	}
+	return node, nil
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.next >= len(p.tokens) {
+		return filterToken{position: p.end}, false
+	}
+	return p.tokens[p.next], true
+}
+
+func isKeyword(token filterToken, keyword string) bool {
+	return strings.EqualFold(token.text, keyword)
+}
+
+func (p *filterParser) parseOr(depth int) (*filterNode, error) {
+	return p.parseJoin(depth, "OR", p.parseAnd)
+}
+
+func (p *filterParser) parseAnd(depth int) (*filterNode, error) {
+	return p.parseJoin(depth, "AND", p.parseTerm)
+}
+
+// parseJoin reads operands separated by the keyword
+func (p *filterParser) parseJoin(depth int, keyword string, operand func(int) (*filterNode, error)) (*filterNode, error) {
+	first, err := operand(depth)
+	if err != nil {
+		return nil, err
+	}
+	node := &filterNode{join: keyword, children: []*filterNode{first}}
+	for {
+		token, ok := p.peek()
+		if !ok || !isKeyword(token, keyword) {
+			break
+		}
+		p.next++
+		child, err := operand(depth)
+		if err != nil {
+			return nil, err
+		}
+		node.children = append(node.children, child)
+	}
+	if len(node.children) == 1 {
+		return first, nil
+	}
+	return node, nil
+}
+
+func (p *filterParser) parseTerm(depth int) (*filterNode, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, &FilterError{token.position, "", "expected a condition or ("}
+	}
+
+	switch {
+	case token.text == "(":
+		if depth >= filterMaxDepth {
+			return nil, &FilterError{token.position, token.text, fmt.Sprintf("must not nest more than %d levels deep", filterMaxDepth)}
+		}
+		p.next++
+		node, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		closing, ok := p.peek()
+		if !ok || closing.text != ")" {
+			return nil, &FilterError{closing.position, closing.text, "expected )"}
+		}
+		p.next++
+		return node, nil
+	case token.text == ")" || isKeyword(token, "AND") || isKeyword(token, "OR"):
+		return nil, &FilterError{token.position, token.text, "expected a condition or ("}
+	}
+
+	p.next++
+	p.conditions++
+	if p.conditions > filterMaxConditions {
+		return nil, &FilterError{token.position, token.text, fmt.Sprintf("must not have more than %d conditions", filterMaxConditions)}
+	}
+	return p.parseCondition(token)
+}
+
+// parseCondition reads field:operator:value
+func (p *filterParser) parseCondition(token filterToken) (*filterNode, error) {
+	parts := strings.SplitN(token.text, ":", 3)
+	if len(parts) != 3 {
+		return nil, &FilterError{token.position, token.text, "must be field:operator:value"}
+	}
+	name, operator, raw := parts[0], parts[1], parts[2]
+
+	field, ok := p.fields[name]
+	if !ok {
+		return nil, &FilterError{token.position, name, fmt.Sprintf("unknown field, must be one of %s", strings.Join(sortedKeys(p.fields), ", "))}
+	}
+	operatorPosition := token.position + len([]rune(name)) + 1
+	allowed := filterOperators[field.Type]
+	if !slices.Contains(allowed, operator) {
+		return nil, &FilterError{operatorPosition, operator, fmt.Sprintf("%s does not support this operator, must be one of %s", name, strings.Join(allowed, ", "))}
+	}
+
+	valuePosition := operatorPosition + len([]rune(operator)) + 1
+	node := &filterNode{field: field, operator: operator}
+
+	// null is only special without quotes, "null" is the text
+	if raw == "null" && (operator == "eq" || operator == "ne") {
+		if !field.Nullable {
+			return nil, &FilterError{valuePosition, raw, fmt.Sprintf("%s is never null", name)}
+		}
+		return node, nil
+	}
+
+	rawValues := []string{raw}
+	if operator == "in" {
+		rawValues = splitOutsideQuotes(raw, '|')
+		if len(rawValues) > filterMaxInValues {
+			return nil, &FilterError{valuePosition, raw, fmt.Sprintf("must not list more than %d values", filterMaxInValues)}
+		}
+	}
+	// an error points at the value itself, not at the start of the in list
+	position := valuePosition
+	for _, rawValue := range rawValues {
+		value, err := parseFilterValue(field.Type, rawValue)
+		if err != nil {
+			return nil, &FilterError{position, rawValue, err.Error()}
+		}
+		node.values = append(node.values, value)
+		position += len([]rune(rawValue)) + 1
+	}
+	return node, nil
+}
+
+// parseFilterValue converts the text of a value to the type of the field
+func parseFilterValue(fieldType string, raw string) (any, error) {
+	if strings.HasPrefix(raw, `"`) {
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return nil, fmt.Errorf("quoted value must end with a quote")
+		}
+		var b strings.Builder
+		inner := raw[1 : len(raw)-1]
+		for i := 0; i < len(inner); i++ {
+			if inner[i] == '\\' && i+1 < len(inner) {
+				i++
+			}
+			b.WriteByte(inner[i])
+		}
+		raw = b.String()
+	}
+	if raw == "" {
+		return nil, fmt.Errorf("must not be empty")
+	}
+
+	switch fieldType {
+	case FilterInteger:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		return n, nil
+	case FilterTime:
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			t, err = time.Parse(time.DateOnly, raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("must be an RFC 3339 timestamp or a date (YYYY-MM-DD)")
+		}
+		return t, nil
+	case FilterBoolean:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		return b, nil
+	}
+	return raw, nil
+}
+
+// splitOutsideQuotes splits the values of in, a separator inside quotes is kept
+func splitOutsideQuotes(s string, sep byte) []string {
+	parts := []string{}
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case inQuotes && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func sortedKeys(fields map[string]FilterField) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// compile turns the tree into SQL. The values are appended to args and the
+// placeholders are numbered to match
+func (node *filterNode) compile(args *[]any) string {
+	if node.join != "" {
+		parts := make([]string, len(node.children))
+		for i, child := range node.children {
+			parts[i] = child.compile(args)
+		}
+		return "(" + strings.Join(parts, " "+node.join+" ") + ")"
+	}
+
+	column := node.field.Column
+	placeholder := func(value any) string {
+		*args = append(*args, value)
+		return fmt.Sprintf("$%d", len(*args))
+	}
+
+	switch {
+	case len(node.values) == 0 && node.operator == "eq":
+		return column + " IS NULL"
+	case len(node.values) == 0:
+		return column + " IS NOT NULL"
+	case node.operator == "in" && node.field.Type == FilterInteger:
+		values := make([]int64, len(node.values))
+		for i, value := range node.values {
+			values[i] = value.(int64)
+		}
+		return column + " = ANY(" + placeholder(pq.Array(values)) + ")"
+	case node.operator == "in":
+		values := make([]string, len(node.values))
+		for i, value := range node.values {
+			values[i] = value.(string)
+		}
+		return column + " = ANY(" + placeholder(pq.Array(values)) + ")"
+	case node.operator == "contains":
+		// % and _ in the value are matched literally
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(node.values[0].(string))
+		return column + " ILIKE '%' || " + placeholder(escaped) + " || '%'"
+	}
+	return column + " " + sqlOperators[node.operator] + " " + placeholder(node.values[0])
+}
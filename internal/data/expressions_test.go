@@ -0,0 +1,180 @@
+package data
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		sql        string
+		args       []any
+	}{
+		{"condition", "author:eq:alice", "comments.author = $1", []any{"alice"}},
+		{"not equal", "author:ne:alice", "comments.author IS DISTINCT FROM $1", []any{"alice"}},
+		{"integer", "version:gte:2", "comments.version >= $1", []any{int64(2)}},
+		{"date", "created_at:lt:2026-01-01", "comments.created_at < $1",
+			[]any{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{"timestamp", "created_at:gt:2026-01-01T10:00:00Z", "comments.created_at > $1",
+			[]any{time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)}},
+		{"AND binds tighter than OR", "author:eq:a OR author:eq:b AND version:gt:1",
+			"(comments.author = $1 OR (comments.author = $2 AND comments.version > $3))",
+			[]any{"a", "b", int64(1)}},
+		{"AND first", "author:eq:a AND author:eq:b OR version:gt:1",
+			"((comments.author = $1 AND comments.author = $2) OR comments.version > $3)",
+			[]any{"a", "b", int64(1)}},
+		{"parentheses", "(author:eq:a OR author:eq:b) AND version:gt:1",
+			"((comments.author = $1 OR comments.author = $2) AND comments.version > $3)",
+			[]any{"a", "b", int64(1)}},
+		{"keywords in any case", "author:eq:a and version:gt:1 Or id:eq:3",
+			"((comments.author = $1 AND comments.version > $2) OR comments.id = $3)",
+			[]any{"a", int64(1), int64(3)}},
+		{"redundant parentheses", "((author:eq:a))", "comments.author = $1", []any{"a"}},
+		{"quoted", `content:eq:"good point (really)"`, "comments.content = $1", []any{"good point (really)"}},
+		{"escaped quote and backslash", `content:eq:"say \"hi\" \\o/"`, "comments.content = $1", []any{`say "hi" \o/`}},
+		{"quoted keyword", `content:eq:"AND" OR content:eq:"("`, "(comments.content = $1 OR comments.content = $2)",
+			[]any{"AND", "("}},
+		{"colon in the value", "content:eq:a:b", "comments.content = $1", []any{"a:b"}},
+		{"null", "thread_id:eq:null", "comments.thread_id IS NULL", nil},
+		{"not null", "thread_id:ne:null", "comments.thread_id IS NOT NULL", nil},
+		{"quoted null is text", `author:eq:"null"`, "comments.author = $1", []any{"null"}},
+		{"integer in", "id:in:1|2|3", "comments.id = ANY($1)", []any{pq.Array([]int64{1, 2, 3})}},
+		{"text in", `author:in:alice|"b|c"|"d\"e"`, "comments.author = ANY($1)",
+			[]any{pq.Array([]string{"alice", "b|c", `d"e`})}},
+		{"contains", "content:contains:point", "comments.content ILIKE '%' || $1 || '%'", []any{"point"}},
+		{"contains matches wildcards literally", `content:contains:"50%_off\\"`,
+			"comments.content ILIKE '%' || $1 || '%'", []any{`50\%\_off\\`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := parseFilter(tt.expression, CommentFilterFields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var args []any
+			sql := node.compile(&args)
+			if sql != tt.sql {
+				t.Errorf("sql = %s, want %s", sql, tt.sql)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %#v, want %#v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestParseFilterBoolean(t *testing.T) {
+	node, err := parseFilter("enabled:eq:false", RuleFilterFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var args []any
+	if sql := node.compile(&args); sql != "enabled = $1" || !reflect.DeepEqual(args, []any{false}) {
+		t.Errorf("compile = %s %v, want enabled = $1 [false]", sql, args)
+	}
+}
+
+// conditions joins n conditions with AND
+func conditions(n int) string {
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = "id:eq:1"
+	}
+	return strings.Join(parts, " AND ")
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		position   int
+		token      string
+		message    string
+	}{
+		{"empty", "", 1, "", "must not be empty"},
+		{"blank", "   ", 1, "", "must not be empty"},
+		{"too long", "content:eq:" + strings.Repeat("a", 1000), 1, "", "must not be more than 1000 bytes long"},
+		{"no operator", "author", 1, "author", "must be field:operator:value"},
+		{"unknown field", "nope:eq:1", 1, "nope", "unknown field"},
+		{"unknown field after another", "id:eq:1 OR nope:eq:1", 12, "nope", "unknown field"},
+		{"operator", "author:gt:a", 8, "gt", "author does not support this operator"},
+		{"operator of a time", "created_at:eq:2026-01-01", 12, "eq", "created_at does not support this operator"},
+		{"integer", "version:eq:x", 12, "x", "must be an integer"},
+		{"time", "created_at:lt:yesterday", 15, "yesterday", "must be an RFC 3339 timestamp"},
+		{"empty value", "version:eq:1 AND author:eq:", 28, "", "must not be empty"},
+		{"never null", "version:eq:null", 12, "null", "version is never null"},
+		{"null needs eq or ne", "thread_id:gt:null", 14, "null", "must be an integer"},
+		{"unterminated quote", `author:eq:"abc`, 1, `author:eq:"abc`, "unterminated quoted value"},
+		{"second in value", "id:in:1|x|3", 9, "x", "must be an integer"},
+		{"last in value", "id:in:1|2|", 11, "", "must not be empty"},
+		{"in value after quotes", `author:in:"a|b"|""`, 17, `""`, "must not be empty"},
+		{"in value after accents", `author:in:café|""`, 16, `""`, "must not be empty"},
+		{"too many in values", "id:in:" + strings.Repeat("1|", 50) + "1", 7, strings.Repeat("1|", 50) + "1", "must not list more than 50 values"},
+		{"missing condition", "author:eq:a AND", 16, "", "expected a condition or ("},
+		{"two keywords", "author:eq:a AND OR author:eq:b", 17, "OR", "expected a condition or ("},
+		{"stray )", ")", 1, ")", "expected a condition or ("},
+		{"missing )", "(author:eq:a", 13, "", "expected )"},
+		{"extra )", "author:eq:a)", 12, ")", "expected AND or OR"},
+		{"missing keyword", "author:eq:a author:eq:b", 13, "author:eq:b", "expected AND or OR"},
+		{"empty parentheses", "()", 2, ")", "expected a condition or ("},
+		{"positions count characters", "content:eq:é AND nope:eq:1", 18, "nope", "unknown field"},
+		{"too deep", strings.Repeat("(", 6) + "id:eq:1" + strings.Repeat(")", 6), 6, "(", "must not nest more than 5 levels deep"},
+		{"too many conditions", conditions(21), 241, "id:eq:1", "must not have more than 20 conditions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseFilter(tt.expression, CommentFilterFields)
+			var filterErr *FilterError
+			if !errors.As(err, &filterErr) {
+				t.Fatalf("err = %v, want a *FilterError", err)
+			}
+			if filterErr.Position != tt.position || filterErr.Token != tt.token || !strings.HasPrefix(filterErr.Message, tt.message) {
+				t.Errorf("err = %d %q %q, want %d %q %q", filterErr.Position, filterErr.Token, filterErr.Message, tt.position, tt.token, tt.message)
+			}
+		})
+	}
+}
+
+func TestParseFilterLimits(t *testing.T) {
+	for _, expression := range []string{
+		strings.Repeat("(", 5) + "id:eq:1" + strings.Repeat(")", 5),
+		conditions(20),
+		"id:in:" + strings.Repeat("1|", 49) + "1",
+	} {
+		_, err := parseFilter(expression, CommentFilterFields)
+		if err != nil {
+			t.Errorf("parseFilter(%.40q...) = %v", expression, err)
+		}
+	}
+}
+
+func TestFilterCondition(t *testing.T) {
+	filters := Filters{
+		Filter:         []string{"author:eq:a OR version:gt:1", "id:in:1|2", "thread_id:eq:null"},
+		FilterSafeList: CommentFilterFields,
+	}
+	condition, args := filters.filterCondition(3)
+
+	want := "((comments.author = $3 OR comments.version > $4) AND comments.id = ANY($5) AND comments.thread_id IS NULL)"
+	if condition != want {
+		t.Errorf("condition = %s, want %s", condition, want)
+	}
+	wantArgs := []any{"a", int64(1), pq.Array([]int64{1, 2})}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %#v, want %#v", args, wantArgs)
+	}
+
+	condition, args = Filters{}.filterCondition(3)
+	if condition != "TRUE" || args != nil {
+		t.Errorf("without filters: %s %v, want TRUE []", condition, args)
+	}
+}
@@ -0,0 +1,206 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// A resourceField is a field that clients can ask for with fields=. target
+// returns where the column is scanned to, the same pointer is what ends up
+// in the JSON so that no reflection is needed
+type resourceField[T any] struct {
+	name   string
+	column string // empty when the query computes the field itself
+	target func(item *T) any
+}
+
+// A Fieldset is the fields of a resource that a query selects and a response
+// shows. The full fieldsets are CommentFields and UserFields, Select narrows them
+type Fieldset[T any] struct {
+	fields  []resourceField[T]
+	partial bool               // fields= was given, only the selected fields are shown
+	all     []resourceField[T] // what was selected from, for Require
+	hidden  []string           // read for the server's own use, not shown
+}
+
+// Select keeps the named fields. No names means every field
+func (s Fieldset[T]) Select(names []string) (Fieldset[T], error) {
+	if len(names) == 0 {
+		return s, nil
+	}
+
+	selected := Fieldset[T]{partial: true, all: s.fields}
+	for _, field := range s.fields {
+		if slices.Contains(names, field.name) {
+			selected.fields = append(selected.fields, field)
+		}
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(s.fields, func(field resourceField[T]) bool { return field.name == name }) {
+			return s, fmt.Errorf("unknown field %q, must be one of %s", name, strings.Join(s.Names(), ", "))
+		}
+	}
+	return selected, nil
+}
+
+// Require makes sure that the named fields are read from the database,
+// the ones that the client did not ask for are still not shown
+func (s Fieldset[T]) Require(names ...string) Fieldset[T] {
+	if !s.partial {
+		return s
+	}
+
+	required := Fieldset[T]{partial: true, all: s.all, hidden: slices.Clone(s.hidden)}
+	for _, field := range s.all {
+		selected := slices.ContainsFunc(s.fields, func(f resourceField[T]) bool { return f.name == field.name })
+		if !selected && slices.Contains(names, field.name) {
+			required.hidden = append(required.hidden, field.name)
+			selected = true
+		}
+		if selected {
+			required.fields = append(required.fields, field)
+		}
+	}
+	return required
+}
+
+// Names lists the fields in the order they are shown
+func (s Fieldset[T]) Names() []string {
+	names := make([]string, len(s.fields))
+	for i, field := range s.fields {
+		names[i] = field.name
+	}
+	return names
+}
+
+// Partial tells if fields= narrowed the fieldset
+func (s Fieldset[T]) Partial() bool {
+	return s.partial
+}
+
+// Shown lists the fields that the response shows, those added by Require are left out
+func (s Fieldset[T]) Shown() []string {
+	names := []string{}
+	for _, field := range s.fields {
+		if !slices.Contains(s.hidden, field.name) {
+			names = append(names, field.name)
+		}
+	}
+	return names
+}
+
+// columns is the select list of the fieldset. It is never empty so that
+// a query can always add its own columns after it
+func (s Fieldset[T]) columns() string {
+	columns := []string{}
+	for _, field := range s.fields {
+		if field.column != "" {
+			columns = append(columns, field.column)
+		}
+	}
+	if len(columns) == 0 {
+		return "NULL"
+	}
+	return strings.Join(columns, ", ")
+}
+
+// scanFields gives the destinations of columns() in the same order
+func (s Fieldset[T]) scanFields(item *T) []any {
+	targets := []any{}
+	for _, field := range s.fields {
+		if field.column != "" {
+			targets = append(targets, field.target(item))
+		}
+	}
+	if len(targets) == 0 {
+		// the NULL of columns()
+		targets = append(targets, new(any))
+	}
+	return targets
+}
+
+// Project is what the response shows of the item, the item itself
+// unless the client asked for some fields
+func (s Fieldset[T]) Project(item *T) any {
+	if !s.partial {
+		return item
+	}
+
+	projection := projection{}
+	for _, field := range s.fields {
+		if slices.Contains(s.hidden, field.name) {
+			continue
+		}
+		projection.names = append(projection.names, field.name)
+		projection.values = append(projection.values, field.target(item))
+	}
+	return projection
+}
+
+// ProjectAll projects every item of a list
+func (s Fieldset[T]) ProjectAll(items []*T) []any {
+	projected := make([]any, len(items))
+	for i, item := range items {
+		projected[i] = s.Project(item)
+	}
+	return projected
+}
+
+// a projection is encoded as an object with the fields in the order of the fieldset
+type projection struct {
+	names  []string
+	values []any
+}
+
+func (p projection) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, name := range p.names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(p.values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// the fields of a comment. The snippet is computed by the search
+var CommentFields = Fieldset[Comment]{fields: []resourceField[Comment]{
+	{"id", "comments.id", func(c *Comment) any { return &c.ID }},
+	{"content", "comments.content", func(c *Comment) any { return &c.Content }},
+	{"author", "comments.author", func(c *Comment) any { return &c.Author }},
+	{"thread_id", "comments.thread_id", func(c *Comment) any { return &c.ThreadID }},
+	{"parent_id", "comments.parent_id", func(c *Comment) any { return &c.ParentID }},
+	{"created_at", "comments.created_at", func(c *Comment) any { return &c.CreatedAt }},
+	{"updated_at", "comments.updated_at", func(c *Comment) any { return &c.UpdatedAt }},
+	{"version", "comments.version", func(c *Comment) any { return &c.Version }},
+	{"status", "comments.status", func(c *Comment) any { return &c.Status }},
+	{"matched_rule_id", "comments.matched_rule_id", func(c *Comment) any { return &c.RuleID }},
+	{"reactions", reactionCountsColumn, func(c *Comment) any { return &c.Reactions }},
+	{"mentions", mentionsColumn, func(c *Comment) any { return &c.Mentions }},
+	{"snippet", "", func(c *Comment) any { return &c.Snippet }},
+}}
+
+// the fields of a user
+var UserFields = Fieldset[User]{fields: []resourceField[User]{
+	{"id", "id", func(u *User) any { return &u.ID }},
+	{"email", "email", func(u *User) any { return &u.Email }},
+	{"fullname", "fullname", func(u *User) any { return &u.Fullname }},
+	{"username", "username", func(u *User) any { return &u.Username }},
+	{"created_at", "created_at", func(u *User) any { return &u.CreatedAt }},
+	{"updated_at", "updated_at", func(u *User) any { return &u.UpdatedAt }},
+}}
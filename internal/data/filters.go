@@ -1,7 +1,9 @@
 package data
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/ReynerioSamos/craboo/internal/validator"
 )
@@ -11,10 +13,19 @@ import (
 // The Filters type will contain the fields related to pagination
 // and eventually the fields related to sorting
 type Filters struct {
-	Page         int // which page number does the client want
-	PageSize     int // how records per page
+	Page         int `json:"page" validate:"min=1,max=500"`      // which page number does the client want
+	PageSize     int `json:"page_size" validate:"min=1,max=100"` // how records per page
 	Sort         string
 	SortSafeList []string //allowed sort fiels
+
+	// optional time range, nil means no limit
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedSince  *time.Time
+
+	// filter expressions, see expressions.go. Several are combined with AND
+	Filter         []string
+	FilterSafeList map[string]FilterField // the fields that may be filtered on
 }
 
 type Metadata struct {
@@ -26,14 +37,58 @@ type Metadata struct {
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
-	v.Check(f.Page > 0, "page", "must be greater than zero")
-	v.Check(f.Page <= 500, "page", "must be a maximum of 500")
-	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
-	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
+	// the page limits are in the validate tags
+	v.Struct(f)
 
 	//Check if sort fields provided are valid
 	// We will implement PermittedValue() later
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+
+	// an empty range is most likely a mistake
+	if f.CreatedAfter != nil && f.CreatedBefore != nil {
+		v.Check(f.CreatedAfter.Before(*f.CreatedBefore), "created_before", "must be later than created_after")
+	}
+	if f.UpdatedSince != nil {
+		v.Check(!f.UpdatedSince.After(time.Now()), "updated_since", "must not be in the future")
+	}
+
+	v.Check(len(f.Filter) <= 5, "filter", "must not be given more than 5 times")
+	for _, expression := range f.Filter {
+		_, err := parseFilter(expression, f.FilterSafeList)
+		if err != nil {
+			v.AddError("filter", err.Error())
+		}
+	}
+}
+
+// timeRange returns the SQL condition for the time range of the table and its arguments.
+// The placeholders are numbered from first on
+func (f Filters) timeRange(table string, first int) (string, []any) {
+	condition := fmt.Sprintf(`(%[1]s.created_at > $%[2]d OR $%[2]d IS NULL)
+		AND (%[1]s.created_at < $%[3]d OR $%[3]d IS NULL)
+		AND (%[1]s.updated_at >= $%[4]d OR $%[4]d IS NULL)`, table, first, first+1, first+2)
+	return condition, []any{f.CreatedAfter, f.CreatedBefore, f.UpdatedSince}
+}
+
+// filterCondition compiles the filter expressions into one SQL condition,
+// TRUE when there are none. The placeholders are numbered from first on
+func (f Filters) filterCondition(first int) (string, []any) {
+	if len(f.Filter) == 0 {
+		return "TRUE", nil
+	}
+
+	// the arguments before ours, so that the numbering lines up
+	args := make([]any, first-1)
+	conditions := []string{}
+	for _, expression := range f.Filter {
+		node, err := parseFilter(expression, f.FilterSafeList)
+		if err != nil {
+			// ValidateFilters lets no such expression through
+			panic("unsafe filter parameter: " + expression)
+		}
+		conditions = append(conditions, node.compile(&args))
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")", args[first-1:]
 }
 
 // Implement the sorting feature
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// A StoredResponse is the first response to a request with an Idempotency-Key
+type StoredResponse struct {
+	StatusCode int
+	Header     map[string][]string
+	Body       []byte
+}
+
+// An IdempotencyModel expects a connection pool
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// a request that has not finished after this long is taken to have died with
+// its instance, the key can be used again
+const idempotencyStaleAfter = time.Minute
+
+// Begin claims the key for a request. It returns nil when the request should
+// run, the stored response when it ran before, ErrIdempotencyKeyInUse while
+// it is still running and ErrIdempotencyKeyMismatch when the key came with
+// another request. An expired key is claimed like a new one
+func (m IdempotencyModel) Begin(scope string, key string, fingerprint string, ttl time.Duration) (*StoredResponse, error) {
+	query := `
+		INSERT INTO idempotency_keys (scope, key, fingerprint, expires_at)
+		VALUES ($1, $2, $3, NOW() + make_interval(secs => $4))
+		ON CONFLICT (scope, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, created_at = NOW(), expires_at = EXCLUDED.expires_at,
+			status_code = NULL, headers = NULL, body = NULL
+		WHERE idempotency_keys.expires_at < NOW()
+			OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < NOW() - make_interval(secs => $5))
+		RETURNING true
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var claimed bool
+	err := m.DB.QueryRowContext(ctx, query, scope, key, fingerprint,
+		ttl.Seconds(), idempotencyStaleAfter.Seconds()).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// the key is taken, by the same request or another one
+	query = `
+		SELECT fingerprint, status_code, headers, body
+		FROM idempotency_keys
+		WHERE scope = $1 AND key = $2
+		`
+	var storedFingerprint string
+	var statusCode sql.NullInt32
+	var header []byte
+	var stored StoredResponse
+	err = m.DB.QueryRowContext(ctx, query, scope, key).Scan(&storedFingerprint, &statusCode, &header, &stored.Body)
+	if err != nil {
+		// released in the meantime, the client may try again
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrIdempotencyKeyInUse
+		}
+		return nil, err
+	}
+
+	switch {
+	case storedFingerprint != fingerprint:
+		return nil, ErrIdempotencyKeyMismatch
+	case !statusCode.Valid:
+		return nil, ErrIdempotencyKeyInUse
+	}
+
+	stored.StatusCode = int(statusCode.Int32)
+	err = json.Unmarshal(header, &stored.Header)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// Complete stores the response of the request that claimed the key
+func (m IdempotencyModel) Complete(scope string, key string, response *StoredResponse) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status_code = $3, headers = $4, body = $5
+		WHERE scope = $1 AND key = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, scope, key, response.StatusCode, header, response.Body)
+	return err
+}
+
+// Release gives the key up when the request failed on our side, so that
+// the retry runs again instead of getting the error back
+func (m IdempotencyModel) Release(scope string, key string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE scope = $1 AND key = $2
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, key)
+	return err
+}
+
+// DeleteExpired removes the keys that can no longer be replayed
+func (m IdempotencyModel) DeleteExpired() (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at < NOW()
+		`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,240 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// copier streams rows into a single table using the postgres COPY protocol.
+// Everything happens inside one transaction so that an import either lands
+// completely or not at all
+type copier struct {
+	tx     *sql.Tx
+	stmt   *sql.Stmt
+	ctx    context.Context
+	count  int
+	copied bool // the COPY is over, the transaction takes other statements again
+}
+
+func beginCopy(ctx context.Context, db *sql.DB, table string, columns ...string) (*copier, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return copyInto(ctx, tx, table, columns...)
+}
+
+// copyInto starts the COPY in a transaction that is open already
+func copyInto(ctx context.Context, tx *sql.Tx, table string, columns ...string) (*copier, error) {
+	// COPY is only allowed inside a transaction, lib/pq builds the statement for us
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &copier{tx: tx, stmt: stmt, ctx: ctx}, nil
+}
+
+// queue a single row, lib/pq buffers the rows and sends them in batches
+func (c *copier) add(args ...any) error {
+	_, err := c.stmt.ExecContext(c.ctx, args...)
+	if err != nil {
+		return err
+	}
+	c.count++
+	return nil
+}
+
+// Count returns the number of rows queued so far
+func (c *copier) Count() int {
+	return c.count
+}
+
+// end flushes the remaining rows and ends the COPY
+func (c *copier) end() error {
+	if c.copied {
+		return nil
+	}
+	c.copied = true
+
+	// an Exec with no arguments tells lib/pq to flush the buffered rows
+	_, err := c.stmt.ExecContext(c.ctx)
+	if err != nil {
+		c.stmt.Close()
+		c.tx.Rollback()
+		return err
+	}
+
+	err = c.stmt.Close()
+	if err != nil {
+		c.tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Commit flushes the remaining rows and commits the transaction
+func (c *copier) Commit() error {
+	err := c.end()
+	if err != nil {
+		return err
+	}
+	return c.tx.Commit()
+}
+
+// Rollback throws away everything that was queued
+func (c *copier) Rollback() error {
+	if !c.copied {
+		c.stmt.Close()
+	}
+	return c.tx.Rollback()
+}
+
+// createdAtOrNow keeps the original timestamp of imported records
+// and falls back to the current time when none was provided
+func createdAtOrNow(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now()
+	}
+	return t
+}
+
+// A CommentImporter bulk loads comments
+type CommentImporter struct {
+	*copier
+}
+
+// BeginImport opens a COPY stream into the comments table.
+// The caller must call Commit() or Rollback() when done
+func (c CommentModel) BeginImport(ctx context.Context) (*CommentImporter, error) {
+	cp, err := beginCopy(ctx, c.DB, "comments", "content", "author", "created_at", "updated_at")
+	if err != nil {
+		return nil, err
+	}
+	return &CommentImporter{cp}, nil
+}
+
+// Add queues a comment that has already been validated
+func (ci *CommentImporter) Add(comment *Comment) error {
+	// an imported comment has not been updated here yet
+	createdAt := createdAtOrNow(comment.CreatedAt)
+	return ci.add(comment.Content, comment.Author, createdAt, createdAt)
+}
+
+// A UserImporter bulk loads users. The users are copied into a temporary
+// table first: a taken email or username would abort a COPY into users
+// as a whole, Conflicts finds those rows so that Commit can leave them out
+type UserImporter struct {
+	*copier
+	imported int
+}
+
+// An ImportConflict is a row whose email or username belongs to a user already
+type ImportConflict struct {
+	Line  int
+	Field string // email or username
+}
+
+// BeginImport opens a COPY stream into the temporary table.
+// The caller must call Commit() or Rollback() when done
+func (u UserModel) BeginImport(ctx context.Context) (*UserImporter, error) {
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		CREATE TEMPORARY TABLE user_imports (
+			line integer NOT NULL,
+			email text NOT NULL,
+			fullname text NOT NULL,
+			username text NOT NULL,
+			created_at timestamp(0) with time zone NOT NULL
+		) ON COMMIT DROP
+		`)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	cp, err := copyInto(ctx, tx, "user_imports", "line", "email", "fullname", "username", "created_at")
+	if err != nil {
+		return nil, err
+	}
+	return &UserImporter{copier: cp}, nil
+}
+
+// Add queues a user that has already been validated, line is where it is in the input
+func (ui *UserImporter) Add(line int, user *User) error {
+	return ui.add(line, user.Email, user.Fullname, user.Username, createdAtOrNow(user.CreatedAt))
+}
+
+// Conflicts ends the COPY and returns the rows whose email or username is
+// taken, ignoring case. Commit does not import them
+func (ui *UserImporter) Conflicts() ([]ImportConflict, error) {
+	err := ui.end()
+	if err != nil {
+		return nil, err
+	}
+
+	// IN lets postgres hash the existing emails and usernames once
+	query := `
+		DELETE FROM user_imports
+		WHERE lower(email) IN (SELECT lower(email) FROM users)
+		OR lower(username) IN (SELECT lower(username) FROM users)
+		RETURNING line,
+			CASE WHEN lower(email) IN (SELECT lower(email) FROM users) THEN 'email' ELSE 'username' END
+		`
+	rows, err := ui.tx.QueryContext(ui.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conflicts := []ImportConflict{}
+	for rows.Next() {
+		var conflict ImportConflict
+		err := rows.Scan(&conflict.Line, &conflict.Field)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
+
+// Commit moves the users without conflicts into the users table
+func (ui *UserImporter) Commit() error {
+	err := ui.end()
+	if err != nil {
+		return err
+	}
+
+	result, err := ui.tx.ExecContext(ui.ctx, `
+		INSERT INTO users (email, fullname, username, created_at, updated_at)
+		SELECT email, fullname, username, created_at, created_at
+		FROM user_imports
+		ORDER BY line
+		`)
+	if err != nil {
+		ui.tx.Rollback()
+		return err
+	}
+	imported, err := result.RowsAffected()
+	if err != nil {
+		ui.tx.Rollback()
+		return err
+	}
+	ui.imported = int(imported)
+
+	return ui.tx.Commit()
+}
+
+// Count returns the number of users that were imported
+func (ui *UserImporter) Count() int {
+	return ui.imported
+}
@@ -0,0 +1,193 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// an @ followed by a username. The @ must not be glued to a word
+// so that email addresses such as bob@example.com are not mentions
+var mentionRX = regexp.MustCompile(`(?:^|[^\w@])@(\w{3,25})\b`)
+
+// A Mention is an @username in the content of a comment.
+// Start and End are character (not byte) offsets of the whole "@username"
+type Mention struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+}
+
+// Mentions lets us read the json array built by postgres straight into the slice
+type Mentions []Mention
+
+func (m *Mentions) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	case nil:
+		*m = Mentions{}
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Mentions", src)
+	}
+
+	mentions := Mentions{}
+	err := json.Unmarshal(raw, &mentions)
+	if err != nil {
+		return err
+	}
+	*m = mentions
+	return nil
+}
+
+// SQL that builds the mentions of the current comments row
+const mentionsColumn = `(SELECT COALESCE(jsonb_agg(jsonb_build_object(
+				'user_id', comment_mentions.user_id, 'username', users.username,
+				'start', comment_mentions.start_offset, 'end', comment_mentions.end_offset)
+				ORDER BY comment_mentions.start_offset), '[]')
+			FROM comment_mentions JOIN users ON users.id = comment_mentions.user_id
+			WHERE comment_mentions.comment_id = comments.id)`
+
+// ParseMentions finds every @username in the content. The users are not
+// resolved yet so UserID is zero
+func ParseMentions(content string) Mentions {
+	mentions := Mentions{}
+	for _, loc := range mentionRX.FindAllStringSubmatchIndex(content, -1) {
+		// loc[2]:loc[3] is the username, the @ sits right before it
+		start := loc[2] - 1
+		mentions = append(mentions, Mention{
+			Username: content[loc[2]:loc[3]],
+			Start:    utf8.RuneCountInString(content[:start]),
+			End:      utf8.RuneCountInString(content[:loc[3]]),
+		})
+	}
+	return mentions
+}
+
+// A MentionModel expects a connection pool
+type MentionModel struct {
+	DB *sql.DB
+}
+
+// replaceMentions resolves the parsed mentions against the users table and stores
+// the ones that belong to a user, dropping whatever the comment mentioned before.
+// It runs in the transaction that saves the comment and returns the resolved mentions
+func replaceMentions(ctx context.Context, tx *sql.Tx, commentID int64, parsed Mentions) (Mentions, error) {
+	_, err := tx.ExecContext(ctx, `DELETE FROM comment_mentions WHERE comment_id = $1`, commentID)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := Mentions{}
+	if len(parsed) > 0 {
+		usernames := make([]string, len(parsed))
+		for i, mention := range parsed {
+			usernames[i] = strings.ToLower(mention.Username)
+		}
+
+		rows, err := tx.QueryContext(ctx, `
+			SELECT id, username
+			FROM users
+			WHERE lower(username) = ANY($1)
+			`, pq.Array(usernames))
+		if err != nil {
+			return nil, err
+		}
+		users := map[string]Mention{}
+		for rows.Next() {
+			var user Mention
+			err := rows.Scan(&user.UserID, &user.Username)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			users[strings.ToLower(user.Username)] = user
+		}
+		rows.Close()
+		err = rows.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, mention := range parsed {
+			user, ok := users[strings.ToLower(mention.Username)]
+			// @something that is not a user is just text
+			if !ok {
+				continue
+			}
+			mention.UserID = user.UserID
+			mention.Username = user.Username
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO comment_mentions (comment_id, user_id, start_offset, end_offset)
+				VALUES ($1, $2, $3, $4)
+				`, commentID, mention.UserID, mention.Start, mention.End)
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, mention)
+		}
+	}
+
+	return resolved, nil
+}
+
+// GetForUser lists the approved comments that mention the user,
+// with the fields of the fieldset
+func (m MentionModel) GetForUser(userID int64, filters Filters, fields Fieldset[Comment]) ([]*Comment, Metadata, error) {
+	timeRange, timeArgs := filters.timeRange("comments", 4)
+	filter, filterArgs := filters.filterCondition(7)
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), %s
+		FROM comments
+		%s
+		WHERE status = 'approved'
+		AND EXISTS (SELECT 1 FROM comment_mentions
+			WHERE comment_mentions.comment_id = comments.id AND comment_mentions.user_id = $1)
+		AND %s
+		AND %s
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3
+		`, fields.columns(), reactionTotalsJoin, timeRange, filter, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := append([]any{userID, filters.limit(), filters.offset()}, timeArgs...)
+	args = append(args, filterArgs...)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	comments := []*Comment{}
+	for rows.Next() {
+		var comment Comment
+		err := rows.Scan(append([]any{&totalRecords}, fields.scanFields(&comment)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		comments = append(comments, &comment)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return comments, metadata, nil
+}
@@ -0,0 +1,274 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/validator"
+	"github.com/lib/pq"
+)
+
+// the states a comment moves through. Only approved comments are public
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+	StatusHidden   = "hidden"
+)
+
+// what a moderator can do to a comment and the status it ends up with
+var moderationActions = map[string]string{
+	"approve": StatusApproved,
+	"reject":  StatusRejected,
+	"hide":    StatusHidden,
+}
+
+// the most comments a single moderation request may touch
+const maxModerationBatch = 100
+
+// A Report is a user flagging a comment
+type Report struct {
+	ID        int64     `json:"id"`                // unique value for each report
+	CommentID int64     `json:"comment_id"`        // the comment being reported
+	UserID    *int64    `json:"user_id,omitempty"` // who reported it, optional
+	Reason    string    `json:"reason"`            // why it was reported
+	CreatedAt time.Time `json:"-"`                 // database timestamp
+}
+
+func ValidateReport(v *validator.Validator, report *Report) {
+	// check if reason field is empty
+	v.Check(report.Reason != "", "reason", "must be provided")
+	// check if the reason field is too long
+	v.Check(len(report.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+	// check if the user is valid when one was given
+	v.Check(report.UserID == nil || *report.UserID > 0, "user_id", "must be greater than zero")
+}
+
+// A ModerationAction is a moderator approving/rejecting/hiding a batch of comments
+type ModerationAction struct {
+	CommentIDs []int64 `json:"comment_ids"` // the comments being moderated
+	Action     string  `json:"action"`      // approve, reject or hide
+	Reason     string  `json:"reason"`      // recorded with every comment
+	Moderator  string  `json:"moderator"`   // who made the decision
+}
+
+func ValidateModerationAction(v *validator.Validator, action *ModerationAction) {
+	v.Check(len(action.CommentIDs) > 0, "comment_ids", "must contain at least one id")
+	v.Check(len(action.CommentIDs) <= maxModerationBatch, "comment_ids",
+		fmt.Sprintf("must not contain more than %d ids", maxModerationBatch))
+	for _, id := range action.CommentIDs {
+		v.Check(id > 0, "comment_ids", "must only contain ids greater than zero")
+	}
+
+	_, ok := moderationActions[action.Action]
+	v.Check(ok, "action", "must be one of approve, reject or hide")
+
+	v.Check(action.Reason != "", "reason", "must be provided")
+	v.Check(len(action.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+	v.Check(action.Moderator != "", "moderator", "must be provided")
+	v.Check(len(action.Moderator) <= 25, "moderator", "must not be more than 25 bytes long")
+}
+
+// A QueuedComment is a comment waiting for a moderator
+type QueuedComment struct {
+	*Comment
+	Reports int `json:"reports"` // unresolved reports against the comment
+}
+
+// A ModerationModel expects a connection pool
+type ModerationModel struct {
+	DB *sql.DB
+}
+
+// InsertReport flags a comment
+func (m ModerationModel) InsertReport(report *Report) error {
+	query := `
+		INSERT INTO comment_reports (comment_id, user_id, reason)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+		`
+	args := []any{report.CommentID, report.UserID, report.Reason}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&report.ID, &report.CreatedAt)
+	if err != nil {
+		// foreign_key_violation: the comment or the user does not exist
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// Queue lists pending comments and comments with unresolved reports,
+// the most reported first
+func (m ModerationModel) Queue(filters Filters) ([]*QueuedComment, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), %s, COALESCE(open_reports.total, 0) AS reports
+		FROM comments
+		LEFT JOIN (
+			SELECT comment_id, COUNT(*) AS total
+			FROM comment_reports
+			WHERE resolved_at IS NULL
+			GROUP BY comment_id
+		) AS open_reports ON open_reports.comment_id = comments.id
+		WHERE status = 'pending' OR open_reports.total > 0
+		ORDER BY reports DESC, created_at ASC, id ASC
+		LIMIT $1 OFFSET $2
+		`, commentColumns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	queue := []*QueuedComment{}
+	for rows.Next() {
+		queued := QueuedComment{Comment: &Comment{}}
+		dest := append([]any{&totalRecords}, queued.scanFields()...)
+		err := rows.Scan(append(dest, &queued.Reports)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		queue = append(queue, &queued)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return queue, metadata, nil
+}
+
+// Apply moderates every comment in the batch, records the decision and resolves
+// the open reports. A change of status goes to the outbox like an edit does.
+// It is all or nothing: if a single id does not exist ErrRecordNotFound is
+// returned and no comment is changed
+func (m ModerationModel) Apply(action *ModerationAction) error {
+	status := moderationActions[action.Action]
+	unique := uniqueIDs(action.CommentIDs)
+	ids := pq.Array(unique)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// this is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	// lock the comments so that their old status still holds when we write the events
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, status
+		FROM comments
+		WHERE id = ANY($1)
+		ORDER BY id
+		FOR UPDATE
+		`, ids)
+	if err != nil {
+		return err
+	}
+	previous := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var from string
+		err := rows.Scan(&id, &from)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		previous[id] = from
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	if len(previous) != len(unique) {
+		return ErrRecordNotFound
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		UPDATE comments
+		SET status = $1, version = version + 1, updated_at = NOW()
+		WHERE id = ANY($2)
+		RETURNING `+commentColumns, status, ids)
+	if err != nil {
+		return err
+	}
+	moderated := []*Comment{}
+	for rows.Next() {
+		var comment Comment
+		err := rows.Scan(comment.scanFields()...)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		moderated = append(moderated, &comment)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	// e.g. approving a held comment is comment.created, the notifications
+	// only go out then
+	for _, comment := range moderated {
+		if previous[comment.ID] == comment.Status {
+			continue
+		}
+		err = insertCommentEvent(ctx, tx, previous[comment.ID], comment)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO moderation_actions (comment_id, action, reason, moderator)
+		SELECT id, $2, $3, $4 FROM unnest($1::bigint[]) AS id
+		`, ids, action.Action, action.Reason, action.Moderator)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE comment_reports
+		SET resolved_at = NOW()
+		WHERE comment_id = ANY($1) AND resolved_at IS NULL
+		`, ids)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// uniqueIDs drops repeated ids so they can be compared against affected rows
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]bool, len(ids))
+	unique := []int64{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// the kinds of email a user can turn off, "all" turns off every one of them.
+// The welcome email is only sent once so it cannot be turned off
+const (
+	NotifyMentions = "mentions"
+	NotifyReplies  = "replies"
+	NotifyDigest   = "digest"
+	NotifyAll      = "all"
+)
+
+// Preferences say which emails a user wants to get
+type Preferences struct {
+	UserID   int64 `json:"user_id"`
+	Mentions bool  `json:"mentions"` // someone mentioned the user with @username
+	Replies  bool  `json:"replies"`  // someone replied to a comment of the user
+	Digest   bool  `json:"digest"`   // a daily summary of both
+	Version  int32 `json:"version"`  // incremented on each update, 0 until the user changes anything
+}
+
+// Unsubscribe turns off the kind of email
+func (p *Preferences) Unsubscribe(kind string) {
+	switch kind {
+	case NotifyMentions:
+		p.Mentions = false
+	case NotifyReplies:
+		p.Replies = false
+	case NotifyDigest:
+		p.Digest = false
+	case NotifyAll:
+		p.Mentions, p.Replies, p.Digest = false, false, false
+	}
+}
+
+// A PreferenceModel expects a connection pool
+type PreferenceModel struct {
+	DB *sql.DB
+}
+
+// Get returns the preferences of the user. Users who never changed them
+// get the same defaults as the table
+func (m PreferenceModel) Get(userID int64) (*Preferences, error) {
+	if userID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT users.id, COALESCE(p.mentions, true), COALESCE(p.replies, true),
+			COALESCE(p.digest, false), COALESCE(p.version, 0)
+		FROM users
+		LEFT JOIN notification_preferences p ON p.user_id = users.id
+		WHERE users.id = $1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var prefs Preferences
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&prefs.UserID,
+		&prefs.Mentions,
+		&prefs.Replies,
+		&prefs.Digest,
+		&prefs.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &prefs, nil
+}
+
+// Upsert stores the preferences, creating the row the first time
+func (m PreferenceModel) Upsert(prefs *Preferences) error {
+	query := `
+		INSERT INTO notification_preferences (user_id, mentions, replies, digest)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET mentions = EXCLUDED.mentions, replies = EXCLUDED.replies, digest = EXCLUDED.digest,
+			version = notification_preferences.version + 1
+		RETURNING version
+		`
+	args := []any{prefs.UserID, prefs.Mentions, prefs.Replies, prefs.Digest}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&prefs.Version)
+}
@@ -0,0 +1,235 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// the states of an outbox event
+const (
+	OutboxPending   = "pending"
+	OutboxPublished = "published"
+	OutboxDead      = "dead" // gave up after too many attempts, waits for an admin
+)
+
+// An OutboxEvent is a domain event stored in the same transaction as the change
+// it describes, the relay hands it to the consumers afterwards
+type OutboxEvent struct {
+	ID            int64           `json:"id"`
+	Sequence      int64           `json:"sequence"` // the place in line, see Pending
+	CreatedAt     time.Time       `json:"created_at"`
+	Event         string          `json:"event"`        // e.g. comment.created
+	AggregateID   int64           `json:"aggregate_id"` // the comment or user the event is about
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`               // pending, published or dead
+	Attempts      int             `json:"attempts"`             // failed attempts so far
+	LastError     string          `json:"last_error,omitempty"` // why the last attempt failed
+	NextAttemptAt time.Time       `json:"next_attempt_at"`      // when a pending event is tried again
+	PublishedAt   *time.Time      `json:"published_at,omitempty"`
+}
+
+// insertOutbox records the event in the transaction of the change,
+// so either both are stored or neither is
+func insertOutbox(ctx context.Context, tx *sql.Tx, event string, aggregateID int64, payload any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO outbox (event, aggregate_id, payload)
+		VALUES ($1, $2, $3)
+		`
+	_, err = tx.ExecContext(ctx, query, event, aggregateID, raw)
+	return err
+}
+
+// the advisory lock that makes sure only one relay publishes at a time,
+// otherwise two instances could hand the events over out of order
+const outboxLockKey = 5_410_001
+
+// An OutboxModel expects a connection pool
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// WithLock runs fn while this instance holds the relay lock. It returns false
+// without running fn when another instance has it. The lock belongs to a
+// transaction so it goes away with the connection if we crash
+func (m OutboxModel) WithLock(ctx context.Context, fn func() error) (bool, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, outboxLockKey).Scan(&locked)
+	if err != nil || !locked {
+		return false, err
+	}
+
+	return true, fn()
+}
+
+// Pending returns the events that still have to be published, first in line
+// first. An event only joins the line once its transaction is older than every
+// running one, so an event that commits late can't be skipped: every event
+// after it in the line is from a younger transaction
+func (m OutboxModel) Pending(limit int) ([]*OutboxEvent, error) {
+	query := `
+		SELECT ` + outboxColumns + `
+		FROM outbox
+		WHERE status = 'pending'
+		AND txid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY txid ASC, sequence ASC
+		LIMIT $1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*OutboxEvent{}
+	for rows.Next() {
+		var event OutboxEvent
+		err := rows.Scan(event.scanFields()...)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// MarkPublished records that every consumer has handled the event
+func (m OutboxModel) MarkPublished(event *OutboxEvent) error {
+	query := `
+		UPDATE outbox
+		SET status = 'published', last_error = '', published_at = NOW()
+		WHERE id = $1
+		RETURNING status, published_at
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, event.ID).Scan(&event.Status, &event.PublishedAt)
+}
+
+// RecordFailure stores a failed attempt. The event is tried again at retryAt,
+// when retryAt is nil it is moved to the dead letters
+func (m OutboxModel) RecordFailure(event *OutboxEvent, cause error, retryAt *time.Time) error {
+	status := OutboxPending
+	if retryAt == nil {
+		status = OutboxDead
+	}
+
+	query := `
+		UPDATE outbox
+		SET status = $1, attempts = attempts + 1, last_error = $2,
+			next_attempt_at = COALESCE($3, next_attempt_at)
+		WHERE id = $4
+		RETURNING status, attempts, last_error, next_attempt_at
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, status, cause.Error(), retryAt, event.ID).Scan(
+		&event.Status, &event.Attempts, &event.LastError, &event.NextAttemptAt)
+}
+
+// Retry puts a dead event back at the end of the line, it gets the transaction
+// of the retry and a new sequence. It is published after the events that are
+// pending already, not in its original place
+func (m OutboxModel) Retry(id int64) (*OutboxEvent, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		UPDATE outbox
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW(),
+			txid = pg_current_xact_id(), sequence = nextval('outbox_sequence_seq')
+		WHERE id = $1 AND status = 'dead'
+		RETURNING ` + outboxColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var event OutboxEvent
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(event.scanFields()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &event, nil
+}
+
+// GetAll lists the events, newest first. status may be empty for every event
+func (m OutboxModel) GetAll(status string, filters Filters) ([]*OutboxEvent, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), ` + outboxColumns + `
+		FROM outbox
+		WHERE (status = $1 OR $1 = '')
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*OutboxEvent{}
+	for rows.Next() {
+		var event OutboxEvent
+		err := rows.Scan(append([]any{&totalRecords}, event.scanFields()...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, &event)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
+
+// outboxColumns and scanFields() list the columns of an event in the same order
+const outboxColumns = `id, sequence, created_at, event, aggregate_id, payload, status, attempts,
+			last_error, next_attempt_at, published_at`
+
+func (event *OutboxEvent) scanFields() []any {
+	return []any{
+		&event.ID,
+		&event.Sequence,
+		&event.CreatedAt,
+		&event.Event,
+		&event.AggregateID,
+		&event.Payload,
+		&event.Status,
+		&event.Attempts,
+		&event.LastError,
+		&event.NextAttemptAt,
+		&event.PublishedAt,
+	}
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/validator"
+	"github.com/lib/pq"
+)
+
+// the kinds of reaction that are always available, more (emoji) can be configured
+var DefaultReactionKinds = []string{"like", "dislike"}
+
+// ReactionCounts holds the number of reactions per kind for a comment e.g. {"like": 3}
+type ReactionCounts map[string]int
+
+// Scan lets us read the json object built by postgres straight into the map
+func (rc *ReactionCounts) Scan(src any) error {
+	var raw []byte
+	switch v := src.(type) {
+	case []byte:
+		raw = v
+	case string:
+		raw = []byte(v)
+	case nil:
+		*rc = ReactionCounts{}
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into ReactionCounts", src)
+	}
+
+	counts := ReactionCounts{}
+	err := json.Unmarshal(raw, &counts)
+	if err != nil {
+		return err
+	}
+	*rc = counts
+	return nil
+}
+
+// SQL that computes the reactions of the current comments row. It is shared
+// by Get() and GetAll() so that both return the same thing.
+// reactionTotalsJoin exposes the likes and reactions columns used for sorting
+const (
+	reactionCountsColumn = `(SELECT COALESCE(jsonb_object_agg(kind, total), '{}')
+			FROM (SELECT kind, COUNT(*) AS total FROM reactions
+				WHERE reactions.comment_id = comments.id GROUP BY kind) AS counts)`
+	reactionTotalsJoin = `CROSS JOIN LATERAL (
+			SELECT COUNT(*) FILTER (WHERE kind = 'like') AS likes, COUNT(*) AS reactions
+			FROM reactions WHERE reactions.comment_id = comments.id) AS reaction_totals`
+)
+
+type Reaction struct {
+	CommentID int64     `json:"comment_id"` // the comment being reacted to
+	UserID    int64     `json:"user_id"`    // the user who reacted
+	Kind      string    `json:"kind"`       // like, dislike or an emoji
+	CreatedAt time.Time `json:"-"`          // database timestamp
+}
+
+func ValidateReaction(v *validator.Validator, reaction *Reaction, permittedKinds []string) {
+	// check that the user was provided
+	v.Check(reaction.UserID > 0, "user_id", "must be provided")
+	// check that the kind is one we allow
+	v.Check(validator.PermittedValue(reaction.Kind, permittedKinds...), "kind", "is not a permitted reaction")
+}
+
+// A ReactionModel expects a connection pool
+type ReactionModel struct {
+	DB *sql.DB
+}
+
+// Insert records the reaction. Reacting twice with the same kind is not an error,
+// the primary key makes sure there is only one reaction per user per kind
+func (r ReactionModel) Insert(reaction *Reaction) error {
+	query := `
+		INSERT INTO reactions (comment_id, user_id, kind)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (comment_id, user_id, kind) DO UPDATE SET kind = EXCLUDED.kind
+		RETURNING created_at
+		`
+	args := []any{reaction.CommentID, reaction.UserID, reaction.Kind}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := r.DB.QueryRowContext(ctx, query, args...).Scan(&reaction.CreatedAt)
+	if err != nil {
+		// foreign_key_violation: the comment or the user does not exist
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (r ReactionModel) Delete(reaction *Reaction) error {
+	query := `
+		DELETE FROM reactions
+		WHERE comment_id = $1 AND user_id = $2 AND kind = $3
+		`
+	args := []any{reaction.CommentID, reaction.UserID, reaction.Kind}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := r.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// the user never reacted this way
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Counts returns the aggregated reactions of a single comment
+func (r ReactionModel) Counts(commentID int64) (ReactionCounts, error) {
+	query := `
+		SELECT kind, COUNT(*)
+		FROM reactions
+		WHERE comment_id = $1
+		GROUP BY kind
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := r.DB.QueryContext(ctx, query, commentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := ReactionCounts{}
+	for rows.Next() {
+		var kind string
+		var total int
+		err := rows.Scan(&kind, &total)
+		if err != nil {
+			return nil, err
+		}
+		counts[kind] = total
+	}
+
+	return counts, rows.Err()
+}
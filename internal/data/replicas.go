@@ -0,0 +1,160 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replicas spreads reads over the streaming replicas of the primary, one after
+// the other. A replica that is down, does not stream from the primary or lags
+// more than MaxLag is skipped until Check finds it fine again, without a usable
+// replica the reads go to the primary.
+// A nil *Replicas sends every read to the primary
+type Replicas struct {
+	Primary *sql.DB
+	MaxLag  time.Duration
+
+	replicas []*replica
+	next     atomic.Uint64
+}
+
+type replica struct {
+	db   *sql.DB
+	name string
+
+	mu      sync.Mutex
+	status  ReplicaStatus
+	checked bool
+}
+
+// A ReplicaStatus is what the last Check found out about a replica
+type ReplicaStatus struct {
+	Name       string  `json:"name"`
+	Healthy    bool    `json:"healthy"`
+	LagSeconds float64 `json:"lag_seconds"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// NewReplicas takes the pools of the replicas and their DSNs, the DSNs only
+// name them in the status. Every replica counts as down until the first Check
+func NewReplicas(primary *sql.DB, dbs []*sql.DB, dsns []string, maxLag time.Duration) *Replicas {
+	if len(dbs) == 0 {
+		return nil
+	}
+	rs := &Replicas{Primary: primary, MaxLag: maxLag}
+	for i, db := range dbs {
+		name := fmt.Sprintf("replica %d", i+1)
+		// a URL names the host, the password stays out of the logs
+		u, err := url.Parse(dsns[i])
+		if err == nil && u.Host != "" {
+			name = u.Host
+		}
+		rs.replicas = append(rs.replicas, &replica{db: db, name: name, status: ReplicaStatus{Name: name}})
+	}
+	return rs
+}
+
+// Reader is the pool for the next read
+func (rs *Replicas) Reader() *sql.DB {
+	n := uint64(len(rs.replicas))
+	start := rs.next.Add(1)
+	for i := range n {
+		r := rs.replicas[(start+i)%n]
+		r.mu.Lock()
+		healthy := r.status.Healthy
+		r.mu.Unlock()
+		if healthy {
+			return r.db
+		}
+	}
+	return rs.Primary
+}
+
+// Check pings every replica and asks how far behind it is. It returns the
+// replicas whose health changed, every replica on the first check
+func (rs *Replicas) Check() []ReplicaStatus {
+	changed := []ReplicaStatus{}
+	for _, r := range rs.replicas {
+		status := ReplicaStatus{Name: r.name, Healthy: true}
+		lag, err := r.lag()
+		switch {
+		case err != nil:
+			status.Healthy = false
+			status.Error = err.Error()
+		case lag > rs.MaxLag:
+			status.Healthy = false
+			status.Error = fmt.Sprintf("replication lag of %s is more than %s", lag.Round(time.Millisecond), rs.MaxLag)
+		}
+		status.LagSeconds = lag.Seconds()
+
+		r.mu.Lock()
+		if !r.checked || r.status.Healthy != status.Healthy {
+			changed = append(changed, status)
+		}
+		r.status = status
+		r.checked = true
+		r.mu.Unlock()
+	}
+	return changed
+}
+
+// lag is how old the last replayed transaction is. A replica that replayed
+// everything it received is not behind, however long ago that was, as long
+// as it is still receiving: without a WAL receiver that streams from the
+// primary it falls behind without knowing, so that is an error. Without
+// pg_read_all_stats the role only sees that a receiver runs, not its status
+func (r *replica) lag() (time.Duration, error) {
+	query := `
+		SELECT pg_is_in_recovery(),
+			EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE COALESCE(status, 'streaming') = 'streaming'),
+			COALESCE(pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn(), false),
+			COALESCE(EXTRACT(EPOCH FROM NOW() - pg_last_xact_replay_timestamp()), 0)
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var recovering, streaming, caughtUp bool
+	var seconds float64
+	err := r.db.QueryRowContext(ctx, query).Scan(&recovering, &streaming, &caughtUp, &seconds)
+	switch {
+	case err != nil:
+		return 0, err
+	case !recovering:
+		return 0, errors.New("not a replica, it does not follow the primary")
+	case !streaming:
+		return 0, errors.New("no WAL receiver is streaming from the primary")
+	case caughtUp:
+		return 0, nil
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Status is what the last Check found out about every replica
+func (rs *Replicas) Status() []ReplicaStatus {
+	if rs == nil {
+		return []ReplicaStatus{}
+	}
+	statuses := []ReplicaStatus{}
+	for _, r := range rs.replicas {
+		r.mu.Lock()
+		statuses = append(statuses, r.status)
+		r.mu.Unlock()
+	}
+	return statuses
+}
+
+// Close closes the pools of the replicas, not the primary
+func (rs *Replicas) Close() {
+	if rs == nil {
+		return
+	}
+	for _, r := range rs.replicas {
+		r.db.Close()
+	}
+}
@@ -0,0 +1,460 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ReynerioSamos/craboo/internal/validator"
+	"github.com/lib/pq"
+)
+
+// the kinds of rule an admin can define
+const (
+	RuleKeywords      = "keywords"       // any of a list of words
+	RuleRegex         = "regex"          // a regular expression
+	RuleLinks         = "links"          // more than threshold links
+	RuleRepeatedChars = "repeated_chars" // the same character more than threshold times in a row
+)
+
+// what happens to a comment that matches a rule
+const (
+	RuleActionReject = "reject" // the comment is refused with a 422
+	RuleActionHold   = "hold"   // the comment is stored as pending
+	RuleActionFlag   = "flag"   // the comment is published and reported to the moderators
+)
+
+// the higher the number the stronger the action, used to pick one when several rules match
+var ruleActionSeverity = map[string]int{
+	RuleActionFlag:   1,
+	RuleActionHold:   2,
+	RuleActionReject: 3,
+}
+
+// finds http(s) links and bare www. links
+var linkRX = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.`)
+
+type Rule struct {
+	ID        int64      `json:"id"`                                                                       // unique value for each rule
+	CreatedAt time.Time  `json:"-"`                                                                        // database timestamp
+	Name      string     `json:"name" validate:"required,line,maxchars=50,max=400" normalize:"squash,nfc"` // shown to the client when a comment is rejected
+	Kind      string     `json:"kind"`                                                                     // keywords, regex, links or repeated_chars
+	Keywords  []string   `json:"keywords,omitempty"`                                                       // used by keyword rules
+	Pattern   string     `json:"pattern,omitempty"`                                                        // used by regex rules
+	Threshold int        `json:"threshold,omitempty"`                                                      // used by links and repeated_chars rules
+	Action    string     `json:"action" validate:"oneof=reject hold flag"`                                 // reject, hold or flag
+	Enabled   bool       `json:"enabled"`                                                                  // disabled rules are never evaluated
+	Hits      int64      `json:"hits"`                                                                     // how many comments matched
+	LastHitAt *time.Time `json:"last_hit_at,omitempty"`                                                    // when the rule last matched
+	Version   int32      `json:"version"`                                                                  // incremented on each update
+
+	// the compiled form of Keywords/Pattern
+	rx *regexp.Regexp
+}
+
+func ValidateRule(v *validator.Validator, rule *Rule) {
+	validator.Normalize(rule)
+	v.Struct(rule)
+
+	switch rule.Kind {
+	case RuleKeywords:
+		v.Check(len(rule.Keywords) > 0, "keywords", "must contain at least one keyword")
+		v.Check(len(rule.Keywords) <= 500, "keywords", "must not contain more than 500 keywords")
+		for i, keyword := range rule.Keywords {
+			v.CheckRequired(strings.TrimSpace(keyword), validator.Path("keywords", i))
+		}
+	case RuleRegex:
+		v.Check(rule.Pattern != "", "pattern", "must be provided")
+		v.Check(len(rule.Pattern) <= 500, "pattern", "must not be more than 500 bytes long")
+	case RuleLinks, RuleRepeatedChars:
+		v.Check(rule.Threshold > 0, "threshold", "must be greater than zero")
+	default:
+		v.AddError("kind", "must be one of keywords, regex, links or repeated_chars")
+	}
+
+	// only report a compile error when everything else is fine
+	if v.IsEmpty() {
+		err := rule.compile()
+		if err != nil {
+			v.AddError("pattern", "must be a valid regular expression")
+		}
+	}
+}
+
+// compile turns the keyword list or the pattern into a regular expression
+func (rule *Rule) compile() error {
+	switch rule.Kind {
+	case RuleKeywords:
+		alternatives := make([]string, len(rule.Keywords))
+		for i, keyword := range rule.Keywords {
+			alternatives[i] = keywordPattern(strings.TrimSpace(keyword))
+		}
+		// whole words only, regardless of case
+		rx, err := regexp.Compile(`(?i)` + strings.Join(alternatives, "|"))
+		if err != nil {
+			return err
+		}
+		rule.rx = rx
+	case RuleRegex:
+		rx, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return err
+		}
+		rule.rx = rx
+	}
+	return nil
+}
+
+// the boundaries of a word. \b of regexp only knows ASCII letters and needs a
+// letter on one side, so it never matches around "$$$" and wrongly inside "café"
+const (
+	wordStart = `(?:^|[^\pL\pN_])`
+	wordEnd   = `(?:$|[^\pL\pN_])`
+)
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+// keywordPattern matches the keyword as a whole word, the keyword itself is
+// the group. A side that is no letter, such as the end of "c++", needs no boundary
+func keywordPattern(keyword string) string {
+	pattern := `(` + regexp.QuoteMeta(keyword) + `)`
+	first, _ := utf8.DecodeRuneInString(keyword)
+	if isWordRune(first) {
+		pattern = wordStart + pattern
+	}
+	last, _ := utf8.DecodeLastRuneInString(keyword)
+	if isWordRune(last) {
+		pattern += wordEnd
+	}
+	return pattern
+}
+
+// match reports whether the content breaks the rule and the offending text
+func (rule *Rule) match(content string) (bool, string) {
+	switch rule.Kind {
+	case RuleKeywords:
+		if rule.rx == nil {
+			return false, ""
+		}
+		// the boundaries are part of the match, the keyword is the group that matched
+		loc := rule.rx.FindStringSubmatchIndex(content)
+		for i := 2; i < len(loc); i += 2 {
+			if loc[i] >= 0 {
+				return true, content[loc[i]:loc[i+1]]
+			}
+		}
+		return false, ""
+	case RuleRegex:
+		if rule.rx == nil {
+			return false, ""
+		}
+		loc := rule.rx.FindStringIndex(content)
+		if loc == nil {
+			return false, ""
+		}
+		return true, content[loc[0]:loc[1]]
+	case RuleLinks:
+		links := linkRX.FindAllString(content, -1)
+		return len(links) > rule.Threshold, fmt.Sprintf("%d links", len(links))
+	case RuleRepeatedChars:
+		// Go's regexp has no back references so we count the runs ourselves
+		var previous rune = utf8.RuneError
+		run := 0
+		for _, char := range content {
+			if char == previous {
+				run++
+			} else {
+				previous = char
+				run = 1
+			}
+			if run > rule.Threshold {
+				return true, strings.Repeat(string(char), run)
+			}
+		}
+	}
+	return false, ""
+}
+
+// A RuleMatch is a rule that the content broke
+type RuleMatch struct {
+	RuleID  int64  `json:"rule_id"`
+	Name    string `json:"name"`
+	Action  string `json:"action"`
+	Matched string `json:"matched"` // the text that triggered the rule
+}
+
+// A RuleDecision is the outcome of running the whole ruleset
+type RuleDecision struct {
+	Action  string      `json:"action,omitempty"` // the strongest action of all matches, empty when nothing matched
+	Rule    *RuleMatch  `json:"rule,omitempty"`   // the match that decided the action
+	Matches []RuleMatch `json:"matches"`
+}
+
+// RuleIDs returns the ids of every matched rule
+func (d *RuleDecision) RuleIDs() []int64 {
+	ids := make([]int64, len(d.Matches))
+	for i, match := range d.Matches {
+		ids[i] = match.RuleID
+	}
+	return ids
+}
+
+// Evaluate runs the content against every rule
+func Evaluate(rules []*Rule, content string) *RuleDecision {
+	decision := &RuleDecision{Matches: []RuleMatch{}}
+	deciding := -1
+	for _, rule := range rules {
+		ok, matched := rule.match(content)
+		if !ok {
+			continue
+		}
+
+		decision.Matches = append(decision.Matches, RuleMatch{
+			RuleID:  rule.ID,
+			Name:    rule.Name,
+			Action:  rule.Action,
+			Matched: matched,
+		})
+		// the first rule with the strongest action wins
+		if ruleActionSeverity[rule.Action] > ruleActionSeverity[decision.Action] {
+			decision.Action = rule.Action
+			deciding = len(decision.Matches) - 1
+		}
+	}
+
+	if deciding >= 0 {
+		decision.Rule = &decision.Matches[deciding]
+	}
+	return decision
+}
+
+// A RuleModel expects a connection pool
+type RuleModel struct {
+	DB *sql.DB
+}
+
+func (m RuleModel) Insert(rule *Rule) error {
+	// a NULL array would break the NOT NULL constraint
+	if rule.Keywords == nil {
+		rule.Keywords = []string{}
+	}
+
+	query := `
+		INSERT INTO moderation_rules (name, kind, keywords, pattern, threshold, action, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, version
+		`
+	args := []any{rule.Name, rule.Kind, pq.Array(rule.Keywords), rule.Pattern,
+		rule.Threshold, rule.Action, rule.Enabled}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&rule.ID, &rule.CreatedAt, &rule.Version)
+}
+
+func (m RuleModel) Get(id int64) (*Rule, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT ` + ruleColumns + `
+		FROM moderation_rules
+		WHERE id = $1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rule, err := scanRule(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+func (m RuleModel) Update(rule *Rule) error {
+	// a NULL array would break the NOT NULL constraint
+	if rule.Keywords == nil {
+		rule.Keywords = []string{}
+	}
+
+	query := `
+		UPDATE moderation_rules
+		SET name = $1, kind = $2, keywords = $3, pattern = $4, threshold = $5,
+			action = $6, enabled = $7, version = version + 1
+		WHERE id = $8
+		RETURNING version
+		`
+	args := []any{rule.Name, rule.Kind, pq.Array(rule.Keywords), rule.Pattern,
+		rule.Threshold, rule.Action, rule.Enabled, rule.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&rule.Version)
+}
+
+func (m RuleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM moderation_rules
+		WHERE id = $1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetAll lists the rules, with the hit statistics, for the admins
+func (m RuleModel) GetAll(filters Filters) ([]*Rule, Metadata, error) {
+	filter, filterArgs := filters.filterCondition(3)
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), `+ruleColumns+`
+		FROM moderation_rules
+		WHERE %s
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2
+		`, filter, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := append([]any{filters.limit(), filters.offset()}, filterArgs...)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	rules := []*Rule{}
+	for rows.Next() {
+		var rule Rule
+		err := rows.Scan(append([]any{&totalRecords}, rule.scanFields()...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		rules = append(rules, &rule)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return rules, metadata, nil
+}
+
+// GetEnabled returns the compiled ruleset that comments are checked against
+func (m RuleModel) GetEnabled() ([]*Rule, error) {
+	query := `
+		SELECT ` + ruleColumns + `
+		FROM moderation_rules
+		WHERE enabled
+		ORDER BY id ASC
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*Rule{}
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		// rules are validated on the way in, a broken one is simply skipped
+		if rule.compile() != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// RecordHits updates the statistics of the rules that matched a comment
+func (m RuleModel) RecordHits(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query := `
+		UPDATE moderation_rules
+		SET hits = hits + 1, last_hit_at = NOW()
+		WHERE id = ANY($1)
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(ids))
+	return err
+}
+
+// ruleColumns and scanFields() list the columns of a rule in the same order
+const ruleColumns = `id, created_at, name, kind, keywords, pattern, threshold, action,
+			enabled, hits, last_hit_at, version`
+
+func (rule *Rule) scanFields() []any {
+	return []any{
+		&rule.ID,
+		&rule.CreatedAt,
+		&rule.Name,
+		&rule.Kind,
+		pq.Array(&rule.Keywords),
+		&rule.Pattern,
+		&rule.Threshold,
+		&rule.Action,
+		&rule.Enabled,
+		&rule.Hits,
+		&rule.LastHitAt,
+		&rule.Version,
+	}
+}
+
+// scanRule reads a single rule from either *sql.Row or *sql.Rows
+func scanRule(row interface{ Scan(...any) error }) (*Rule, error) {
+	var rule Rule
+	err := row.Scan(rule.scanFields()...)
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
@@ -0,0 +1,49 @@
+package data
+
+import "testing"
+
+func TestKeywordRuleMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		keywords []string
+		content  string
+		matched  string // empty when the rule must not match
+	}{
+		{"whole word", []string{"spam"}, "this is spam.", "spam"},
+		{"ignores case", []string{"spam"}, "SPAM everywhere", "SPAM"},
+		{"not inside a word", []string{"spam"}, "spammer", ""},
+		{"not at the end of a word", []string{"spam"}, "antispam", ""},
+		{"start of content", []string{"spam"}, "spam", "spam"},
+		{"symbols only", []string{"$$$"}, "earn $$$ now", "$$$"},
+		{"symbols at the start", []string{"$$$"}, "$$$ fast", "$$$"},
+		{"symbols next to letters", []string{"!!!"}, "wow!!!", "!!!"},
+		{"emoji", []string{"💰"}, "get 💰 today", "💰"},
+		{"emoji next to text", []string{"💰"}, "money💰", "💰"},
+		{"trailing symbols", []string{"c++"}, "I write c++ daily", "c++"},
+		{"trailing symbols at the end", []string{"c++"}, "I write c++", "c++"},
+		{"trailing symbols inside a word", []string{"c++"}, "abc++", ""},
+		{"leading symbols", []string{"#ad"}, "post #ad here", "#ad"},
+		{"leading symbols before a letter", []string{"#ad"}, "post #adverts", ""},
+		{"accented letters are letters", []string{"café"}, "cafés", ""},
+		{"accented word", []string{"café"}, "un café noir", "café"},
+		{"accent before the keyword", []string{"fe"}, "café", ""},
+		{"phrase", []string{"buy now"}, "please buy now!", "buy now"},
+		{"quoted metacharacters", []string{"a.b"}, "axb", ""},
+		{"second keyword", []string{"foo", "$$$"}, "pay $$$", "$$$"},
+		{"neighbours are not part of the match", []string{"spam"}, "(spam)", "spam"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &Rule{Kind: RuleKeywords, Keywords: tt.keywords}
+			err := rule.compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, matched := rule.match(tt.content)
+			if ok != (tt.matched != "") || matched != tt.matched {
+				t.Errorf("match(%q) = %v, %q; want %q", tt.content, ok, matched, tt.matched)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// A StreamEvent is a change to a public comment, written by the
+// comments_stream_notify trigger
+type StreamEvent struct {
+	ID        int64           `json:"id"`   // also the SSE event id
+	TxID      int64           `json:"-"`    // the transaction that wrote it, see StreamCursor
+	CreatedAt time.Time       `json:"-"`    // database timestamp
+	Type      string          `json:"type"` // comment.created, comment.updated or comment.deleted
+	CommentID int64           `json:"-"`    // used for filtering
+	Author    string          `json:"-"`    // used for filtering
+	ThreadID  *int64          `json:"-"`    // used for filtering
+	Data      json.RawMessage `json:"data"` // the comment, or just its id when deleted
+}
+
+// A StreamEventModel expects a connection pool
+type StreamEventModel struct {
+	DB *sql.DB
+}
+
+// A StreamCursor is a position in the stream. The ids are handed out before
+// commit so they can become visible out of order, the stream is read in the
+// order of (TxID, ID) instead and only up to the oldest running transaction.
+// Whatever commits later sorts after everything read so far. The zero
+// StreamCursor is before every event
+type StreamCursor struct {
+	TxID int64
+	ID   int64
+}
+
+// Cursor is the position of the event
+func (event *StreamEvent) Cursor() StreamCursor {
+	return StreamCursor{TxID: event.TxID, ID: event.ID}
+}
+
+// Before reports whether c comes before other
+func (c StreamCursor) Before(other StreamCursor) bool {
+	return c.TxID < other.TxID || (c.TxID == other.TxID && c.ID < other.ID)
+}
+
+// After returns up to limit final events past the cursor, in stream order
+func (m StreamEventModel) After(cursor StreamCursor, limit int) ([]*StreamEvent, error) {
+	query := `
+		SELECT id, txid::text::bigint, created_at, type, comment_id, author, thread_id, data
+		FROM comment_stream_events
+		WHERE (txid, id) > ($1::text::xid8, $2)
+		AND txid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY txid ASC, id ASC
+		LIMIT $3
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, cursor.TxID, cursor.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*StreamEvent{}
+	for rows.Next() {
+		var event StreamEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.TxID,
+			&event.CreatedAt,
+			&event.Type,
+			&event.CommentID,
+			&event.Author,
+			&event.ThreadID,
+			&event.Data)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// Last is where a fresh listener starts from: the last final event
+func (m StreamEventModel) Last() (StreamCursor, error) {
+	query := `
+		SELECT txid::text::bigint, id
+		FROM comment_stream_events
+		WHERE txid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY txid DESC, id DESC
+		LIMIT 1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var cursor StreamCursor
+	err := m.DB.QueryRowContext(ctx, query).Scan(&cursor.TxID, &cursor.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StreamCursor{}, nil
+	}
+	return cursor, err
+}
+
+// CursorOf is the position of the event with the id, for clients resuming with
+// Last-Event-ID. When the event is gone the stream resumes before the oldest
+// event with a bigger id, and when there is none from the last final event
+func (m StreamEventModel) CursorOf(id int64) (StreamCursor, error) {
+	query := `
+		SELECT txid::text::bigint, id
+		FROM comment_stream_events
+		WHERE id >= $1
+		ORDER BY id ASC
+		LIMIT 1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var cursor StreamCursor
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&cursor.TxID, &cursor.ID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return m.Last()
+	case err != nil:
+		return StreamCursor{}, err
+	}
+	// the event of the client is gone, the one found is new to it
+	if cursor.ID != id {
+		cursor.ID--
+	}
+	return cursor, nil
+}
+
+// DeleteOlderThan trims the history, clients can't resume further back than this
+func (m StreamEventModel) DeleteOlderThan(age time.Duration) error {
+	query := `
+		DELETE FROM comment_stream_events
+		WHERE created_at < NOW() - make_interval(secs => $1)
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, age.Seconds())
+	return err
+}
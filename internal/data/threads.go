@@ -0,0 +1,167 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ReynerioSamos/craboo/internal/validator"
+	"github.com/lib/pq"
+)
+
+// A Thread is the discussion attached to a page of another system,
+// e.g. an article URL or an opaque product key
+type Thread struct {
+	ID            int64          `json:"id"`                                                                 // unique value for each thread
+	CreatedAt     time.Time      `json:"-"`                                                                  // database timestamp
+	Key           string         `json:"key"`                                                                // the external identifier
+	Title         string         `json:"title" validate:"line,maxchars=200,max=2000" normalize:"squash,nfc"` // shown above the comments
+	Metadata      map[string]any `json:"metadata"`                                                           // whatever the owner wants to store
+	PreModeration bool           `json:"pre_moderation"`                                                     // hold new comments until approved
+	Version       int32          `json:"version"`                                                            // incremented on each update
+}
+
+func ValidateThreadKey(v *validator.Validator, key string) {
+	// check if key field is empty
+	v.Check(key != "", "key", "must be provided")
+	// long enough for any URL we are likely to see
+	v.Check(len(key) <= 2048, "key", "must not be more than 2048 bytes long")
+	v.Check(utf8.ValidString(key), "key", "must be valid UTF-8")
+}
+
+func ValidateThread(v *validator.Validator, thread *Thread) {
+	ValidateThreadKey(v, thread.Key)
+	// the title is normalized before its limits are checked
+	validator.Normalize(thread)
+	v.Struct(thread)
+
+	// keep the metadata small, it is returned with every thread
+	raw, err := json.Marshal(thread.Metadata)
+	v.Check(err == nil && len(raw) <= 4096, "metadata", "must not be more than 4096 bytes long")
+}
+
+// A ThreadModel expects a connection pool
+type ThreadModel struct {
+	DB *sql.DB
+}
+
+// GetByKey finds a thread by its external identifier
+func (t ThreadModel) GetByKey(key string) (*Thread, error) {
+	query := `
+		SELECT id, created_at, key, title, metadata, pre_moderation, version
+		FROM threads
+		WHERE key = $1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	thread, err := scanThread(t.DB.QueryRowContext(ctx, query, key))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return thread, nil
+}
+
+// GetByIDs loads the threads with the ids in one query
+func (t ThreadModel) GetByIDs(ids []int64) ([]*Thread, error) {
+	query := `
+		SELECT id, created_at, key, title, metadata, pre_moderation, version
+		FROM threads
+		WHERE id = ANY($1)
+		ORDER BY id
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := t.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	threads := []*Thread{}
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	return threads, rows.Err()
+}
+
+// GetOrCreate returns the thread with the key, creating an empty one if needed.
+// This is how a thread comes to life when the first comment is posted
+func (t ThreadModel) GetOrCreate(key string) (*Thread, error) {
+	query := `
+		INSERT INTO threads (key)
+		VALUES ($1)
+		ON CONFLICT (key) DO NOTHING
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := t.DB.ExecContext(ctx, query, key)
+	if err != nil {
+		return nil, err
+	}
+	return t.GetByKey(key)
+}
+
+// Upsert creates the thread or replaces its title, metadata and settings
+func (t ThreadModel) Upsert(thread *Thread) error {
+	if thread.Metadata == nil {
+		thread.Metadata = map[string]any{}
+	}
+	metadata, err := json.Marshal(thread.Metadata)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO threads (key, title, metadata, pre_moderation)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (key) DO UPDATE
+		SET title = EXCLUDED.title, metadata = EXCLUDED.metadata,
+			pre_moderation = EXCLUDED.pre_moderation, version = threads.version + 1
+		RETURNING id, created_at, version
+		`
+	args := []any{thread.Key, thread.Title, metadata, thread.PreModeration}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return t.DB.QueryRowContext(ctx, query, args...).Scan(&thread.ID, &thread.CreatedAt, &thread.Version)
+}
+
+// scanThread reads a single thread and decodes its metadata
+func scanThread(row interface{ Scan(...any) error }) (*Thread, error) {
+	var thread Thread
+	var metadata []byte
+	err := row.Scan(
+		&thread.ID,
+		&thread.CreatedAt,
+		&thread.Key,
+		&thread.Title,
+		&metadata,
+		&thread.PreModeration,
+		&thread.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(metadata, &thread.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &thread, nil
+}
@@ -4,40 +4,63 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"reflect"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/ReynerioSamos/craboo/internal/validator"
+	"github.com/lib/pq"
 )
 
 type User struct {
-	ID        int64     `json:"id"`       // unique value for each user
-	Email     string    `json:"email"`    // the email of user
-	Fullname  string    `json:"fullname"` // the full name of user
-	CreatedAt time.Time `json:"-"`        // database timestamp
+	ID        int64     `json:"id"`                                                                           // unique value for each user
+	Email     string    `json:"email" validate:"required,max=254,email" normalize:"email"`                    // the email of user
+	Fullname  string    `json:"fullname" validate:"required,line,maxchars=50,max=400" normalize:"squash,nfc"` // the full name of user
+	Username  string    `json:"username" validate:"required,min=3,max=25,username" normalize:"trim"`          // unique handle used for @mentions
+	CreatedAt time.Time `json:"created_at"`                                                                   // database timestamp
+	UpdatedAt time.Time `json:"updated_at"`                                                                   // changed by every update
 }
 
+// the limits are in the validate tags of User. The text is normalized
+// first so that the limits count what is stored
 func ValidateUser(v *validator.Validator, user *User) {
-	// check if email field is empty
-	v.Check(user.Email != "", "email", "must be provided")
-
-	// check if fullname field is empty
-	v.Check(user.Fullname != "", "fullname", "must be provided")
+	validator.Normalize(user)
+	v.Struct(user)
+}
 
-	// check if the email field is too long
-	v.Check(len(user.Email) <= 254, "email", "must not be more than 254 bytes long")
+// usernames are mentioned as @username so only letters, digits and underscores
+func init() {
+	validator.RegisterRule("username", func(field reflect.Value, param string) *validator.FieldError {
+		if usernameRegex.MatchString(field.String()) {
+			return nil
+		}
+		return &validator.FieldError{Code: validator.CodeFormat, Message: "must only contain letters, digits and underscores"}
+	})
+}
 
-	// validation for email formatt using regex
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	v.Check(emailRegex.MatchString(user.Email), "email", "must be a valid email address")
+// the same characters that ParseMentions recognises
+var usernameRegex = regexp.MustCompile(`^\w+$`)
 
-	//check if fullname field is too long
-	v.Check(len(user.Fullname) <= 50, "fullname", "must not be more than 50 bytes long")
+// isDuplicateUsername checks for a unique_violation on the username index
+func isDuplicateUsername(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "users_username_unique_idx"
 }
 
 // A UserModel expects a connection pool
 type UserModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Cache    *ReadCache // nil when reads are not cached
+	Replicas *Replicas  // where Get reads, nil for the primary
+	primary  bool       // reads skip the cache
+}
+
+// Primary reads from the primary and past the cache, see CommentModel.Primary
+func (u UserModel) Primary() UserModel {
+	u.Replicas = nil
+	u.primary = true
+	return u
 }
 
 // Insert a new row in the users table
@@ -45,12 +68,12 @@ type UserModel struct {
 func (u UserModel) Insert(user *User) error {
 	// the SQL query to be executed against the database table
 	query := `
-		INSERT INTO users (email, fullname)
-		VALUES ($1, $2)
-		RETURNING id, created_at
+		INSERT INTO users (email, fullname, username)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at
 		`
-	// the actual values to replace $1, and $2
-	args := []any{user.Email, user.Fullname}
+	// the actual values to replace $1, $2 and $3
+	args := []any{user.Email, user.Fullname, user.Username}
 
 	// Create a context with a 3-second timeout. No database
 	// operation should take more than 3 seconds or we will quit it
@@ -61,11 +84,52 @@ func (u UserModel) Insert(user *User) error {
 	// id, created_at, and the version to be sent back to us which we will use
 	// to update the user struct later on
 
-	return u.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt)
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// this is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		if isDuplicateUsername(err) {
+			return ErrDuplicateUsername
+		}
+		return err
+	}
+
+	// the user.created event is stored with the user
+	err = insertOutbox(ctx, tx, EventUserCreated, user.ID, user)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // Get a specific user from the users table
 func (u UserModel) Get(id int64) (*User, error) {
+	return u.GetFields(id, UserFields)
+}
+
+// GetFields only reads the fields of the fieldset, the rest stay zero.
+// With a cache the whole user is read and kept
+func (u UserModel) GetFields(id int64, fields Fieldset[User]) (*User, error) {
+	if u.Cache == nil || u.primary {
+		return u.getFields(id, fields)
+	}
+	user, err := u.Cache.users.Get(id, func() (*User, error) {
+		return u.getFields(id, UserFields)
+	})
+	if err != nil {
+		return nil, err
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (u UserModel) getFields(id int64, fields Fieldset[User]) (*User, error) {
 	// check if the id is valid
 	if id < 1 {
 		return nil, ErrRecordNotFound
@@ -73,7 +137,7 @@ func (u UserModel) Get(id int64) (*User, error) {
 
 	// the SQL query to be executed against the database table
 	query := `
-		SELECT id, created_at, email, fullname
+		SELECT ` + fields.columns() + `
 		FROM users
 		WHERE id = $1
 		`
@@ -84,11 +148,77 @@ func (u UserModel) Get(id int64) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := u.DB.QueryRowContext(ctx, query, id).Scan(
+	reader := u.DB
+	if u.Replicas != nil {
+		reader = u.Replicas.Reader()
+	}
+	err := reader.QueryRowContext(ctx, query, id).Scan(fields.scanFields(&user)...)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// GetByUsernames loads the users with the usernames in one query, ignoring
+// case. Usernames that nobody has are left out
+func (u UserModel) GetByUsernames(usernames []string) ([]*User, error) {
+	lowered := make([]string, len(usernames))
+	for i, username := range usernames {
+		lowered[i] = strings.ToLower(username)
+	}
+
+	query := `
+		SELECT ` + UserFields.columns() + `
+		FROM users
+		WHERE lower(username) = ANY($1)
+		ORDER BY id
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := u.DB.QueryContext(ctx, query, pq.Array(lowered))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(UserFields.scanFields(&user)...)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+	return users, rows.Err()
+}
+
+// GetByUsername finds a user by username, ignoring case like the mentions do
+func (u UserModel) GetByUsername(username string) (*User, error) {
+	query := `
+		SELECT id, created_at, updated_at, email, fullname, username
+		FROM users
+		WHERE lower(username) = lower($1)
+		`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := u.DB.QueryRowContext(ctx, query, username).Scan(
 		&user.ID,
 		&user.CreatedAt,
+		&user.UpdatedAt,
 		&user.Email,
 		&user.Fullname,
+		&user.Username,
 	)
 
 	if err != nil {
@@ -106,16 +236,41 @@ func (u UserModel) Update(user *User) error {
 	// The SQL query to be executed against the database table
 	query := `
 		UPDATE users
-		SET email = $1, fullname = $2
-		WHERE id = $3
-		RETURNING email, fullname
+		SET email = $1, fullname = $2, username = $3, updated_at = NOW()
+		WHERE id = $4
+		RETURNING email, fullname, username, updated_at
 		`
 
-	args := []any{user.Email, user.Fullname, user.ID}
+	args := []any{user.Email, user.Fullname, user.Username, user.ID}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return u.DB.QueryRowContext(ctx, query, args...).Scan(&user.Email, &user.Fullname)
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.Email, &user.Fullname, &user.Username, &user.UpdatedAt)
+	if err != nil {
+		if isDuplicateUsername(err) {
+			return ErrDuplicateUsername
+		}
+		return err
+	}
+
+	err = insertOutbox(ctx, tx, EventUserUpdated, user.ID, user)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// the other instances hear of it from the trigger
+	u.Cache.InvalidateUser(user.ID)
+	return nil
 }
 
 func (u UserModel) Delete(id int64) error {
@@ -131,10 +286,16 @@ func (u UserModel) Delete(id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// ExecContext does not return any rows unlike QueryRowContext.
 	// It only returns information about the query execution
 	// such as how many rows were affected
-	result, err := u.DB.ExecContext(ctx, query, id)
+	result, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -150,5 +311,15 @@ func (u UserModel) Delete(id int64) error {
 		return ErrRecordNotFound
 	}
 
+	err = insertOutbox(ctx, tx, EventUserDeleted, id, map[string]int64{"id": id})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	u.Cache.InvalidateUser(id)
 	return nil
 }
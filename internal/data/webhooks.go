@@ -0,0 +1,443 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/validator"
+	"github.com/lib/pq"
+)
+
+// the events other services can subscribe to
+const (
+	EventCommentCreated = "comment.created"
+	EventCommentUpdated = "comment.updated"
+	EventCommentDeleted = "comment.deleted"
+	EventUserCreated    = "user.created"
+	EventUserUpdated    = "user.updated"
+	EventUserDeleted    = "user.deleted"
+	EventWebhookTest    = "webhook.test"
+)
+
+// EventTypes is every event a webhook may filter on
+var EventTypes = []string{
+	EventCommentCreated, EventCommentUpdated, EventCommentDeleted,
+	EventUserCreated, EventUserUpdated, EventUserDeleted,
+}
+
+// the states of a delivery
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+type Webhook struct {
+	ID                  int64     `json:"id"`                                              // unique value for each webhook
+	CreatedAt           time.Time `json:"-"`                                               // database timestamp
+	URL                 string    `json:"url" validate:"required,max=2048,url=http https"` // where the events are posted
+	Secret              string    `json:"secret,omitempty" validate:"min=16,max=256"`      // HMAC key, only shown when the webhook is created
+	Events              []string  `json:"events" validate:"unique"`                        // empty means every event
+	Enabled             bool      `json:"enabled"`                                         // disabled webhooks receive nothing
+	ConsecutiveFailures int       `json:"consecutive_failures"`                            // reset by a successful delivery
+	Version             int32     `json:"version"`                                         // incremented on each update
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Struct(webhook)
+
+	for i, event := range webhook.Events {
+		v.CheckCode(validator.PermittedValue(event, EventTypes...), validator.Path("events", i), validator.CodeNotInEnum,
+			fmt.Sprintf("%q is not a known event", event), map[string]any{"permitted": EventTypes})
+	}
+}
+
+// A Delivery is one event sent (or to be sent) to one webhook
+type Delivery struct {
+	ID            int64           `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	WebhookID     int64           `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`                    // pending, succeeded or failed
+	Attempts      int             `json:"attempts"`                  // how many times we tried
+	ResponseCode  *int            `json:"response_code"`             // of the last attempt, nil if there was no response
+	LastError     string          `json:"last_error,omitempty"`      // why the last attempt failed
+	NextAttemptAt *time.Time      `json:"next_attempt_at,omitempty"` // when a pending delivery is retried
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+
+	// where to send it, filled in when the delivery is claimed
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// A WebhookModel expects a connection pool
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, secret, events, enabled)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+		`
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	args := []any{webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Enabled}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, url, secret, events, enabled, consecutive_failures, version
+		FROM webhooks
+		WHERE id = $1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var webhook Webhook
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		&webhook.Secret,
+		pq.Array(&webhook.Events),
+		&webhook.Enabled,
+		&webhook.ConsecutiveFailures,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+func (m WebhookModel) GetAll(filters Filters) ([]*Webhook, Metadata, error) {
+	filter, filterArgs := filters.filterCondition(3)
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, url, events, enabled, consecutive_failures, version
+		FROM webhooks
+		WHERE %s
+		ORDER BY %s %s, id ASC
+		LIMIT $1 OFFSET $2
+		`, filter, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := append([]any{filters.limit(), filters.offset()}, filterArgs...)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&totalRecords,
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Enabled,
+			&webhook.ConsecutiveFailures,
+			&webhook.Version)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return webhooks, metadata, nil
+}
+
+// Update saves the settings. Re-enabling a webhook clears its failure count
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, secret = $2, events = $3, enabled = $4,
+			consecutive_failures = CASE WHEN $4 AND NOT enabled THEN 0 ELSE consecutive_failures END,
+			version = version + 1
+		WHERE id = $5
+		RETURNING consecutive_failures, version
+		`
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	args := []any{webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Enabled, webhook.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ConsecutiveFailures, &webhook.Version)
+}
+
+func (m WebhookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Enqueue creates a pending delivery of the outbox event for every enabled webhook
+// that subscribed to it. The worker picks them up from there. An event that is
+// handed over again does not create a second delivery
+func (m WebhookModel) Enqueue(event *OutboxEvent) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, outbox_id, event, payload)
+		SELECT id, $1, $2, $3
+		FROM webhooks
+		WHERE enabled AND (cardinality(events) = 0 OR $2 = ANY(events))
+		ON CONFLICT (webhook_id, outbox_id) DO NOTHING
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, event.ID, event.Event, []byte(event.Payload))
+	return err
+}
+
+// InsertDelivery creates a single delivery for one webhook, used by test events
+func (m WebhookModel) InsertDelivery(webhook *Webhook, event string, payload any) (*Delivery, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery := &Delivery{
+		WebhookID: webhook.ID,
+		Event:     event,
+		Payload:   raw,
+		Status:    DeliveryPending,
+		URL:       webhook.URL,
+		Secret:    webhook.Secret,
+	}
+
+	// whoever created it sends it once. ClaimDue never picks up a test, if the
+	// send is lost it stays pending instead of counting against the webhook
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, attempts, next_attempt_at)
+		VALUES ($1, $2, $3, 1, NOW() + interval '1 minute')
+		RETURNING id, created_at, attempts
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, webhook.ID, event, raw).Scan(&delivery.ID, &delivery.CreatedAt, &delivery.Attempts)
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// ClaimDue hands out up to limit deliveries that are due. Claiming pushes their
+// next attempt into the future by lease so that other instances leave them alone
+// while we send them; if we die they simply become due again
+func (m WebhookModel) ClaimDue(limit int, lease time.Duration) ([]*Delivery, error) {
+	query := `
+		UPDATE webhook_deliveries
+		SET attempts = attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2)
+		FROM webhooks
+		WHERE webhooks.id = webhook_deliveries.webhook_id
+		AND webhook_deliveries.id IN (
+			SELECT webhook_deliveries.id
+			FROM webhook_deliveries JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+			WHERE webhook_deliveries.status = 'pending'
+			AND webhook_deliveries.next_attempt_at <= NOW()
+			AND webhook_deliveries.event <> 'webhook.test'
+			AND webhooks.enabled
+			ORDER BY webhook_deliveries.next_attempt_at ASC
+			LIMIT $1
+			FOR UPDATE OF webhook_deliveries SKIP LOCKED
+		)
+		RETURNING webhook_deliveries.id, webhook_deliveries.created_at, webhook_deliveries.webhook_id,
+			webhook_deliveries.event, webhook_deliveries.payload, webhook_deliveries.attempts,
+			webhooks.url, webhooks.secret
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		delivery := Delivery{Status: DeliveryPending}
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Attempts,
+			&delivery.URL,
+			&delivery.Secret)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// RecordAttempt stores the outcome of sending a delivery. A failed attempt is
+// retried at retryAt unless retryAt is nil, then the delivery has failed for good.
+// The webhook is disabled once it has failed disableAfter times in a row. A
+// disableAfter of 0 leaves the failure count of the webhook alone, a test event
+// says nothing about the deliveries
+func (m WebhookModel) RecordAttempt(delivery *Delivery, retryAt *time.Time, disableAfter int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// this is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	succeeded := delivery.Status == DeliverySucceeded
+	if !succeeded {
+		delivery.Status = DeliveryPending
+		if retryAt == nil {
+			delivery.Status = DeliveryFailed
+		}
+	}
+	delivery.NextAttemptAt = retryAt
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $1, response_code = $2, last_error = $3,
+			next_attempt_at = COALESCE($4, next_attempt_at),
+			delivered_at = CASE WHEN $1 = 'succeeded' THEN NOW() ELSE NULL END
+		WHERE id = $5
+		`, delivery.Status, delivery.ResponseCode, delivery.LastError, retryAt, delivery.ID)
+	if err != nil {
+		return err
+	}
+	if disableAfter == 0 {
+		return tx.Commit()
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE webhooks
+		SET consecutive_failures = CASE WHEN $2 THEN 0 ELSE consecutive_failures + 1 END,
+			enabled = enabled AND ($2 OR consecutive_failures + 1 < $3)
+		WHERE id = $1
+		`, delivery.WebhookID, succeeded, disableAfter)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetDeliveries is the delivery log of a webhook, newest first
+func (m WebhookModel) GetDeliveries(webhookID int64, filters Filters) ([]*Delivery, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), id, created_at, webhook_id, event, payload, status, attempts,
+			response_code, last_error, next_attempt_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+		`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		var delivery Delivery
+		var nextAttemptAt time.Time
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.ResponseCode,
+			&delivery.LastError,
+			&nextAttemptAt,
+			&delivery.DeliveredAt)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		// only pending deliveries will be attempted again
+		if delivery.Status == DeliveryPending {
+			delivery.NextAttemptAt = &nextAttemptAt
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
@@ -0,0 +1,369 @@
+package importer
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/ReynerioSamos/craboo/internal/validator"
+)
+
+// the input formats we know how to read
+type Format string
+
+const (
+	NDJSON Format = "ndjson"
+	CSV    Format = "csv"
+)
+
+// we only keep this many rejections in the report, the count keeps going
+const maxRejections = 1000
+
+// a single NDJSON line may not be larger than this
+const maxLineBytes = 1 << 20
+
+// ErrBadInput is wrapped around problems with the uploaded data as a whole,
+// for example a missing CSV header. Problems with single rows are rejections
+var ErrBadInput = errors.New("invalid import input")
+
+// ParseFormat accepts either the short name or a content type
+func ParseFormat(value string) (Format, error) {
+	// drop parameters such as "; charset=utf-8"
+	value, _, _ = strings.Cut(value, ";")
+	switch strings.TrimSpace(strings.ToLower(value)) {
+	case "ndjson", "jsonl", "application/x-ndjson", "application/jsonl":
+		return NDJSON, nil
+	case "csv", "text/csv":
+		return CSV, nil
+	default:
+		return "", fmt.Errorf("unsupported import format %q", value)
+	}
+}
+
+// A Rejection tells the client which line was skipped and why
+type Rejection struct {
+	Line    int               `json:"line"`
+	Reasons map[string]string `json:"reasons"`
+}
+
+// A Report summarises an import run
+type Report struct {
+	DryRun     bool        `json:"dry_run"`
+	Processed  int         `json:"processed"`
+	Accepted   int         `json:"accepted"`
+	Imported   int         `json:"imported"`
+	Rejected   int         `json:"rejected"`
+	Rejections []Rejection `json:"rejections"`
+}
+
+func (r *Report) reject(line int, reasons map[string]string) {
+	r.Rejected++
+	if len(r.Rejections) < maxRejections {
+		r.Rejections = append(r.Rejections, Rejection{Line: line, Reasons: reasons})
+	}
+}
+
+// record is one decoded row keyed by column name
+type record map[string]string
+
+// readRecords calls fn for every row in the input together with its line number.
+// A non-nil err passed to fn is a problem with that row alone
+func readRecords(r io.Reader, format Format, columns []string, fn func(line int, rec record, err error) error) error {
+	switch format {
+	case NDJSON:
+		return readNDJSON(r, columns, fn)
+	case CSV:
+		return readCSV(r, columns, fn)
+	default:
+		return fmt.Errorf("unsupported import format %q", format)
+	}
+}
+
+func readNDJSON(r io.Reader, columns []string, fn func(line int, rec record, err error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		// skip blank lines
+		if text == "" {
+			continue
+		}
+
+		var values map[string]any
+		err := json.Unmarshal([]byte(text), &values)
+		if err != nil {
+			err = fn(line, nil, fmt.Errorf("badly-formed JSON: %v", err))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		rec := make(record, len(values))
+		var recErr error
+		for key, value := range values {
+			if !validator.PermittedValue(key, columns...) {
+				recErr = fmt.Errorf("unknown key %q", key)
+				break
+			}
+			s, ok := value.(string)
+			if !ok {
+				recErr = fmt.Errorf("incorrect JSON type for field %q", key)
+				break
+			}
+			rec[key] = s
+		}
+
+		err = fn(line, rec, recErr)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("line %d is longer than %d bytes", line+1, maxLineBytes)
+	}
+	return err
+}
+
+func readCSV(r io.Reader, columns []string, fn func(line int, rec record, err error) error) error {
+	reader := csv.NewReader(r)
+	// let us report the wrong number of columns ourselves
+	reader.FieldsPerRecord = -1
+
+	// the first row must name the columns
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("the CSV input must start with a header row")
+		}
+		return err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+		if !validator.PermittedValue(header[i], columns...) {
+			return fmt.Errorf("unknown CSV column %q", header[i])
+		}
+	}
+
+	for {
+		fields, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			err = fn(parseError.StartLine, nil, parseError.Err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(fields) != len(header) {
+			err = fn(line, nil, fmt.Errorf("expected %d fields but found %d", len(header), len(fields)))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		rec := make(record, len(fields))
+		for i, value := range fields {
+			rec[header[i]] = value
+		}
+		err = fn(line, rec, nil)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parse the optional created_at column so that the original timestamp is kept
+func parseCreatedAt(v *validator.Validator, rec record) time.Time {
+	value := rec["created_at"]
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		v.AddError("created_at", "must be an RFC 3339 timestamp")
+		return time.Time{}
+	}
+	return t
+}
+
+// importer is the part of data.CommentImporter/data.UserImporter we need
+type importer interface {
+	Count() int
+	Commit() error
+	Rollback() error
+}
+
+// a conflictChecker finds the rows that clash with what is stored already,
+// after the last row was added and before the commit
+type conflictChecker interface {
+	Conflicts() ([]data.ImportConflict, error)
+}
+
+// the rejection reasons of the conflicts
+var conflictReasons = map[string]string{
+	"email":    "a user with this email already exists",
+	"username": "a user with this username already exists",
+}
+
+// run drives an import: every record is built and validated, the good ones are
+// passed to add() and the bad ones end up in the report. Without an importer
+// (a dry run of comments) nothing goes to the database, a dry run with one
+// rolls back at the end
+func run(r io.Reader, format Format, dryRun bool, columns []string, imp importer,
+	build func(v *validator.Validator, rec record, line int) func() error) (*Report, error) {
+	report := &Report{DryRun: dryRun, Rejections: []Rejection{}}
+	// remember if the database failed us so we don't blame the input
+	var dbErr error
+
+	err := readRecords(r, format, columns, func(line int, rec record, err error) error {
+		report.Processed++
+		if err != nil {
+			report.reject(line, map[string]string{"record": err.Error()})
+			return nil
+		}
+
+		v := validator.New()
+		add := build(v, rec, line)
+		if !v.IsEmpty() {
+			report.reject(line, v.Messages())
+			return nil
+		}
+
+		report.Accepted++
+		if imp == nil {
+			return nil
+		}
+		err = add()
+		if err != nil {
+			dbErr = fmt.Errorf("line %d: %w", line, err)
+			return dbErr
+		}
+		return nil
+	})
+
+	if err != nil {
+		if imp != nil {
+			imp.Rollback()
+		}
+		if dbErr == nil {
+			err = fmt.Errorf("%w: %w", ErrBadInput, err)
+		}
+		return nil, err
+	}
+	if imp == nil {
+		return report, nil
+	}
+
+	if checker, ok := imp.(conflictChecker); ok {
+		conflicts, err := checker.Conflicts()
+		if err != nil {
+			imp.Rollback()
+			return nil, err
+		}
+		for _, conflict := range conflicts {
+			report.Accepted--
+			report.reject(conflict.Line, map[string]string{conflict.Field: conflictReasons[conflict.Field]})
+		}
+		// the conflicts are found after the other rejections
+		slices.SortStableFunc(report.Rejections, func(a, b Rejection) int { return a.Line - b.Line })
+	}
+
+	if dryRun {
+		return report, imp.Rollback()
+	}
+	err = imp.Commit()
+	if err != nil {
+		return nil, err
+	}
+	report.Imported = imp.Count()
+	return report, nil
+}
+
+// Comments validates every record with data.ValidateComment and copies
+// the valid ones into the comments table. With dryRun nothing is written
+func Comments(ctx context.Context, r io.Reader, format Format, dryRun bool, model data.CommentModel) (*Report, error) {
+	var imp *data.CommentImporter
+	var sink importer
+	if !dryRun {
+		var err error
+		imp, err = model.BeginImport(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sink = imp
+	}
+
+	columns := []string{"content", "author", "created_at"}
+	return run(r, format, dryRun, columns, sink, func(v *validator.Validator, rec record, line int) func() error {
+		comment := &data.Comment{
+			Content:   rec["content"],
+			Author:    rec["author"],
+			CreatedAt: parseCreatedAt(v, rec),
+		}
+		data.ValidateComment(v, comment)
+		return func() error {
+			return imp.Add(comment)
+		}
+	})
+}
+
+// Users validates every record with data.ValidateUser and copies
+// the valid ones into the users table. With dryRun nothing is written,
+// the emails and usernames are still checked against the stored users
+func Users(ctx context.Context, r io.Reader, format Format, dryRun bool, model data.UserModel) (*Report, error) {
+	imp, err := model.BeginImport(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the rows that clash with stored users are found at the end,
+	// repeats within the import are caught here
+	seenUsernames := map[string]bool{}
+	seenEmails := map[string]bool{}
+
+	columns := []string{"email", "fullname", "username", "created_at"}
+	return run(r, format, dryRun, columns, imp, func(v *validator.Validator, rec record, line int) func() error {
+		user := &data.User{
+			Email:     rec["email"],
+			Fullname:  rec["fullname"],
+			Username:  rec["username"],
+			CreatedAt: parseCreatedAt(v, rec),
+		}
+		data.ValidateUser(v, user)
+		username := strings.ToLower(user.Username)
+		email := strings.ToLower(user.Email)
+		v.Check(!seenUsernames[username], "username", "appears more than once in the import")
+		v.Check(!seenEmails[email], "email", "appears more than once in the import")
+		if v.IsEmpty() {
+			seenUsernames[username] = true
+			seenEmails[email] = true
+		}
+		return func() error {
+			return imp.Add(line, user)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// every template defines a "subject", a "plainBody" and an "htmlBody"
+//
+//go:embed "templates"
+var templateFS embed.FS
+
+// A Mailer sends emails through an SMTP server. Any server will do,
+// including a local fake one such as MailHog or Mailpit for development
+type Mailer struct {
+	Host     string
+	Port     int
+	Username string // no authentication when empty
+	Password string
+	Sender   string        // e.g. "Craboo <no-reply@example.com>"
+	Timeout  time.Duration // for the whole conversation with the server
+}
+
+// Send renders the template with the data and sends the result to the recipient
+func (m *Mailer) Send(recipient string, templateFile string, data any) error {
+	from, err := mail.ParseAddress(m.Sender)
+	if err != nil {
+		return fmt.Errorf("sender: %w", err)
+	}
+	to, err := mail.ParseAddress(recipient)
+	if err != nil {
+		return fmt.Errorf("recipient: %w", err)
+	}
+	// SMTP servers want internationalized domains in their ASCII form
+	at := strings.LastIndex(to.Address, "@")
+	domain, err := idna.Lookup.ToASCII(to.Address[at+1:])
+	if err != nil {
+		return fmt.Errorf("recipient: %w", err)
+	}
+	to.Address = to.Address[:at+1] + domain
+
+	message, err := m.render(from, to, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(m.Host, strconv.Itoa(m.Port)), m.Timeout)
+	if err != nil {
+		return err
+	}
+	err = conn.SetDeadline(time.Now().Add(m.Timeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	// use TLS whenever the server offers it, fake servers usually don't
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: m.Host})
+		if err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(to.Address)
+	if err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(message)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// render builds a multipart/alternative message with a plain text and an HTML part
+func (m *Mailer) render(from *mail.Address, to *mail.Address, templateFile string, data any) ([]byte, error) {
+	// the subject and the plain text must not be HTML escaped
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+	subject := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+	plainBody := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlTmpl, err := htmltemplate.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+	htmlBody := new(bytes.Buffer)
+	err = htmlTmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	message := new(bytes.Buffer)
+	parts := multipart.NewWriter(message)
+
+	fmt.Fprintf(message, "From: %s\r\n", from.String())
+	fmt.Fprintf(message, "To: %s\r\n", to.String())
+	// a line break in the subject would start a new header
+	fmt.Fprintf(message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")))
+	fmt.Fprintf(message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(message, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", parts.Boundary())
+
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"text/plain; charset=utf-8", plainBody.Bytes()},
+		{"text/html; charset=utf-8", htmlBody.Bytes()},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := parts.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		_, err = qp.Write(part.body)
+		if err != nil {
+			return nil, err
+		}
+		err = qp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = parts.Close()
+	if err != nil {
+		return nil, err
+	}
+	return message.Bytes(), nil
+}
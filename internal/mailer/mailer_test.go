@@ -0,0 +1,223 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an SMTP conversation as the server saw it
+type envelope struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// smtpServer accepts one conversation on a local port, just enough SMTP for
+// net/smtp. The envelope arrives on the channel once the client quits
+func smtpServer(t *testing.T) (int, <-chan envelope) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan envelope, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		text := textproto.NewConn(conn)
+		var env envelope
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO", "HELO":
+				// no STARTTLS and no AUTH
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 8BITMIME")
+			case "MAIL":
+				env.from = path(arg)
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				env.to = append(env.to, path(arg))
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				env.data, err = io.ReadAll(text.DotReader())
+				if err != nil {
+					return
+				}
+				text.PrintfLine("250 OK")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				received <- env
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, received
+}
+
+// path is the address of "FROM:<address> BODY=8BITMIME" and the like
+func path(arg string) string {
+	_, address, _ := strings.Cut(arg, "<")
+	address, _, _ = strings.Cut(address, ">")
+	return address
+}
+
+func TestSend(t *testing.T) {
+	port, received := smtpServer(t)
+	m := &Mailer{
+		Host:    "127.0.0.1",
+		Port:    port,
+		Sender:  "Craboo <no-reply@example.com>",
+		Timeout: 5 * time.Second,
+	}
+
+	// long enough for a soft line break, with characters that need encoding
+	content := "Ça marche très bien ✓ <b>not bold</b> " + strings.Repeat("lorem ipsum ", 10) + "= the end"
+	err := m.Send("Zoë <zoe@bücher.example>", "mention.tmpl", map[string]any{
+		"fullname":        "Zoë Ångström",
+		"author":          "Jürgen",
+		"content":         content,
+		"comment_url":     "https://example.com/comments/7",
+		"unsubscribe_url": "https://example.com/unsubscribe?token=abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env envelope
+	select {
+	case env = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server got no email")
+	}
+
+	if env.from != "no-reply@example.com" {
+		t.Errorf("MAIL FROM = %q, want %q", env.from, "no-reply@example.com")
+	}
+	// the domain goes out in its ASCII form
+	if len(env.to) != 1 || env.to[0] != "zoe@xn--bcher-kva.example" {
+		t.Errorf("RCPT TO = %q, want %q", env.to, "zoe@xn--bcher-kva.example")
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(env.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to, err := mail.ParseAddress(msg.Header.Get("To"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.Name != "Zoë" || to.Address != "zoe@xn--bcher-kva.example" {
+		t.Errorf("To = %q <%s>, want %q <%s>", to.Name, to.Address, "Zoë", "zoe@xn--bcher-kva.example")
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+
+	rawSubject := msg.Header.Get("Subject")
+	if !strings.HasPrefix(rawSubject, "=?utf-8?q?") {
+		t.Errorf("Subject = %q is not Q-encoded", rawSubject)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(rawSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Jürgen mentioned you in a comment" {
+		t.Errorf("Subject = %q, want %q", subject, "Jürgen mentioned you in a comment")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", mediaType)
+	}
+
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", content},
+		{"text/html; charset=utf-8", "Ça marche très bien ✓ &lt;b&gt;not bold&lt;/b&gt;"},
+	} {
+		// NextPart would decode the quoted-printable for us
+		part, err := parts.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := part.Header.Get("Content-Type"); got != want.contentType {
+			t.Errorf("Content-Type = %q, want %q", got, want.contentType)
+		}
+		if got := part.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+			t.Errorf("Content-Transfer-Encoding = %q, want quoted-printable", got)
+		}
+
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(raw))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if len(line) > 76 {
+				t.Errorf("%s: line of %d characters: %q", want.contentType, len(line), line)
+			}
+			for _, r := range line {
+				if r > 127 {
+					t.Errorf("%s: line is not ASCII: %q", want.contentType, line)
+					break
+				}
+			}
+		}
+
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(decoded), want.content) {
+			t.Errorf("%s: the body does not contain %q:\n%s", want.contentType, want.content, decoded)
+		}
+	}
+	if _, err := parts.NextRawPart(); err != io.EOF {
+		t.Errorf("more than two parts: %v", err)
+	}
+}
+
+func TestSendRejectsInvalidAddresses(t *testing.T) {
+	m := &Mailer{Host: "127.0.0.1", Port: 1, Sender: "Craboo <no-reply@example.com>", Timeout: time.Second}
+	for _, recipient := range []string{"not an address", "zoe@bad_domain\u0000.example"} {
+		err := m.Send(recipient, "mention.tmpl", nil)
+		if err == nil || !strings.HasPrefix(err.Error(), "recipient: ") {
+			t.Errorf("Send(%q) = %v, want a recipient error", recipient, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidToken is returned for unsubscribe tokens that were not signed with our secret
+var ErrInvalidToken = errors.New("invalid unsubscribe token")
+
+// UnsubscribeToken signs the user and the kind of email so that the link in
+// the email works without logging in. The tokens do not expire, an old email
+// should still let the user unsubscribe
+func UnsubscribeToken(secret string, userID int64, kind string) string {
+	payload := strconv.FormatInt(userID, 10) + ":" + kind
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signToken(secret, payload)
+}
+
+// ParseUnsubscribeToken checks the signature and returns the user and the kind of email
+func ParseUnsubscribeToken(secret string, token string) (int64, string, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, "", ErrInvalidToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, "", ErrInvalidToken
+	}
+	payload := string(raw)
+	if !hmac.Equal([]byte(signature), []byte(signToken(secret, payload))) {
+		return 0, "", ErrInvalidToken
+	}
+
+	id, kind, ok := strings.Cut(payload, ":")
+	if !ok {
+		return 0, "", ErrInvalidToken
+	}
+	userID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, "", ErrInvalidToken
+	}
+	return userID, kind, nil
+}
+
+func signToken(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("unsubscribe:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
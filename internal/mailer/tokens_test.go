@@ -0,0 +1,86 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	tests := []struct {
+		userID int64
+		kind   string
+	}{
+		{1, "mentions"},
+		{42, "digest"},
+		{9_007_199_254_740_993, "all"},
+		// a colon in the kind must not confuse the parsing
+		{7, "odd:kind"},
+	}
+	for _, tt := range tests {
+		token := UnsubscribeToken("s3cret", tt.userID, tt.kind)
+		userID, kind, err := ParseUnsubscribeToken("s3cret", token)
+		if err != nil {
+			t.Errorf("ParseUnsubscribeToken(%q) = %v", token, err)
+			continue
+		}
+		if userID != tt.userID || kind != tt.kind {
+			t.Errorf("ParseUnsubscribeToken(%q) = %d, %q; want %d, %q", token, userID, kind, tt.userID, tt.kind)
+		}
+		// the token goes into a URL as it is
+		if strings.ContainsAny(token, "+/=?&% ") {
+			t.Errorf("token %q is not URL safe", token)
+		}
+	}
+}
+
+func TestUnsubscribeTokenTampering(t *testing.T) {
+	token := UnsubscribeToken("s3cret", 42, "digest")
+	encoded, signature, _ := strings.Cut(token, ".")
+
+	// the signature of another payload, made without the secret
+	forged := base64.RawURLEncoding.EncodeToString([]byte("43:digest"))
+	// flip one character of the signature
+	flipped := []byte(signature)
+	if flipped[0] == 'A' {
+		flipped[0] = 'B'
+	} else {
+		flipped[0] = 'A'
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+	}{
+		{"other secret", "other", token},
+		{"other user", "s3cret", forged + "." + signature},
+		{"other kind", "s3cret", base64.RawURLEncoding.EncodeToString([]byte("42:all")) + "." + signature},
+		{"changed signature", "s3cret", encoded + "." + string(flipped)},
+		{"no signature", "s3cret", encoded},
+		{"empty signature", "s3cret", encoded + "."},
+		{"signature only", "s3cret", "." + signature},
+		{"not base64", "s3cret", "!!!." + signature},
+		{"empty", "s3cret", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseUnsubscribeToken(tt.secret, tt.token)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("ParseUnsubscribeToken(%q) = %v, want %v", tt.token, err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestUnsubscribeTokenPayload(t *testing.T) {
+	// a payload that is signed but does not hold a user id is still rejected
+	for _, payload := range []string{"digest", "abc:digest", ":digest"} {
+		token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + signToken("s3cret", payload)
+		_, _, err := ParseUnsubscribeToken("s3cret", token)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("ParseUnsubscribeToken(%q) = %v, want %v", token, err, ErrInvalidToken)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+)
+
+// A Worker sends the queued emails in the background
+type Worker struct {
+	Model  data.EmailModel
+	Mailer *Mailer
+	Logger *slog.Logger
+
+	PollInterval time.Duration // how often to look for emails that are due
+	BatchSize    int           // how many emails to claim at once
+	MaxAttempts  int           // an email fails for good after this many attempts
+	BaseBackoff  time.Duration // the wait after the first failure, doubled every time
+}
+
+// Backoff is how long to wait before the next attempt: BaseBackoff, 2x, 4x, ...
+// capped at six hours
+func (wk *Worker) Backoff(attempts int) time.Duration {
+	backoff := float64(wk.BaseBackoff) * math.Pow(2, float64(attempts-1))
+	return time.Duration(math.Min(backoff, float64(6*time.Hour)))
+}
+
+// Run polls until the context is cancelled
+func (wk *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(wk.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wk.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce sends every email that is currently due
+func (wk *Worker) RunOnce(ctx context.Context) {
+	for {
+		// long enough for the SMTP timeout, after that another instance may retry
+		emails, err := wk.Model.ClaimDue(wk.BatchSize, wk.Mailer.Timeout+time.Minute)
+		if err != nil {
+			wk.Logger.Error(err.Error())
+			return
+		}
+
+		for _, email := range emails {
+			wk.send(email)
+		}
+
+		// a short batch means we have caught up
+		if len(emails) < wk.BatchSize || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// send sends one email and records the result
+func (wk *Worker) send(email *data.Email) {
+	var content map[string]any
+	err := json.Unmarshal(email.Data, &content)
+	if err == nil {
+		err = wk.Mailer.Send(email.Recipient, email.Template+".tmpl", content)
+	}
+
+	var retryAt *time.Time
+	if err == nil {
+		email.Status = data.EmailSent
+		email.LastError = ""
+	} else {
+		email.LastError = err.Error()
+		if email.Attempts < wk.MaxAttempts {
+			next := time.Now().Add(wk.Backoff(email.Attempts))
+			retryAt = &next
+		}
+	}
+
+	err = wk.Model.RecordAttempt(email, retryAt)
+	if err != nil {
+		wk.Logger.Error(err.Error(), "email_id", email.ID)
+		return
+	}
+
+	if email.Status != data.EmailSent {
+		wk.Logger.Warn("sending email failed", "email_id", email.ID, "template", email.Template,
+			"attempts", email.Attempts, "error", email.LastError)
+	}
+}
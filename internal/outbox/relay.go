@@ -0,0 +1,147 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+)
+
+// A Handler consumes one event. An event may be handed over more than once,
+// e.g. when the process dies before it is marked as published, so handlers
+// must cope with repeats
+type Handler func(ctx context.Context, event *data.OutboxEvent) error
+
+type consumer struct {
+	name   string
+	handle Handler
+}
+
+// A Relay publishes the outbox events to the registered consumers once their
+// transactions are done, in a line no late commit can jump, see
+// data.OutboxModel.Pending. A failing event holds back the ones after it until
+// it succeeds or is moved to the dead letters
+type Relay struct {
+	Model  data.OutboxModel
+	Logger *slog.Logger
+
+	PollInterval time.Duration // how often to look for new events
+	BatchSize    int           // how many events to read at once
+	MaxAttempts  int           // an event is dead after this many failed attempts
+	BaseBackoff  time.Duration // the wait after the first failure, doubled every time
+
+	consumers []consumer
+}
+
+// Register adds a consumer. Every consumer sees every event, they are
+// registered before Run is started
+func (rl *Relay) Register(name string, handle Handler) {
+	rl.consumers = append(rl.consumers, consumer{name: name, handle: handle})
+}
+
+// Backoff is how long to wait before the next attempt: BaseBackoff, 2x, 4x, ...
+// capped at an hour since everything after the event is waiting for it
+func (rl *Relay) Backoff(attempts int) time.Duration {
+	backoff := float64(rl.BaseBackoff) * math.Pow(2, float64(attempts-1))
+	return time.Duration(math.Min(backoff, float64(time.Hour)))
+}
+
+// Run polls until the context is cancelled
+func (rl *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(rl.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rl.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce publishes every event that is currently due. Only one instance
+// publishes at a time, the others skip their turn
+func (rl *Relay) RunOnce(ctx context.Context) {
+	_, err := rl.Model.WithLock(ctx, func() error {
+		return rl.publishDue(ctx)
+	})
+	if err != nil {
+		rl.Logger.Error(err.Error(), "component", "outbox")
+	}
+}
+
+func (rl *Relay) publishDue(ctx context.Context) error {
+	for {
+		events, err := rl.Model.Pending(rl.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			// the oldest event is waiting for a retry, the rest waits with it
+			if event.NextAttemptAt.After(time.Now()) {
+				return nil
+			}
+
+			err := rl.publish(ctx, event)
+			if err == nil {
+				err = rl.Model.MarkPublished(event)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			var retryAt *time.Time
+			if event.Attempts+1 < rl.MaxAttempts {
+				next := time.Now().Add(rl.Backoff(event.Attempts + 1))
+				retryAt = &next
+			}
+			recordErr := rl.Model.RecordFailure(event, err, retryAt)
+			if recordErr != nil {
+				return recordErr
+			}
+
+			if retryAt != nil {
+				rl.Logger.Warn("outbox event failed", "event_id", event.ID, "event", event.Event,
+					"attempts", event.Attempts, "error", event.LastError)
+				return nil
+			}
+			// a dead event no longer holds up the rest
+			rl.Logger.Error("outbox event is dead", "event_id", event.ID, "event", event.Event,
+				"attempts", event.Attempts, "error", event.LastError)
+		}
+
+		// a short batch means we have caught up
+		if len(events) < rl.BatchSize || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// publish hands the event to every consumer, stopping at the first failure.
+// The consumers before it will see the event again on the next attempt
+func (rl *Relay) publish(ctx context.Context, event *data.OutboxEvent) error {
+	for _, c := range rl.consumers {
+		err := rl.handle(ctx, c, event)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// handle runs one consumer, a panic counts as a failure instead of killing the relay
+func (rl *Relay) handle(ctx context.Context, c consumer, event *data.OutboxEvent) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return c.handle(ctx, event)
+}
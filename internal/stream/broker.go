@@ -0,0 +1,216 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+	"github.com/lib/pq"
+)
+
+// the channel the comments_stream_notify trigger notifies
+const channel = "comment_stream"
+
+// how many events are read from the table in one go
+const batchSize = 500
+
+// ErrTooManySubscribers is returned when the instance is serving its maximum number of streams
+var ErrTooManySubscribers = errors.New("too many stream subscribers")
+
+// A Filter narrows a stream down to one author and/or one thread
+type Filter struct {
+	Author   string
+	ThreadID *int64
+}
+
+// Match reports whether the event passes the filter
+func (f Filter) Match(event *data.StreamEvent) bool {
+	if f.Author != "" && f.Author != event.Author {
+		return false
+	}
+	if f.ThreadID != nil && (event.ThreadID == nil || *event.ThreadID != *f.ThreadID) {
+		return false
+	}
+	return true
+}
+
+// A Subscription receives the live events that match its filter
+type Subscription struct {
+	filter Filter
+	events chan *data.StreamEvent
+	broker *Broker
+	once   sync.Once
+}
+
+// Events is closed when the subscription ends. That happens on Close() or when the
+// subscriber falls too far behind; the client can then resume with Last-Event-ID
+func (s *Subscription) Events() <-chan *data.StreamEvent {
+	return s.events
+}
+
+func (s *Subscription) Close() {
+	s.broker.remove(s)
+}
+
+// The Broker listens for the notifications of the trigger and fans the new
+// events out to the subscribers of this instance
+type Broker struct {
+	Model          data.StreamEventModel
+	Logger         *slog.Logger
+	MaxSubscribers int
+	Retention      time.Duration // how long events are kept for resuming
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	cursor      data.StreamCursor // the last event dispatched
+}
+
+// Subscribe registers a new subscriber
+func (b *Broker) Subscribe(filter Filter) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[*Subscription]struct{})
+	}
+	if len(b.subscribers) >= b.MaxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+
+	sub := &Subscription{
+		filter: filter,
+		// enough room for a burst, a client that can't keep up is dropped
+		events: make(chan *data.StreamEvent, 64),
+		broker: b,
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *Broker) remove(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub.once.Do(func() {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	})
+}
+
+// Resume is the position of a client that resumes with Last-Event-ID
+func (b *Broker) Resume(lastID int64) (data.StreamCursor, error) {
+	return b.Model.CursorOf(lastID)
+}
+
+// Replay returns the events after the cursor that match the filter, for clients
+// resuming with Last-Event-ID. At most limit events are returned
+func (b *Broker) Replay(cursor data.StreamCursor, filter Filter, limit int) ([]*data.StreamEvent, error) {
+	replay := []*data.StreamEvent{}
+	for len(replay) < limit {
+		events, err := b.Model.After(cursor, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			cursor = event.Cursor()
+			if filter.Match(event) && len(replay) < limit {
+				replay = append(replay, event)
+			}
+		}
+		if len(events) < batchSize {
+			break
+		}
+	}
+	return replay, nil
+}
+
+// Run listens until the context is cancelled
+func (b *Broker) Run(ctx context.Context, dsn string) error {
+	cursor, err := b.Model.Last()
+	if err != nil {
+		return err
+	}
+	b.cursor = cursor
+
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			b.Logger.Error(err.Error(), "listener", channel)
+		}
+	})
+	defer listener.Close()
+
+	err = listener.Listen(channel)
+	if err != nil {
+		return err
+	}
+
+	// notifications can be lost without us noticing, so check now and then anyway
+	poll := time.NewTicker(30 * time.Second)
+	defer poll.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		// a nil notification means the connection was re-established, we may
+		// have missed notifications so we catch up the same way
+		case <-listener.Notify:
+			b.dispatch()
+		case <-poll.C:
+			go listener.Ping()
+			b.dispatch()
+		case <-cleanup.C:
+			err := b.Model.DeleteOlderThan(b.Retention)
+			if err != nil {
+				b.Logger.Error(err.Error())
+			}
+		}
+	}
+}
+
+// dispatch reads every event that became final and hands it to the subscribers.
+// An event of a transaction that is still running waits for the next notification
+// or poll, by then it sorts after the cursor however small its id is
+func (b *Broker) dispatch() {
+	for {
+		events, err := b.Model.After(b.cursor, batchSize)
+		if err != nil {
+			b.Logger.Error(err.Error())
+			return
+		}
+
+		for _, event := range events {
+			b.cursor = event.Cursor()
+			b.publish(event)
+		}
+
+		if len(events) < batchSize {
+			return
+		}
+	}
+}
+
+func (b *Broker) publish(event *data.StreamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if !sub.filter.Match(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// the subscriber is too slow, drop it rather than block everybody
+			sub.once.Do(func() {
+				delete(b.subscribers, sub)
+				close(sub.events)
+			})
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package validator
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Struct checks the fields of a struct against their validate tags, e.g.
+//
+//	Content string `json:"content" validate:"required,max=100"`
+//
+// Errors use the JSON name of the field. Nested structs and slices of structs
+// are checked too, their errors look like items[3].content
+//
+// Rules for text: text and line reject invalid UTF-8 and control characters,
+// minchars and maxchars count user-perceived characters rather than bytes.
+//
+// The rules are run in the order of the tag and stop at the first failure of
+// a field. A nil pointer only fails required, the other rules skip it
+
+// the codes of the tag rules that the checks above do not have
+const (
+	CodeTooSmall = "too_small"
+	CodeTooLarge = "too_large"
+)
+
+// A RuleFunc checks a field against the parameter of its rule (the 100 of
+// max=100) and returns nil when the value is fine
+type RuleFunc func(field reflect.Value, param string) *FieldError
+
+var (
+	rulesMu sync.RWMutex
+	rules   = map[string]RuleFunc{
+		"required": ruleRequired,
+		"min":      ruleMin,
+		"max":      ruleMax,
+		"oneof":    ruleOneOf,
+		"url":      ruleURL,
+		"unique":   ruleUnique,
+		"email":    ruleEmail,
+		"text":     ruleText,
+		"line":     ruleLine,
+		"minchars": ruleMinChars,
+		"maxchars": ruleMaxChars,
+	}
+)
+
+// RegisterRule adds a rule that validate tags can use. It is meant to be
+// called from init, before Struct sees a tag that uses the rule
+func RegisterRule(name string, fn RuleFunc) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules[name] = fn
+}
+
+func lookupRule(name string) RuleFunc {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return rules[name]
+}
+
+// A TagRule is one rule of a field, e.g. max with the parameter 100
+type TagRule struct {
+	Name  string `json:"name"`
+	Param string `json:"param,omitempty"`
+}
+
+// FieldRules are the rules of one field, for documentation
+type FieldRules struct {
+	Field string    `json:"field"` // the JSON name, nested fields are items[].content
+	Rules []TagRule `json:"rules"`
+}
+
+// the parsed tags of a struct type, they are cached so that reflection over
+// the tags happens once per type
+type structRules struct {
+	fields []fieldRules
+}
+
+type fieldRules struct {
+	index     []int
+	name      string
+	rules     []TagRule
+	normalize []string     // see Normalize
+	nested    *structRules // for a struct or a slice of structs with rules
+	slice     bool
+}
+
+var structCache sync.Map // reflect.Type to *structRules
+
+// Struct runs the validate tags of the struct that s points to
+func (v *Validator) Struct(s any) {
+	value := reflect.ValueOf(s)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		panic("validator: Struct needs a struct, not " + value.Kind().String())
+	}
+	v.checkStruct(value, rulesFor(value.Type()))
+}
+
+func (v *Validator) checkStruct(value reflect.Value, sr *structRules) {
+	for _, fr := range sr.fields {
+		field := value.FieldByIndex(fr.index)
+		v.checkField(field, fr)
+
+		if fr.nested == nil {
+			continue
+		}
+		if fr.slice {
+			for i := 0; i < field.Len(); i++ {
+				item := reflect.Indirect(field.Index(i))
+				if item.IsValid() {
+					v.At(Path(fr.name, i)).checkStruct(item, fr.nested)
+				}
+			}
+			continue
+		}
+		if item := reflect.Indirect(field); item.IsValid() {
+			v.At(fr.name).checkStruct(item, fr.nested)
+		}
+	}
+}
+
+func (v *Validator) checkField(field reflect.Value, fr fieldRules) {
+	for _, rule := range fr.rules {
+		if field.Kind() == reflect.Pointer && field.IsNil() && rule.Name != "required" {
+			return
+		}
+		fn := lookupRule(rule.Name)
+		if fn == nil {
+			panic("validator: unknown rule " + rule.Name)
+		}
+		err := fn(reflect.Indirect(field), rule.Param)
+		if err != nil {
+			v.AddErrorCode(fr.name, err.Code, err.Message, err.Params)
+			return
+		}
+	}
+}
+
+// Rules lists the rules of the struct that s is or points to, nested ones included
+func Rules(s any) []FieldRules {
+	t := reflect.TypeOf(s)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	list := []FieldRules{}
+	rulesFor(t).describe("", &list)
+	return list
+}
+
+func (sr *structRules) describe(prefix string, list *[]FieldRules) {
+	for _, fr := range sr.fields {
+		name := fr.name
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if len(fr.rules) > 0 {
+			*list = append(*list, FieldRules{Field: name, Rules: fr.rules})
+		}
+		if fr.nested != nil {
+			if fr.slice {
+				name += "[]"
+			}
+			fr.nested.describe(name, list)
+		}
+	}
+}
+
+func rulesFor(t reflect.Type) *structRules {
+	cached, ok := structCache.Load(t)
+	if ok {
+		return cached.(*structRules)
+	}
+	sr := parseStruct(t, map[reflect.Type]bool{})
+	structCache.Store(t, sr)
+	return sr
+}
+
+// parseStruct reads the tags of a struct type. seen stops recursive types
+func parseStruct(t reflect.Type, seen map[reflect.Type]bool) *structRules {
+	seen[t] = true
+	sr := &structRules{}
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || f.Anonymous {
+			continue
+		}
+		fr := fieldRules{index: f.Index, name: fieldName(f)}
+
+		tag := f.Tag.Get("validate")
+		if tag != "" && tag != "-" {
+			for _, part := range strings.Split(tag, ",") {
+				name, param, _ := strings.Cut(strings.TrimSpace(part), "=")
+				if lookupRule(name) == nil {
+					panic(fmt.Sprintf("validator: unknown rule %q on %s.%s", name, t.Name(), f.Name))
+				}
+				fr.rules = append(fr.rules, TagRule{Name: name, Param: param})
+			}
+		}
+
+		if normalize := f.Tag.Get("normalize"); normalize != "" {
+			fr.normalize = strings.Split(normalize, ",")
+			// fail at the first use rather than when a request comes in
+			NormalizeText("", fr.normalize...)
+		}
+
+		// look into structs and slices of structs that have rules of their own
+		inner := f.Type
+		if inner.Kind() == reflect.Slice {
+			inner = inner.Elem()
+			fr.slice = true
+		}
+		for inner.Kind() == reflect.Pointer {
+			inner = inner.Elem()
+		}
+		if tag != "-" && inner.Kind() == reflect.Struct && inner != reflect.TypeOf(time.Time{}) && !seen[inner] {
+			nested := parseStruct(inner, seen)
+			if len(nested.fields) > 0 {
+				fr.nested = nested
+			}
+		}
+
+		if len(fr.rules) > 0 || len(fr.normalize) > 0 || fr.nested != nil {
+			sr.fields = append(sr.fields, fr)
+		}
+	}
+	delete(seen, t)
+	return sr
+}
+
+// fieldName is the JSON name of the field, the Go name if it has none
+func fieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return name
+}
+
+// the built-in rules
+
+func ruleRequired(field reflect.Value, param string) *FieldError {
+	if !field.IsValid() || field.IsZero() || (field.Kind() == reflect.Slice && field.Len() == 0) {
+		return &FieldError{Code: CodeRequired, Message: "must be provided"}
+	}
+	return nil
+}
+
+// min and max are the length of strings (in bytes), the number of items of
+// slices and maps and the value of numbers
+func ruleMin(field reflect.Value, param string) *FieldError {
+	return compareRule(field, param, true)
+}
+
+func ruleMax(field reflect.Value, param string) *FieldError {
+	return compareRule(field, param, false)
+}
+
+func compareRule(field reflect.Value, param string, min bool) *FieldError {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		panic("validator: min and max need a number, not " + param)
+	}
+	params := map[string]any{"max": limit}
+	if min {
+		params = map[string]any{"min": limit}
+	}
+
+	var n float64
+	var code, message string
+	switch field.Kind() {
+	case reflect.String:
+		n = float64(field.Len())
+		code, message = CodeTooLong, "must not be more than "+param+" bytes long"
+		if min {
+			code, message = CodeTooShort, "must be at least "+param+" bytes long"
+		}
+	case reflect.Slice, reflect.Map, reflect.Array:
+		n = float64(field.Len())
+		code, message = CodeTooLong, "must not contain more than "+param+" items"
+		if min {
+			code, message = CodeTooShort, "must contain at least "+param+" items"
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(field.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(field.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = field.Float()
+	default:
+		panic("validator: min and max do not work on " + field.Kind().String())
+	}
+	if code == "" {
+		code, message = CodeTooLarge, "must be a maximum of "+param
+		if min {
+			code, message = CodeTooSmall, "must be at least "+param
+		}
+	}
+
+	if (min && n < limit) || (!min && n > limit) {
+		return &FieldError{Code: code, Message: message, Params: params}
+	}
+	return nil
+}
+
+// oneof=reject hold flag
+func ruleOneOf(field reflect.Value, param string) *FieldError {
+	permitted := strings.Fields(param)
+	if field.Kind() == reflect.String && PermittedValue(field.String(), permitted...) {
+		return nil
+	}
+	return &FieldError{Code: CodeNotInEnum, Message: "must be one of " + strings.Join(permitted, ", "),
+		Params: map[string]any{"permitted": permitted}}
+}
+
+// url or url=http https for only some schemes
+func ruleURL(field reflect.Value, param string) *FieldError {
+	schemes := strings.Fields(param)
+	if IsURL(field.String(), schemes...) {
+		return nil
+	}
+	message := "must be an absolute URL"
+	if len(schemes) > 0 {
+		message = "must be an absolute " + strings.Join(schemes, " or ") + " URL"
+	}
+	return &FieldError{Code: CodeNotURL, Message: message, Params: map[string]any{"schemes": schemes}}
+}
+
+func ruleUnique(field reflect.Value, param string) *FieldError {
+	seen := map[any]bool{}
+	for i := 0; i < field.Len(); i++ {
+		item := field.Index(i).Interface()
+		if seen[item] {
+			return &FieldError{Code: CodeNotUnique, Message: "must not contain duplicates",
+				Params: map[string]any{"value": item}}
+		}
+		seen[item] = true
+	}
+	return nil
+}
+
+// email accepts internationalized addresses, see ValidEmail
+func ruleEmail(field reflect.Value, param string) *FieldError {
+	if ValidEmail(field.String()) {
+		return nil
+	}
+	return &FieldError{Code: CodeFormat, Message: "must be a valid email address"}
+}
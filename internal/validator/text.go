@@ -0,0 +1,214 @@
+package validator
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Text from users is normalized before it is validated and stored, the
+// normalize tag says how:
+//
+//	trim    removes the white space around the text
+//	squash  trims and turns every run of white space into one space, for names
+//	nfc     composes the text to Unicode NFC, so é is always one code point
+//	email   see NormalizeEmail
+//
+// For example Content string `json:"content" normalize:"trim,nfc"`
+
+// Normalize applies the normalize tags of the struct that s points to
+func Normalize(s any) {
+	value := reflect.ValueOf(s)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		panic("validator: Normalize needs a pointer to a struct")
+	}
+	value = value.Elem()
+	normalizeStruct(value, rulesFor(value.Type()))
+}
+
+func normalizeStruct(value reflect.Value, sr *structRules) {
+	for _, fr := range sr.fields {
+		field := value.FieldByIndex(fr.index)
+		if len(fr.normalize) > 0 && field.Kind() == reflect.String && field.CanSet() {
+			field.SetString(NormalizeText(field.String(), fr.normalize...))
+		}
+
+		if fr.nested == nil {
+			continue
+		}
+		if fr.slice {
+			for i := 0; i < field.Len(); i++ {
+				if item := reflect.Indirect(field.Index(i)); item.IsValid() {
+					normalizeStruct(item, fr.nested)
+				}
+			}
+			continue
+		}
+		if item := reflect.Indirect(field); item.IsValid() {
+			normalizeStruct(item, fr.nested)
+		}
+	}
+}
+
+// NormalizeText applies the normalizations in order. Invalid UTF-8 is left
+// alone so that the text rule can reject it
+func NormalizeText(s string, normalizations ...string) string {
+	if !utf8.ValidString(s) {
+		return s
+	}
+	for _, normalization := range normalizations {
+		switch normalization {
+		case "trim":
+			s = strings.TrimSpace(s)
+		case "squash":
+			s = strings.Join(strings.Fields(s), " ")
+		case "nfc":
+			s = norm.NFC.String(s)
+		case "email":
+			s = NormalizeEmail(s)
+		default:
+			panic("validator: unknown normalization " + normalization)
+		}
+	}
+	return s
+}
+
+// NormalizeEmail trims the address and lowercases the domain, an
+// internationalized domain is kept in Unicode. The local part is case
+// sensitive so it is only put in NFC
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+
+	unicodeDomain, err := idna.Lookup.ToUnicode(domain)
+	if err != nil {
+		unicodeDomain = strings.ToLower(domain)
+	}
+	return norm.NFC.String(local) + "@" + norm.NFC.String(unicodeDomain)
+}
+
+// Graphemes counts the user-perceived characters, an emoji with a skin tone
+// or a letter with a combining accent is one
+func Graphemes(s string) int {
+	return uniseg.GraphemeClusterCount(s)
+}
+
+// ValidText tells if s is valid UTF-8 without control characters or the
+// characters that reorder text (bidi overrides and isolates). Tabs and line
+// breaks are allowed when multiline is set
+func ValidText(s string, multiline bool) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			if !multiline {
+				return false
+			}
+		case unicode.IsControl(r):
+			return false
+		case r >= '\u202A' && r <= '\u202E', r >= '\u2066' && r <= '\u2069':
+			return false
+		}
+	}
+	return true
+}
+
+// ValidEmail checks the address, the local part may be Unicode (RFC 6531)
+// and the domain may be an internationalized one
+func ValidEmail(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 1 || len(email) > 254 {
+		return false
+	}
+	local, domain := email[:at], email[at+1:]
+
+	if len(local) > 64 || !ValidText(local, false) {
+		return false
+	}
+	for _, r := range local {
+		if unicode.IsSpace(r) || strings.ContainsRune(`"(),:;<>@[\]`, r) {
+			return false
+		}
+	}
+	if strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+		return false
+	}
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return false
+	}
+	labels := strings.Split(ascii, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	tld := labels[len(labels)-1]
+	if strings.HasPrefix(tld, "xn--") {
+		return true
+	}
+	if len(tld) < 2 {
+		return false
+	}
+	for _, r := range tld {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// the rules on text
+
+// text allows line breaks, line does not
+func ruleText(field reflect.Value, param string) *FieldError {
+	if ValidText(field.String(), true) {
+		return nil
+	}
+	return &FieldError{Code: CodeFormat, Message: "must be valid UTF-8 without control or bidi override characters"}
+}
+
+func ruleLine(field reflect.Value, param string) *FieldError {
+	if ValidText(field.String(), false) {
+		return nil
+	}
+	return &FieldError{Code: CodeFormat, Message: "must be a single line of valid UTF-8 without control or bidi override characters"}
+}
+
+// minchars and maxchars count user-perceived characters
+func ruleMinChars(field reflect.Value, param string) *FieldError {
+	limit := charsParam(param)
+	if Graphemes(field.String()) < limit {
+		return &FieldError{Code: CodeTooShort, Message: "must be at least " + param + " characters long",
+			Params: map[string]any{"min": limit}}
+	}
+	return nil
+}
+
+func ruleMaxChars(field reflect.Value, param string) *FieldError {
+	limit := charsParam(param)
+	if Graphemes(field.String()) > limit {
+		return &FieldError{Code: CodeTooLong, Message: "must not be more than " + param + " characters long",
+			Params: map[string]any{"max": limit}}
+	}
+	return nil
+}
+
+func charsParam(param string) int {
+	limit, err := strconv.Atoi(param)
+	if err != nil {
+		panic("validator: minchars and maxchars need an integer, not " + param)
+	}
+	return limit
+}
@@ -0,0 +1,177 @@
+package validator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name           string
+		input          string
+		normalizations []string
+		want           string
+	}{
+		{"decomposed to NFC", "cafe\u0301", []string{"nfc"}, "café"},
+		{"NFC stays as it is", "café", []string{"nfc"}, "café"},
+		{"trim", " \t hello \n", []string{"trim"}, "hello"},
+		{"squash", "  Zoë \t\n Ångström  ", []string{"squash"}, "Zoë Ångström"},
+		{"squash and NFC", " Zoe\u0308  A\u030Angstro\u0308m ", []string{"squash", "nfc"}, "Zoë Ångström"},
+		{"skin tone is kept", " 👍🏽 ", []string{"trim", "nfc"}, "👍🏽"},
+		{"bidi override is kept for the text rule", "abc\u202Edef", []string{"trim", "nfc"}, "abc\u202Edef"},
+		{"invalid UTF-8 is left alone", " \xffcafe\u0301 ", []string{"trim", "nfc"}, " \xffcafe\u0301 "},
+		{"email", " Zoë@Bücher.Example ", []string{"email"}, "Zoë@bücher.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeText(tt.input, tt.normalizations...)
+			if got != tt.want {
+				t.Errorf("NormalizeText(%q, %v) = %q, want %q", tt.input, tt.normalizations, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		want  string
+	}{
+		{"trimmed", " alice@example.com\n", "alice@example.com"},
+		{"uppercase domain", "alice@EXAMPLE.Com", "alice@example.com"},
+		{"local part keeps its case", "Alice.Smith@example.com", "Alice.Smith@example.com"},
+		{"local part in NFC", "jose\u0301@example.com", "josé@example.com"},
+		{"IDN domain stays Unicode", "zoe@bücher.example", "zoe@bücher.example"},
+		{"uppercase IDN domain", "zoe@BÜCHER.example", "zoe@bücher.example"},
+		{"punycode domain to Unicode", "zoe@xn--bcher-kva.example", "zoe@bücher.example"},
+		{"the last @ splits", `"a@b"@Example.com`, `"a@b"@example.com`},
+		{"no @", " alice ", "alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeEmail(tt.email)
+			if got != tt.want {
+				t.Errorf("NormalizeEmail(%q) = %q, want %q", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidText(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		line      bool // valid as a single line
+		multiline bool // valid as text
+	}{
+		{"plain", "hello world", true, true},
+		{"NFC accents", "café", true, true},
+		{"combining accent", "cafe\u0301", true, true},
+		{"emoji with a skin tone", "👍🏽", true, true},
+		{"emoji sequence", "👨\u200D👩\u200D👧", true, true},
+		{"right to left letters", "مرحبا بالعالم", true, true},
+		{"line break", "one\ntwo", false, true},
+		{"windows line break", "one\r\ntwo", false, true},
+		{"tab", "a\tb", false, true},
+		{"NUL", "a\x00b", false, false},
+		{"escape", "a\x1b[31mred", false, false},
+		{"C1 control", "a\u0085b", false, false},
+		{"bidi override", "abc\u202Edef", false, false},
+		{"bidi embedding", "\u202Aabc", false, false},
+		{"bidi isolate", "abc\u2067def\u2069", false, false},
+		{"invalid UTF-8", "caf\xe9", false, false},
+		{"truncated UTF-8", "\xf0\x9f\x91", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidText(tt.text, false); got != tt.line {
+				t.Errorf("ValidText(%q, false) = %t, want %t", tt.text, got, tt.line)
+			}
+			if got := ValidText(tt.text, true); got != tt.multiline {
+				t.Errorf("ValidText(%q, true) = %t, want %t", tt.text, got, tt.multiline)
+			}
+		})
+	}
+}
+
+func TestValidEmail(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		valid bool
+	}{
+		{"plain", "alice@example.com", true},
+		{"subdomain", "alice.smith+tag@mail.example.co.uk", true},
+		{"uppercase domain", "Alice@EXAMPLE.COM", true},
+		{"IDN domain", "zoe@bücher.example", true},
+		{"punycode domain", "zoe@xn--bcher-kva.example", true},
+		{"IDN top level domain", "user@例子.广告", true},
+		{"Unicode local part", "josé@example.com", true},
+		{"no @", "alice.example.com", false},
+		{"no local part", "@example.com", false},
+		{"no dot in the domain", "alice@localhost", false},
+		{"one letter top level domain", "alice@example.c", false},
+		{"numeric top level domain", "alice@example.123", false},
+		{"invalid domain", "alice@exa mple.com", false},
+		{"space in the local part", "al ice@example.com", false},
+		{"special in the local part", "al,ice@example.com", false},
+		{"leading dot", ".alice@example.com", false},
+		{"trailing dot", "alice.@example.com", false},
+		{"two dots", "al..ice@example.com", false},
+		{"bidi override in the local part", "alice\u202E@example.com", false},
+		{"control in the local part", "ali\x00ce@example.com", false},
+		{"invalid UTF-8", "al\xffice@example.com", false},
+		{"local part too long", strings.Repeat("a", 65) + "@example.com", false},
+		{"too long", "alice@" + strings.Repeat("a", 250) + ".com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidEmail(tt.email); got != tt.valid {
+				t.Errorf("ValidEmail(%q) = %t, want %t", tt.email, got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMaxChars(t *testing.T) {
+	type sample struct {
+		Name string `json:"name" validate:"maxchars=3"`
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		valid bool
+	}{
+		{"ASCII", "abc", true},
+		{"ASCII too long", "abcd", false},
+		{"NFC accents", "ééé", true},
+		{"combining accents are part of the letter", "e\u0301e\u0301e\u0301", true},
+		{"emoji with a skin tone is one", "👍🏽👍🏽👍🏽", true},
+		{"emoji sequence is one", "👨\u200D👩\u200D👧👨\u200D👩\u200D👧👨\u200D👩\u200D👧", true},
+		{"flags", "🇧🇿🇧🇿🇧🇿", true},
+		{"one emoji too many", "👍🏽👍🏽👍🏽👍🏽", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New()
+			v.Struct(&sample{Name: tt.value})
+			if v.IsEmpty() != tt.valid {
+				t.Fatalf("maxchars=3 on %q: errors = %v, want valid %t", tt.value, v.Errors, tt.valid)
+			}
+			if tt.valid {
+				return
+			}
+			errs := v.Errors["name"]
+			if len(errs) != 1 || errs[0].Code != CodeTooLong || errs[0].Params["max"] != 3 {
+				t.Errorf("errors = %v, want one %s with max 3", errs, CodeTooLong)
+			}
+		})
+	}
+}
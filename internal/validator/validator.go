@@ -1,13 +1,41 @@
 package validator
 
 import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
+// the codes of the errors the checks below report, clients can switch on them
+const (
+	CodeInvalid   = "invalid" // the default of AddError and Check
+	CodeRequired  = "required"
+	CodeTooShort  = "too_short"
+	CodeTooLong   = "too_long"
+	CodeFormat    = "format"
+	CodeNotUnique = "not_unique"
+	CodeNotURL    = "not_url"
+	CodeNotInEnum = "not_in_enum"
+)
+
+// A FieldError is one problem with a field
+type FieldError struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Params  map[string]any `json:"params,omitempty"` // e.g. the max of too_long
+}
+
 // we will create a new type named Validator
 
 type Validator struct {
-	Errors map[string]string
+	// every problem of a field, a field can be nested like items[3].content
+	Errors map[string][]FieldError
+	prefix string // see At()
 }
 
 //Construct a new Validator and return a pointer to it
@@ -15,8 +43,42 @@ type Validator struct {
 
 func New() *Validator {
 	return &Validator{
-		Errors: make(map[string]string),
+		Errors: make(map[string][]FieldError),
+	}
+}
+
+// At returns a validator for the fields of a nested object or array item,
+// v.At("items[3]").Check(ok, "content", ...) reports items[3].content.
+// The errors end up in v
+func (v *Validator) At(prefix string) *Validator {
+	return &Validator{Errors: v.Errors, prefix: v.path(prefix)}
+}
+
+// Path joins the parts of a field path, Path("items", 3, "content") is items[3].content
+func Path(parts ...any) string {
+	path := ""
+	for _, part := range parts {
+		switch part := part.(type) {
+		case int:
+			path += "[" + strconv.Itoa(part) + "]"
+		default:
+			if path != "" {
+				path += "."
+			}
+			path += fmt.Sprint(part)
+		}
 	}
+	return path
+}
+
+func (v *Validator) path(key string) string {
+	if v.prefix == "" {
+		return key
+	}
+	if key == "" || key[0] == '[' {
+		return v.prefix + key
+	}
+	return v.prefix + "." + key
 }
 
 // Let's check to see if the Validator's map contain any entires
@@ -25,12 +87,20 @@ func (v *Validator) IsEmpty() bool {
 }
 
 // Add a new error entry to the Validator's error map
-// Check first if an entry with the same key does not already exist
+// The same message is only reported once per key
 func (v *Validator) AddError(key string, message string) {
-	_, exists := v.Errors[key]
-	if !exists {
-		v.Errors[key] = message
+	v.AddErrorCode(key, CodeInvalid, message, nil)
+}
+
+// AddErrorCode adds an error with a code and the parameters of the check
+func (v *Validator) AddErrorCode(key string, code string, message string, params map[string]any) {
+	key = v.path(key)
+	for _, existing := range v.Errors[key] {
+		if existing.Message == message {
+			return
+		}
 	}
+	v.Errors[key] = append(v.Errors[key], FieldError{Code: code, Message: message, Params: params})
 }
 
 // If any validation check returns false, then we will make an entry into our Validator's error map
@@ -40,7 +110,96 @@ func (v *Validator) Check(acceptable bool, key string, message string) {
 	}
 }
 
+// CheckCode is Check with a code and parameters
+func (v *Validator) CheckCode(acceptable bool, key string, code string, message string, params map[string]any) {
+	if !acceptable {
+		v.AddErrorCode(key, code, message, params)
+	}
+}
+
+// Messages is the old shape of the errors: the first message of every field
+func (v *Validator) Messages() map[string]string {
+	messages := make(map[string]string, len(v.Errors))
+	for key, errs := range v.Errors {
+		messages[key] = errs[0].Message
+	}
+	return messages
+}
+
+// CheckRequired reports an empty value
+func (v *Validator) CheckRequired(value string, key string) {
+	v.CheckCode(value != "", key, CodeRequired, "must be provided", nil)
+}
+
+// CheckLength reports a value that has fewer than min or more than max
+// characters. A max of 0 means no maximum
+func (v *Validator) CheckLength(value string, key string, min int, max int) {
+	n := utf8.RuneCountInString(value)
+	v.CheckCode(n >= min, key, CodeTooShort, fmt.Sprintf("must be at least %d characters long", min),
+		map[string]any{"min": min})
+	if max > 0 {
+		v.CheckCode(n <= max, key, CodeTooLong, fmt.Sprintf("must not be more than %d characters long", max),
+			map[string]any{"max": max})
+	}
+}
+
+// CheckMatches reports a value the regular expression does not match
+func (v *Validator) CheckMatches(value string, rx *regexp.Regexp, key string, message string) {
+	v.CheckCode(Matches(value, rx), key, CodeFormat, message, map[string]any{"pattern": rx.String()})
+}
+
+// CheckUnique reports the values that appear more than once, at their position
+func CheckUnique[T comparable](v *Validator, values []T, key string) {
+	seen := make(map[T]bool, len(values))
+	for i, value := range values {
+		v.CheckCode(!seen[value], Path(key, i), CodeNotUnique, "must not be repeated",
+			map[string]any{"value": value})
+		seen[value] = true
+	}
+}
+
+// CheckURL reports a value that is not an absolute URL with one of the schemes
+func (v *Validator) CheckURL(value string, key string, schemes ...string) {
+	err := ruleURL(reflect.ValueOf(value), strings.Join(schemes, " "))
+	if err != nil {
+		v.AddErrorCode(key, err.Code, err.Message, err.Params)
+	}
+}
+
+// CheckPermitted reports a value that is not one of the permitted values
+func (v *Validator) CheckPermitted(value string, key string, permittedValues ...string) {
+	v.CheckCode(PermittedValue(value, permittedValues...), key, CodeNotInEnum,
+		"must be one of "+strings.Join(permittedValues, ", "), map[string]any{"permitted": permittedValues})
+}
+
 // check for permitted value
 func PermittedValue(value string, permittedValues ...string) bool {
 	return slices.Contains(permittedValues, value)
 }
+
+// Matches tells if the regular expression matches the value
+func Matches(value string, rx *regexp.Regexp) bool {
+	return rx.MatchString(value)
+}
+
+// Unique tells if no value appears twice
+func Unique[T comparable](values []T) bool {
+	seen := make(map[T]bool, len(values))
+	for _, value := range values {
+		if seen[value] {
+			return false
+		}
+		seen[value] = true
+	}
+	return true
+}
+
+// IsURL tells if the value is an absolute URL with a host. Without schemes
+// any scheme will do
+func IsURL(value string, schemes ...string) bool {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	return len(schemes) == 0 || slices.Contains(schemes, u.Scheme)
+}
@@ -0,0 +1,183 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+)
+
+// the headers sent with every delivery
+const (
+	EventHeader     = "X-Craboo-Event"
+	DeliveryHeader  = "X-Craboo-Delivery"
+	TimestampHeader = "X-Craboo-Timestamp"
+	// "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret
+	SignatureHeader = "X-Craboo-Signature"
+)
+
+// Sign computes the value of the signature header. Receivers recompute it
+// with their copy of the secret and compare with hmac.Equal
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// the envelope every receiver gets
+type message struct {
+	ID        int64           `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Send posts the delivery to its webhook and fills in Status, ResponseCode and LastError.
+// Any 2xx response counts as a success
+func Send(ctx context.Context, client *http.Client, delivery *data.Delivery) {
+	body, err := json.Marshal(message{
+		ID:        delivery.ID,
+		Event:     delivery.Event,
+		CreatedAt: delivery.CreatedAt,
+		Data:      delivery.Payload,
+	})
+	if err != nil {
+		delivery.LastError = err.Error()
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.LastError = err.Error()
+		return
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "craboo-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		delivery.ResponseCode = nil
+		delivery.LastError = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	// drain a little so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	code := resp.StatusCode
+	delivery.ResponseCode = &code
+	if code >= 200 && code < 300 {
+		delivery.Status = data.DeliverySucceeded
+		delivery.LastError = ""
+		return
+	}
+	delivery.LastError = fmt.Sprintf("unexpected response status %d", code)
+}
+
+// Store is the part of data.WebhookModel that the worker uses
+type Store interface {
+	ClaimDue(limit int, lease time.Duration) ([]*data.Delivery, error)
+	RecordAttempt(delivery *data.Delivery, retryAt *time.Time, disableAfter int) error
+}
+
+// A Worker sends the pending deliveries in the background
+type Worker struct {
+	Model  Store
+	Client *http.Client
+	Logger *slog.Logger
+
+	PollInterval time.Duration // how often to look for due deliveries
+	BatchSize    int           // how many deliveries to claim at once
+	MaxAttempts  int           // a delivery fails for good after this many attempts
+	BaseBackoff  time.Duration // the wait after the first failure, doubled every time
+	DisableAfter int           // consecutive failures before the webhook is disabled
+}
+
+// Backoff is how long to wait before the next attempt: BaseBackoff, 2x, 4x, ...
+// capped at a day
+func (wk *Worker) Backoff(attempts int) time.Duration {
+	backoff := float64(wk.BaseBackoff) * math.Pow(2, float64(attempts-1))
+	return time.Duration(math.Min(backoff, float64(24*time.Hour)))
+}
+
+// Run polls until the context is cancelled
+func (wk *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(wk.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wk.RunOnce(ctx)
+		}
+	}
+}
+
+// RunOnce sends every delivery that is currently due
+func (wk *Worker) RunOnce(ctx context.Context) {
+	for {
+		// long enough for the client timeout, after that another instance may retry
+		deliveries, err := wk.Model.ClaimDue(wk.BatchSize, wk.Client.Timeout+time.Minute)
+		if err != nil {
+			wk.Logger.Error(err.Error())
+			return
+		}
+
+		for _, delivery := range deliveries {
+			wk.Deliver(ctx, delivery, true)
+		}
+
+		// a short batch means we have caught up
+		if len(deliveries) < wk.BatchSize || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Deliver sends one delivery and records the result. When retry is false a
+// failure is final and does not count towards disabling the webhook, that is
+// what test events use
+func (wk *Worker) Deliver(ctx context.Context, delivery *data.Delivery, retry bool) {
+	Send(ctx, wk.Client, delivery)
+
+	var retryAt *time.Time
+	if delivery.Status != data.DeliverySucceeded && retry && delivery.Attempts < wk.MaxAttempts {
+		next := time.Now().Add(wk.Backoff(delivery.Attempts))
+		retryAt = &next
+	}
+
+	disableAfter := wk.DisableAfter
+	if !retry {
+		disableAfter = 0
+	}
+	err := wk.Model.RecordAttempt(delivery, retryAt, disableAfter)
+	if err != nil {
+		wk.Logger.Error(err.Error(), "delivery_id", delivery.ID)
+		return
+	}
+
+	if delivery.Status != data.DeliverySucceeded {
+		wk.Logger.Warn("webhook delivery failed", "delivery_id", delivery.ID,
+			"webhook_id", delivery.WebhookID, "attempts", delivery.Attempts, "error", delivery.LastError)
+	}
+}
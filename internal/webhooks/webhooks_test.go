@@ -0,0 +1,365 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ReynerioSamos/craboo/internal/data"
+)
+
+// store keeps the webhooks and deliveries in memory the way WebhookModel
+// keeps them in the database
+type store struct {
+	mu         sync.Mutex
+	webhooks   map[int64]*hook
+	deliveries []*data.Delivery
+	retries    []*time.Time // the retryAt of every recorded attempt
+}
+
+type hook struct {
+	url      string
+	secret   string
+	enabled  bool
+	failures int
+}
+
+func newStore() *store {
+	return &store{webhooks: map[int64]*hook{}}
+}
+
+func (s *store) add(webhookID int64, event string) *data.Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery := &data.Delivery{
+		ID:        int64(len(s.deliveries) + 1),
+		CreatedAt: time.Now(),
+		WebhookID: webhookID,
+		Event:     event,
+		Payload:   json.RawMessage(`{"comment_id":7}`),
+		Status:    data.DeliveryPending,
+	}
+	s.deliveries = append(s.deliveries, delivery)
+	return delivery
+}
+
+func (s *store) ClaimDue(limit int, lease time.Duration) ([]*data.Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	claimed := []*data.Delivery{}
+	for _, delivery := range s.deliveries {
+		webhook := s.webhooks[delivery.WebhookID]
+		if len(claimed) == limit || delivery.Status != data.DeliveryPending || !webhook.enabled {
+			continue
+		}
+		if delivery.NextAttemptAt != nil && delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		delivery.Attempts++
+		next := now.Add(lease)
+		delivery.NextAttemptAt = &next
+		// the worker gets its own copy, like a row from the database
+		copied := *delivery
+		copied.URL = webhook.url
+		copied.Secret = webhook.secret
+		claimed = append(claimed, &copied)
+	}
+	return claimed, nil
+}
+
+func (s *store) RecordAttempt(delivery *data.Delivery, retryAt *time.Time, disableAfter int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	succeeded := delivery.Status == data.DeliverySucceeded
+	if !succeeded {
+		delivery.Status = data.DeliveryPending
+		if retryAt == nil {
+			delivery.Status = data.DeliveryFailed
+		}
+	}
+
+	stored := s.deliveries[delivery.ID-1]
+	stored.Status = delivery.Status
+	if retryAt != nil {
+		stored.NextAttemptAt = retryAt
+	}
+	stored.Attempts = delivery.Attempts
+	stored.ResponseCode = delivery.ResponseCode
+	stored.LastError = delivery.LastError
+	s.retries = append(s.retries, retryAt)
+
+	if disableAfter == 0 {
+		return nil
+	}
+	webhook := s.webhooks[delivery.WebhookID]
+	if succeeded {
+		webhook.failures = 0
+		return nil
+	}
+	webhook.failures++
+	if webhook.failures >= disableAfter {
+		webhook.enabled = false
+	}
+	return nil
+}
+
+func (s *store) delivery(id int64) data.Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.deliveries[id-1]
+}
+
+func (s *store) webhook(id int64) hook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.webhooks[id]
+}
+
+// receiver answers with the statuses in turn, the last one over and over
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	times    []time.Time
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	rc.times = append(rc.times, time.Now())
+
+	status := rc.statuses[min(len(rc.requests), len(rc.statuses))-1]
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.requests)
+}
+
+func newWorker(s *store) *Worker {
+	return &Worker{
+		Model:        s,
+		Client:       &http.Client{Timeout: time.Second},
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		PollInterval: time.Millisecond,
+		BatchSize:    10,
+		MaxAttempts:  3,
+		BaseBackoff:  50 * time.Millisecond,
+		DisableAfter: 5,
+	}
+}
+
+// run keeps the worker going until done says so
+func run(t *testing.T, wk *Worker, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("the worker did not finish in time")
+		}
+		wk.RunOnce(context.Background())
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDeliverySignature(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusNoContent}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	s := newStore()
+	s.webhooks[1] = &hook{url: server.URL, secret: "s3cret", enabled: true}
+	s.add(1, data.EventCommentCreated)
+
+	wk := newWorker(s)
+	run(t, wk, func() bool { return s.delivery(1).Status != data.DeliveryPending })
+
+	if got := s.delivery(1).Status; got != data.DeliverySucceeded {
+		t.Fatalf("status = %q, want %q", got, data.DeliverySucceeded)
+	}
+	if rc.count() != 1 {
+		t.Fatalf("the receiver got %d requests, want 1", rc.count())
+	}
+
+	r, body := rc.requests[0], rc.bodies[0]
+	if got := r.Header.Get(EventHeader); got != data.EventCommentCreated {
+		t.Errorf("%s = %q, want %q", EventHeader, got, data.EventCommentCreated)
+	}
+	if got := r.Header.Get(DeliveryHeader); got != "1" {
+		t.Errorf("%s = %q, want %q", DeliveryHeader, got, "1")
+	}
+
+	// recompute the signature the way a receiver would
+	timestamp := r.Header.Get(TimestampHeader)
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		t.Fatalf("%s = %q is not a unix time", TimestampHeader, timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get(SignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("%s = %q, want %q", SignatureHeader, got, want)
+	}
+
+	var msg struct {
+		ID    int64           `json:"id"`
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 1 || msg.Event != data.EventCommentCreated || string(msg.Data) != `{"comment_id":7}` {
+		t.Errorf("body = %s", body)
+	}
+}
+
+func TestDeliveryRetriesWithBackoff(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	s := newStore()
+	s.webhooks[1] = &hook{url: server.URL, secret: "s3cret", enabled: true}
+	s.add(1, data.EventCommentCreated)
+
+	wk := newWorker(s)
+	run(t, wk, func() bool { return s.delivery(1).Status != data.DeliveryPending })
+
+	delivery := s.delivery(1)
+	if delivery.Status != data.DeliverySucceeded || delivery.Attempts != 3 {
+		t.Fatalf("status = %q after %d attempts, want %q after 3", delivery.Status, delivery.Attempts, data.DeliverySucceeded)
+	}
+	// every retry waits for the backoff of the attempts so far
+	for i := 1; i < len(rc.times); i++ {
+		if gap, backoff := rc.times[i].Sub(rc.times[i-1]), wk.Backoff(i); gap < backoff {
+			t.Errorf("attempt %d came %s after the previous one, want at least %s", i+1, gap, backoff)
+		}
+	}
+	if got := s.webhook(1).failures; got != 0 {
+		t.Errorf("consecutive failures = %d after a success, want 0", got)
+	}
+}
+
+func TestDeliveryGivesUpAfterMaxAttempts(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	s := newStore()
+	s.webhooks[1] = &hook{url: server.URL, secret: "s3cret", enabled: true}
+	s.add(1, data.EventCommentCreated)
+
+	wk := newWorker(s)
+	run(t, wk, func() bool { return s.delivery(1).Status != data.DeliveryPending })
+
+	delivery := s.delivery(1)
+	if delivery.Status != data.DeliveryFailed || delivery.Attempts != wk.MaxAttempts {
+		t.Fatalf("status = %q after %d attempts, want %q after %d", delivery.Status, delivery.Attempts, data.DeliveryFailed, wk.MaxAttempts)
+	}
+	if delivery.ResponseCode == nil || *delivery.ResponseCode != http.StatusServiceUnavailable {
+		t.Errorf("response code = %v, want %d", delivery.ResponseCode, http.StatusServiceUnavailable)
+	}
+	if s.retries[len(s.retries)-1] != nil {
+		t.Error("the last attempt was scheduled for a retry")
+	}
+	if rc.count() != wk.MaxAttempts {
+		t.Errorf("the receiver got %d requests, want %d", rc.count(), wk.MaxAttempts)
+	}
+}
+
+func TestWebhookDisabledAfterFailures(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	s := newStore()
+	s.webhooks[1] = &hook{url: server.URL, secret: "s3cret", enabled: true}
+	for range 3 {
+		s.add(1, data.EventCommentCreated)
+	}
+
+	wk := newWorker(s)
+	// one at a time, a claimed batch is sent even when the webhook is disabled meanwhile
+	wk.BatchSize = 1
+	wk.MaxAttempts = 1
+	wk.DisableAfter = 2
+	run(t, wk, func() bool { return !s.webhook(1).enabled })
+
+	// nothing is sent to a disabled webhook
+	wk.RunOnce(context.Background())
+	if rc.count() != 2 {
+		t.Errorf("the receiver got %d requests, want 2", rc.count())
+	}
+	if got := s.delivery(3).Status; got != data.DeliveryPending {
+		t.Errorf("status of the third delivery = %q, want %q", got, data.DeliveryPending)
+	}
+}
+
+func TestTestEventsDoNotCountAsFailures(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusInternalServerError}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	s := newStore()
+	s.webhooks[1] = &hook{url: server.URL, secret: "s3cret", enabled: true}
+
+	wk := newWorker(s)
+	wk.DisableAfter = 1
+	for range 3 {
+		delivery := s.add(1, data.EventWebhookTest)
+		delivery.Attempts = 1
+		delivery.URL = server.URL
+		delivery.Secret = "s3cret"
+		wk.Deliver(context.Background(), delivery, false)
+		if delivery.Status != data.DeliveryFailed {
+			t.Fatalf("status = %q, want %q", delivery.Status, data.DeliveryFailed)
+		}
+	}
+
+	webhook := s.webhook(1)
+	if webhook.failures != 0 || !webhook.enabled {
+		t.Errorf("after failed test events: consecutive failures = %d, enabled = %t; want 0, true", webhook.failures, webhook.enabled)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	wk := &Worker{BaseBackoff: 30 * time.Second}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{6, 16 * time.Minute},
+		{20, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := wk.Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
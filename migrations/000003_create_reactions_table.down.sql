@@ -0,0 +1,2 @@
+-- Filename: migrations/000003_create_reactions_table.down.sql
+DROP TABLE IF EXISTS reactions;
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- Filename: migrations/000003_create_reactions_table.up.sql
+CREATE TABLE IF NOT EXISTS reactions (
+    comment_id bigint NOT NULL REFERENCES comments ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    kind text NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (comment_id, user_id, kind)
+);
+
+CREATE INDEX IF NOT EXISTS reactions_comment_id_kind_idx ON reactions (comment_id, kind);
\ No newline at end of file
@@ -0,0 +1,5 @@
+-- Filename: migrations/000004_add_comment_moderation.down.sql
+DROP TABLE IF EXISTS moderation_actions;
+DROP TABLE IF EXISTS comment_reports;
+ALTER TABLE comments DROP CONSTRAINT IF EXISTS comments_status_check;
+ALTER TABLE comments DROP COLUMN IF EXISTS status;
\ No newline at end of file
@@ -0,0 +1,26 @@
+-- Filename: migrations/000004_add_comment_moderation.up.sql
+-- existing comments were already live so they start out approved
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'approved';
+ALTER TABLE comments ADD CONSTRAINT comments_status_check
+    CHECK (status IN ('pending', 'approved', 'rejected', 'hidden'));
+CREATE INDEX IF NOT EXISTS comments_status_idx ON comments (status);
+
+CREATE TABLE IF NOT EXISTS comment_reports (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    comment_id bigint NOT NULL REFERENCES comments ON DELETE CASCADE,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    reason text NOT NULL,
+    resolved_at timestamp(0) WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS comment_reports_unresolved_idx
+    ON comment_reports (comment_id) WHERE resolved_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS moderation_actions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    comment_id bigint NOT NULL REFERENCES comments ON DELETE CASCADE,
+    action text NOT NULL,
+    reason text NOT NULL,
+    moderator text NOT NULL
+);
\ No newline at end of file
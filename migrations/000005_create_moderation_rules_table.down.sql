@@ -0,0 +1,3 @@
+-- Filename: migrations/000005_create_moderation_rules_table.down.sql
+ALTER TABLE comments DROP COLUMN IF EXISTS matched_rule_id;
+DROP TABLE IF EXISTS moderation_rules;
\ No newline at end of file
@@ -0,0 +1,19 @@
+-- Filename: migrations/000005_create_moderation_rules_table.up.sql
+CREATE TABLE IF NOT EXISTS moderation_rules (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    kind text NOT NULL,
+    keywords text[] NOT NULL DEFAULT '{}',
+    pattern text NOT NULL DEFAULT '',
+    threshold integer NOT NULL DEFAULT 0,
+    action text NOT NULL,
+    enabled boolean NOT NULL DEFAULT true,
+    hits bigint NOT NULL DEFAULT 0,
+    last_hit_at timestamp(0) WITH TIME ZONE,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- the rule that decided what happened to the comment
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS matched_rule_id bigint
+    REFERENCES moderation_rules ON DELETE SET NULL;
\ No newline at end of file
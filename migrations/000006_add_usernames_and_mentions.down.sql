@@ -0,0 +1,4 @@
+-- Filename: migrations/000006_add_usernames_and_mentions.down.sql
+DROP TABLE IF EXISTS comment_mentions;
+DROP INDEX IF EXISTS users_username_unique_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS username;
\ No newline at end of file
@@ -0,0 +1,15 @@
+-- Filename: migrations/000006_add_usernames_and_mentions.up.sql
+-- existing users get a placeholder username that they can change later
+ALTER TABLE users ADD COLUMN IF NOT EXISTS username text;
+UPDATE users SET username = 'user' || id WHERE username IS NULL;
+ALTER TABLE users ALTER COLUMN username SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_unique_idx ON users (lower(username));
+
+CREATE TABLE IF NOT EXISTS comment_mentions (
+    comment_id bigint NOT NULL REFERENCES comments ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    start_offset integer NOT NULL,
+    end_offset integer NOT NULL,
+    PRIMARY KEY (comment_id, start_offset)
+);
+CREATE INDEX IF NOT EXISTS comment_mentions_user_id_idx ON comment_mentions (user_id);
\ No newline at end of file
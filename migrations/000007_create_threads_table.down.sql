@@ -0,0 +1,3 @@
+-- Filename: migrations/000007_create_threads_table.down.sql
+ALTER TABLE comments DROP COLUMN IF EXISTS thread_id;
+DROP TABLE IF EXISTS threads;
\ No newline at end of file
@@ -0,0 +1,14 @@
+-- Filename: migrations/000007_create_threads_table.up.sql
+CREATE TABLE IF NOT EXISTS threads (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    key text NOT NULL UNIQUE,
+    title text NOT NULL DEFAULT '',
+    metadata jsonb NOT NULL DEFAULT '{}',
+    pre_moderation boolean NOT NULL DEFAULT false,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- comments created before threads existed stay in the global list
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS thread_id bigint REFERENCES threads ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS comments_thread_id_idx ON comments (thread_id);
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- Filename: migrations/000008_create_webhooks_tables.down.sql
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
\ No newline at end of file
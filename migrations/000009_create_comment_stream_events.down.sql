@@ -0,0 +1,4 @@
+-- Filename: migrations/000009_create_comment_stream_events.down.sql
+DROP TRIGGER IF EXISTS comments_stream_notify ON comments;
+DROP FUNCTION IF EXISTS comment_stream_notify();
+DROP TABLE IF EXISTS comment_stream_events;
\ No newline at end of file
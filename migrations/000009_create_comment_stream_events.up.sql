@@ -0,0 +1,59 @@
+-- Filename: migrations/000009_create_comment_stream_events.up.sql
+-- every change to a public comment is written here and announced with NOTIFY so
+-- that every API instance can push it to its stream subscribers. The ids double
+-- as the SSE event ids used to resume with Last-Event-ID
+CREATE TABLE IF NOT EXISTS comment_stream_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    type text NOT NULL,
+    comment_id bigint NOT NULL,
+    author text NOT NULL,
+    thread_id bigint,
+    data jsonb NOT NULL
+);
+CREATE INDEX IF NOT EXISTS comment_stream_events_created_at_idx ON comment_stream_events (created_at);
+
+CREATE OR REPLACE FUNCTION comment_stream_notify() RETURNS trigger AS $$
+DECLARE
+    event_type text;
+    row_data comments;
+BEGIN
+    -- only approved comments are public. A comment that stops being approved
+    -- is gone as far as the stream is concerned, one that becomes approved is new
+    IF TG_OP = 'INSERT' THEN
+        IF NEW.status = 'approved' THEN event_type := 'comment.created'; END IF;
+        row_data := NEW;
+    ELSIF TG_OP = 'UPDATE' THEN
+        IF NEW.status = 'approved' AND OLD.status = 'approved' THEN event_type := 'comment.updated';
+        ELSIF NEW.status = 'approved' THEN event_type := 'comment.created';
+        ELSIF OLD.status = 'approved' THEN event_type := 'comment.deleted';
+        END IF;
+        row_data := NEW;
+    ELSE
+        IF OLD.status = 'approved' THEN event_type := 'comment.deleted'; END IF;
+        row_data := OLD;
+    END IF;
+
+    IF event_type IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    INSERT INTO comment_stream_events (type, comment_id, author, thread_id, data)
+    VALUES (event_type, row_data.id, row_data.author, row_data.thread_id,
+        CASE WHEN event_type = 'comment.deleted'
+            THEN jsonb_build_object('id', row_data.id)
+            ELSE jsonb_build_object('id', row_data.id, 'content', row_data.content,
+                'author', row_data.author, 'thread_id', row_data.thread_id,
+                'version', row_data.version)
+        END);
+
+    -- the payload is only a wake up call, listeners read the table
+    PERFORM pg_notify('comment_stream', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS comments_stream_notify ON comments;
+CREATE TRIGGER comments_stream_notify
+    AFTER INSERT OR UPDATE OR DELETE ON comments
+    FOR EACH ROW EXECUTE FUNCTION comment_stream_notify();
\ No newline at end of file
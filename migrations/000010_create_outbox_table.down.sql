@@ -0,0 +1,4 @@
+-- Filename: migrations/000010_create_outbox_table.down.sql
+DROP INDEX IF EXISTS webhook_deliveries_outbox_idx;
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS outbox_id;
+DROP TABLE IF EXISTS outbox;
\ No newline at end of file
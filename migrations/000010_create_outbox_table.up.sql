@@ -0,0 +1,20 @@
+-- Filename: migrations/000010_create_outbox_table.up.sql
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    event text NOT NULL,
+    -- the comment or user the event is about
+    aggregate_id bigint NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    next_attempt_at timestamp WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    published_at timestamp(0) WITH TIME ZONE,
+    CONSTRAINT outbox_status_check CHECK (status IN ('pending', 'published', 'dead'))
+);
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE status = 'pending';
+
+-- the relay may hand the same event over twice, this lets the webhooks ignore the repeat
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS outbox_id bigint;
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_outbox_idx ON webhook_deliveries (webhook_id, outbox_id);
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- Filename: migrations/000011_create_notification_tables.down.sql
+DROP TABLE IF EXISTS digest_runs;
+DROP TABLE IF EXISTS emails;
+DROP TABLE IF EXISTS notification_preferences;
+DROP INDEX IF EXISTS comments_parent_id_idx;
+ALTER TABLE comments DROP COLUMN IF EXISTS parent_id;
\ No newline at end of file
@@ -0,0 +1,37 @@
+-- Filename: migrations/000011_create_notification_tables.up.sql
+-- a comment can answer another one, the author of the parent is told about the reply
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS parent_id bigint REFERENCES comments ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS comments_parent_id_idx ON comments (parent_id);
+
+-- users without a row get the defaults
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    mentions boolean NOT NULL DEFAULT true,
+    replies boolean NOT NULL DEFAULT true,
+    digest boolean NOT NULL DEFAULT false,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- the emails waiting to be sent, and the ones that were
+CREATE TABLE IF NOT EXISTS emails (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    -- the outbox event that caused the email, the relay may hand it over twice
+    outbox_id bigint,
+    recipient text NOT NULL,
+    template text NOT NULL,
+    data jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    next_attempt_at timestamp WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    sent_at timestamp(0) WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS emails_due_idx ON emails (next_attempt_at) WHERE status = 'pending';
+CREATE UNIQUE INDEX IF NOT EXISTS emails_outbox_idx ON emails (outbox_id, template, recipient);
+
+-- one row per day makes sure the digest goes out once, whichever instance sends it
+CREATE TABLE IF NOT EXISTS digest_runs (
+    day date PRIMARY KEY,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
\ No newline at end of file
@@ -0,0 +1,9 @@
+-- Filename: migrations/000012_add_comments_search_vector.down.sql
+DROP TRIGGER IF EXISTS comments_stream_notify ON comments;
+CREATE TRIGGER comments_stream_notify
+    AFTER INSERT OR UPDATE OR DELETE ON comments
+    FOR EACH ROW EXECUTE FUNCTION comment_stream_notify();
+
+DROP INDEX IF EXISTS comments_search_vector_idx;
+ALTER TABLE comments DROP COLUMN IF EXISTS search_vector;
+ALTER TABLE comments DROP COLUMN IF EXISTS search_config;
\ No newline at end of file
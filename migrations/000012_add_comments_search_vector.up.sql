@@ -0,0 +1,15 @@
+-- Filename: migrations/000012_add_comments_search_vector.up.sql
+-- the text search configuration of each row, cmd/search-config changes the
+-- default and updates the rows for a different -search-config
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS search_config regconfig NOT NULL DEFAULT 'english';
+
+-- computed once when the comment is written instead of on every search
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector(search_config, content)) STORED;
+CREATE INDEX IF NOT EXISTS comments_search_vector_idx ON comments USING GIN (search_vector);
+
+-- re-indexing must not look like an edit to the stream subscribers
+DROP TRIGGER IF EXISTS comments_stream_notify ON comments;
+CREATE TRIGGER comments_stream_notify
+    AFTER INSERT OR UPDATE OF content, author, status, thread_id OR DELETE ON comments
+    FOR EACH ROW EXECUTE FUNCTION comment_stream_notify();
\ No newline at end of file
@@ -0,0 +1,5 @@
+-- Filename: migrations/000013_add_updated_at_columns.down.sql
+DROP INDEX IF EXISTS comments_updated_at_idx;
+DROP INDEX IF EXISTS comments_created_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE comments DROP COLUMN IF EXISTS updated_at;
\ No newline at end of file
@@ -0,0 +1,11 @@
+-- Filename: migrations/000013_add_updated_at_columns.up.sql
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS updated_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+-- nothing has been updated yet as far as we know
+UPDATE comments SET updated_at = created_at;
+UPDATE users SET updated_at = created_at;
+
+-- for the created_after, created_before and updated_since filters and sorting
+CREATE INDEX IF NOT EXISTS comments_created_at_idx ON comments (created_at);
+CREATE INDEX IF NOT EXISTS comments_updated_at_idx ON comments (updated_at);
\ No newline at end of file
@@ -0,0 +1,17 @@
+-- Filename: migrations/000014_create_idempotency_keys.up.sql
+-- the first response to a request with an Idempotency-Key, replayed when the client retries
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    -- the method and path, e.g. POST /v1/comments, a key only counts for one endpoint
+    scope text NOT NULL,
+    key text NOT NULL,
+    -- a hash of the request, the same key with another request is an error
+    fingerprint text NOT NULL,
+    created_at timestamp(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) WITH TIME ZONE NOT NULL,
+    -- NULL while the first request is still running
+    status_code integer,
+    headers jsonb,
+    body bytea,
+    PRIMARY KEY (scope, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
\ No newline at end of file
@@ -0,0 +1,5 @@
+-- Filename: migrations/000015_create_cache_invalidation_triggers.down.sql
+DROP TRIGGER IF EXISTS users_cache_invalidation ON users;
+DROP TRIGGER IF EXISTS reactions_cache_invalidation ON reactions;
+DROP TRIGGER IF EXISTS comments_cache_invalidation ON comments;
+DROP FUNCTION IF EXISTS cache_invalidation_notify();
\ No newline at end of file
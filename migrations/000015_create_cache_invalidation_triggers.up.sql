@@ -0,0 +1,38 @@
+-- Filename: migrations/000015_create_cache_invalidation_triggers.up.sql
+-- every instance keeps a read cache of comments and users. These triggers tell
+-- all of them what changed, whoever changed it: the models, the reactions,
+-- the moderation or an import. A payload sent twice in a transaction is sent once
+CREATE OR REPLACE FUNCTION cache_invalidation_notify() RETURNS trigger AS $$
+DECLARE
+    row_data record;
+    row_id bigint;
+BEGIN
+    IF TG_OP = 'DELETE' THEN row_data := OLD; ELSE row_data := NEW; END IF;
+    -- a reaction changes its comment
+    IF TG_TABLE_NAME = 'reactions' THEN
+        row_id := row_data.comment_id;
+    ELSE
+        row_id := row_data.id;
+    END IF;
+
+    PERFORM pg_notify('cache_invalidation', TG_ARGV[0] || ':' || row_id);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS comments_cache_invalidation ON comments;
+CREATE TRIGGER comments_cache_invalidation
+    AFTER INSERT OR UPDATE OR DELETE ON comments
+    FOR EACH ROW EXECUTE FUNCTION cache_invalidation_notify('comments');
+
+-- the reaction counts are part of the comment
+DROP TRIGGER IF EXISTS reactions_cache_invalidation ON reactions;
+CREATE TRIGGER reactions_cache_invalidation
+    AFTER INSERT OR UPDATE OR DELETE ON reactions
+    FOR EACH ROW EXECUTE FUNCTION cache_invalidation_notify('comments');
+
+-- a new user is in no cache yet
+DROP TRIGGER IF EXISTS users_cache_invalidation ON users;
+CREATE TRIGGER users_cache_invalidation
+    AFTER UPDATE OR DELETE ON users
+    FOR EACH ROW EXECUTE FUNCTION cache_invalidation_notify('users');
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- Filename: migrations/000016_add_comment_stream_event_txids.down.sql
+DROP INDEX IF EXISTS comment_stream_events_txid_id_idx;
+ALTER TABLE comment_stream_events DROP COLUMN IF EXISTS txid;
\ No newline at end of file
@@ -0,0 +1,9 @@
+-- Filename: migrations/000016_add_comment_stream_event_txids.up.sql
+-- ids are handed out before commit, so a smaller id can become visible after a
+-- bigger one. The transaction id tells the listeners when an event is final: once
+-- it is older than every running transaction nothing can commit before it anymore.
+-- The events that exist get the id of this migration, they are all final
+ALTER TABLE comment_stream_events ADD COLUMN IF NOT EXISTS txid xid8 NOT NULL DEFAULT pg_current_xact_id();
+
+-- the stream is read in (txid, id) order
+CREATE INDEX IF NOT EXISTS comment_stream_events_txid_id_idx ON comment_stream_events (txid, id);
\ No newline at end of file
@@ -0,0 +1,4 @@
+-- Filename: migrations/000017_add_outbox_sequence.down.sql
+DROP INDEX IF EXISTS outbox_pending_idx;
+ALTER TABLE outbox DROP COLUMN IF EXISTS sequence;
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE status = 'pending';
\ No newline at end of file
@@ -0,0 +1,9 @@
+-- Filename: migrations/000017_add_outbox_sequence.up.sql
+-- the order the relay publishes in. It starts out as the id and a retried
+-- dead event gets a new one, so it goes after the events that are pending
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS sequence bigserial;
+UPDATE outbox SET sequence = id;
+SELECT setval('outbox_sequence_seq', COALESCE(MAX(id), 0) + 1, false) FROM outbox;
+
+DROP INDEX IF EXISTS outbox_pending_idx;
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (sequence) WHERE status = 'pending';
\ No newline at end of file
@@ -0,0 +1,4 @@
+-- Filename: migrations/000018_add_outbox_txids.down.sql
+DROP INDEX IF EXISTS outbox_pending_idx;
+ALTER TABLE outbox DROP COLUMN IF EXISTS txid;
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (sequence) WHERE status = 'pending';
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- Filename: migrations/000018_add_outbox_txids.up.sql
+-- the sequence is handed out before commit, so an event can become visible after
+-- the ones behind it. The relay only takes events whose transaction is older than
+-- every running one, nothing can commit before them anymore. The events that
+-- exist get the id of this migration, they are all final
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS txid xid8 NOT NULL DEFAULT pg_current_xact_id();
+
+-- the relay reads the pending events in (txid, sequence) order
+DROP INDEX IF EXISTS outbox_pending_idx;
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (txid, sequence) WHERE status = 'pending';
\ No newline at end of file